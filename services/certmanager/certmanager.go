@@ -19,6 +19,10 @@ import (
 	"github.com/untangle/golang-shared/services/settings"
 )
 
+// selfSignedCertPath and selfSignedKeyPath are where the self signed certificate of the admin UI is kept
+const selfSignedCertPath = "/tmp/cert.pem"
+const selfSignedKeyPath = "/tmp/cert.key"
+
 // Startup is called when the packetd service starts
 func Startup() {
 	logger.Info("Starting up the certificate manager service\n")
@@ -35,6 +39,12 @@ func GetConfiguredCert() (certPath string, keyPath string) {
 	return
 }
 
+// GetCertificateFiles returns the certificate and key files managed by the certificate manager
+// these are included in configuration backups
+func GetCertificateFiles() []string {
+	return []string{selfSignedCertPath, selfSignedKeyPath}
+}
+
 // generateSelfSigned will generate a self signed cert into the /tmp/ directory, the cert will be valid for 10 years
 // most of the logic taken from here: https://golang.org/src/crypto/tls/generate_cert.go
 func generateSelfSigned() (certPath string, keyPath string) {
@@ -43,8 +53,8 @@ func generateSelfSigned() (certPath string, keyPath string) {
 	var certKey *ecdsa.PrivateKey
 	var certBytes []byte
 
-	certPath = "/tmp/cert.pem"
-	keyPath = "/tmp/cert.key"
+	certPath = selfSignedCertPath
+	keyPath = selfSignedKeyPath
 
 	logger.Debug("Validating existing cert and path...\n")
 	if !checkCertKeyValidity(certPath, keyPath) {
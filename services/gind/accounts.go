@@ -0,0 +1,470 @@
+package gind
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// bcryptMaxPasswordLength is the number of bytes of a password bcrypt uses, the rest is ignored
+const bcryptMaxPasswordLength = 72
+
+// validUsername matches the usernames that may be used for new accounts
+var validUsername = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.@-]{0,63}$`)
+
+// passwordPolicy holds the password policy part of the system.restd.passwords settings
+type passwordPolicy struct {
+	minLength     int
+	maxLength     int
+	minClasses    int
+	historySize   int
+	allowUsername bool
+}
+
+// passwordChangeRequest is the body of a POST to /api/account/password
+type passwordChangeRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// accountRequest is the body of a POST to /api/accounts or a PUT to /api/accounts/:username
+// fields that are not specified in a PUT are left unchanged
+type accountRequest struct {
+	Username     string  `json:"username"`
+	Password     *string `json:"password"`
+	Role         *string `json:"role"`
+	Email        *string `json:"email"`
+	TOTPRequired *bool   `json:"totpRequired"`
+}
+
+// getPasswordPolicy reads the password policy settings, applying defaults for anything not configured
+func getPasswordPolicy() passwordPolicy {
+	jsonObject := getRestdSettings("passwords")
+	policy := passwordPolicy{
+		minLength:     int(settingInt(jsonObject, "minLength", 8)),
+		maxLength:     int(settingInt(jsonObject, "maxLength", 128)),
+		minClasses:    int(settingInt(jsonObject, "minCharacterClasses", 2)),
+		historySize:   int(settingInt(jsonObject, "historySize", 5)),
+		allowUsername: settingBool(jsonObject, "allowUsername", false),
+	}
+	if getPasswordConfig().algorithm == PasswordBcrypt && policy.maxLength > bcryptMaxPasswordLength {
+		policy.maxLength = bcryptMaxPasswordLength
+	}
+	return policy
+}
+
+// checkPasswordPolicy returns an error describing why the password is not allowed for the
+// specified account, or nil if it is allowed
+// credentialsJSON holds the current credentials of the account, or nil for a new account
+func checkPasswordPolicy(username string, password string, credentialsJSON map[string]interface{}) error {
+	policy := getPasswordPolicy()
+
+	if len(password) < policy.minLength {
+		return fmt.Errorf("Password must be at least %d characters", policy.minLength)
+	}
+	if len(password) > policy.maxLength {
+		return fmt.Errorf("Password must be at most %d characters", policy.maxLength)
+	}
+
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < policy.minClasses {
+		return fmt.Errorf("Password must contain at least %d of: lowercase letters, uppercase letters, digits, symbols", policy.minClasses)
+	}
+
+	if !policy.allowUsername && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errors.New("Password must not contain the username")
+	}
+
+	if credentialsJSON != nil && policy.historySize > 0 {
+		for _, hash := range passwordHistory(credentialsJSON, policy.historySize) {
+			if verifyPassword(hash, password) {
+				return fmt.Errorf("Password must not match any of the last %d passwords", policy.historySize)
+			}
+		}
+	}
+	return nil
+}
+
+// passwordHistory returns the current password hash followed by up to size-1 previous hashes
+func passwordHistory(credentialsJSON map[string]interface{}, size int) []string {
+	history := []string{}
+	if hash, ok := getPasswordHash(credentialsJSON); ok {
+		history = append(history, hash)
+	}
+	previous, _ := credentialsJSON["passwordHistory"].([]interface{})
+	for _, json := range previous {
+		if len(history) >= size {
+			break
+		}
+		if hash, ok := json.(string); ok {
+			history = append(history, hash)
+		}
+	}
+	return history
+}
+
+// setPassword stores the password hash in the credentials, keeping the replaced hash in the password history
+func setPassword(cred map[string]interface{}, hash string) {
+	size := getPasswordPolicy().historySize
+	history := []interface{}{}
+	if size > 0 {
+		for _, h := range passwordHistory(cred, size) {
+			history = append(history, h)
+		}
+	}
+
+	cred["passwordHash"] = hash
+	cred["passwordHistory"] = history
+	cred["lastPasswordChange"] = time.Now().Unix()
+	delete(cred, "passwordHashMD5")
+	delete(cred, "passwordCleartext")
+}
+
+// statusError is an error of a settings update that is sent to the client with its status code
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// sendStatusError sends the error of a settings update, with its own status if it is a statusError
+// and as a 500 with the message prepended otherwise
+func sendStatusError(c *gin.Context, message string, err error) {
+	if statusErr, ok := err.(*statusError); ok {
+		c.JSON(statusErr.status, gin.H{"error": statusErr.message})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message + ": " + err.Error()})
+}
+
+// isLastAdmin returns true if the specified account is the only account with the admin role
+// credentials without a role are admins, see getUserRole
+func isLastAdmin(credentialsSlice []interface{}, username string) bool {
+	found := false
+	for _, json := range credentialsSlice {
+		cred, ok := json.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		role, _ := cred["role"].(string)
+		if role != "" && strings.ToLower(role) != RoleAdmin {
+			continue
+		}
+		if cred["username"] != username {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// checkRoleGrant verifies the role is valid and not broader than the permissions of the request
+// if not it sends the error response and returns false
+func checkRoleGrant(c *gin.Context, role string) bool {
+	if _, ok := rolePermissions[role]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: unknown role " + role})
+		return false
+	}
+	for _, p := range rolePermissions[role] {
+		if !requestHasPermission(c, p) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied: missing permission " + string(p), "permission": p})
+			return false
+		}
+	}
+	return true
+}
+
+// accountPasswordChange is the POST /api/account/password handler
+// it changes the password of the current user, which requires the current password
+func accountPasswordChange(c *gin.Context) {
+	var request passwordChangeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	username := getAuthUsername(c)
+	credentialsJSON := getCredentials(username)
+	if credentialsJSON == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Account " + username + " has no password"})
+		return
+	}
+
+	if !validateLocalPassword(c, username, request.CurrentPassword) {
+		if !c.IsAborted() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Current password is incorrect"})
+		}
+		return
+	}
+
+	if err := checkPasswordPolicy(username, request.NewPassword, credentialsJSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	hash, err := hashPassword(request.NewPassword, getPasswordConfig())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password: " + err.Error()})
+		return
+	}
+
+	err = updateCredentials(username, func(cred map[string]interface{}) {
+		setPassword(cred, hash)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save password: " + err.Error()})
+		return
+	}
+
+	// every other session of the user is logged out
+	sessionStore.revokeUser(username, currentSessionID(c))
+
+	logger.Info("Password changed for %v\n", username)
+	c.JSON(http.StatusOK, gin.H{"message": "Successfully changed password"})
+}
+
+// accountsList is the GET /api/accounts handler
+func accountsList(c *gin.Context) {
+	credentialsSlice, err := getStoredCredentials()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read accounts: " + err.Error()})
+		return
+	}
+
+	result := []map[string]interface{}{}
+	for _, json := range credentialsSlice {
+		cred, ok := json.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		result = append(result, publicCredentials(cred))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return fmt.Sprint(result[i]["username"]) < fmt.Sprint(result[j]["username"])
+	})
+	c.JSON(http.StatusOK, result)
+}
+
+// accountsGet is the GET /api/accounts/:username handler
+func accountsGet(c *gin.Context) {
+	credentialsJSON := getCredentials(c.Param("username"))
+	if credentialsJSON == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return
+	}
+	c.JSON(http.StatusOK, publicCredentials(credentialsJSON))
+}
+
+// accountsCreate is the POST /api/accounts handler
+// accounts created without a role get the read-only role, the least privileged one
+func accountsCreate(c *gin.Context) {
+	var request accountRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	username := request.Username
+	if !validUsername.MatchString(username) || builtinUsers[username] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: invalid username " + username})
+		return
+	}
+	if request.Password == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: missing password"})
+		return
+	}
+	role := RoleReadOnly
+	if request.Role != nil {
+		role = strings.ToLower(*request.Role)
+	}
+	if !checkRoleGrant(c, role) {
+		return
+	}
+	if err := checkPasswordPolicy(username, *request.Password, nil); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hash, err := hashPassword(*request.Password, getPasswordConfig())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password: " + err.Error()})
+		return
+	}
+
+	cred := map[string]interface{}{
+		"username": username,
+		"role":     role,
+	}
+	if request.Email != nil {
+		cred["email"] = *request.Email
+	}
+	if request.TOTPRequired != nil {
+		cred["totpRequired"] = *request.TOTPRequired
+	}
+	setPassword(cred, hash)
+
+	err = updateStoredCredentials(func(credentialsSlice []interface{}) ([]interface{}, error) {
+		for _, json := range credentialsSlice {
+			if existing, ok := json.(map[string]interface{}); ok && existing["username"] == username {
+				return nil, &statusError{http.StatusConflict, "Account " + username + " already exists"}
+			}
+		}
+		return append(credentialsSlice, cred), nil
+	})
+	if err != nil {
+		sendStatusError(c, "Failed to save account", err)
+		return
+	}
+
+	logger.Info("Created account %v (%v) by %v\n", username, role, getAuthUsername(c))
+	c.JSON(http.StatusOK, publicCredentials(cred))
+}
+
+// accountsUpdate is the PUT /api/accounts/:username handler
+// an administrator setting a password is not subject to the history check but is to the rest of the policy
+func accountsUpdate(c *gin.Context) {
+	var request accountRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	username := c.Param("username")
+	if request.Username != "" && request.Username != username {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: username can not be changed"})
+		return
+	}
+
+	var role string
+	if request.Role != nil {
+		role = strings.ToLower(*request.Role)
+		if !checkRoleGrant(c, role) {
+			return
+		}
+	}
+	var hash string
+	if request.Password != nil {
+		if err := checkPasswordPolicy(username, *request.Password, nil); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var err error
+		hash, err = hashPassword(*request.Password, getPasswordConfig())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password: " + err.Error()})
+			return
+		}
+	}
+
+	var cred map[string]interface{}
+	err := updateStoredCredentials(func(credentialsSlice []interface{}) ([]interface{}, error) {
+		for _, json := range credentialsSlice {
+			if m, ok := json.(map[string]interface{}); ok && m["username"] == username {
+				cred = m
+			}
+		}
+		if cred == nil {
+			return nil, &statusError{http.StatusNotFound, "Account not found"}
+		}
+
+		if request.Role != nil {
+			if role != RoleAdmin && isLastAdmin(credentialsSlice, username) {
+				return nil, &statusError{http.StatusBadRequest, "Can not remove the admin role from the last admin account"}
+			}
+			cred["role"] = role
+		}
+		if request.Email != nil {
+			cred["email"] = *request.Email
+		}
+		if request.TOTPRequired != nil {
+			cred["totpRequired"] = *request.TOTPRequired
+		}
+		if request.Password != nil {
+			setPassword(cred, hash)
+		}
+		return credentialsSlice, nil
+	})
+	if err != nil {
+		sendStatusError(c, "Failed to save account", err)
+		return
+	}
+	if request.Password != nil || request.Role != nil {
+		sessionStore.revokeUser(username, "")
+	}
+
+	logger.Info("Updated account %v by %v\n", username, getAuthUsername(c))
+	c.JSON(http.StatusOK, publicCredentials(cred))
+}
+
+// accountsDelete is the DELETE /api/accounts/:username handler
+// it also removes the sessions and API keys of the account
+func accountsDelete(c *gin.Context) {
+	username := c.Param("username")
+	if username == getAuthUsername(c) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Can not delete the current account"})
+		return
+	}
+
+	err := updateStoredCredentials(func(credentialsSlice []interface{}) ([]interface{}, error) {
+		kept := []interface{}{}
+		var deleted map[string]interface{}
+		for _, json := range credentialsSlice {
+			if cred, ok := json.(map[string]interface{}); ok && cred["username"] == username {
+				deleted = cred
+				continue
+			}
+			kept = append(kept, json)
+		}
+		if deleted == nil {
+			return nil, &statusError{http.StatusNotFound, "Account not found"}
+		}
+		if isLastAdmin(credentialsSlice, username) {
+			return nil, &statusError{http.StatusBadRequest, "Can not delete the last admin account"}
+		}
+		return kept, nil
+	})
+	if err != nil {
+		sendStatusError(c, "Failed to delete account", err)
+		return
+	}
+
+	sessionStore.revokeUser(username, "")
+	err = updateAPIKeys(func(allKeys []map[string]interface{}) ([]map[string]interface{}, error) {
+		keys := []map[string]interface{}{}
+		for _, key := range allKeys {
+			if key["username"] != username {
+				keys = append(keys, key)
+			}
+		}
+		return keys, nil
+	})
+	if err != nil {
+		logger.Warn("Failed to remove API keys of %v: %v\n", username, err)
+	}
+
+	logger.Info("Deleted account %v by %v\n", username, getAuthUsername(c))
+	c.JSON(http.StatusOK, gin.H{"message": "Successfully deleted account"})
+}
@@ -0,0 +1,332 @@
+package gind
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings"
+)
+
+// apiKeyPrefix is prepended to every generated API key so they can be told apart from other bearer tokens
+const apiKeyPrefix = "restd_"
+
+// apiKeyLastUsedFile stores the last used timestamps of the API keys
+// these are kept out of the settings so that using a key does not require a sync-settings run
+const apiKeyLastUsedFile = restdConfigDir + "/apikeys-lastused.json"
+
+// apiKeyLastUsedInterval is how often a key's last used timestamp is written to disk
+const apiKeyLastUsedInterval = 1 * time.Minute
+
+var apiKeyLastUsed map[string]int64
+var apiKeyLastSaved map[string]int64
+var apiKeyMutex sync.Mutex
+
+// apiKeyCreateRequest is the body of a POST to /api/account/keys
+type apiKeyCreateRequest struct {
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+	Expires int64  `json:"expires"`
+}
+
+// findAPIKey returns the API key passed as an "Authorization: Bearer" header, or "" if there is none
+func findAPIKey(c *gin.Context) string {
+	auth := strings.SplitN(c.Request.Header.Get("Authorization"), " ", 2)
+	if len(auth) != 2 || auth[0] != "Bearer" || !strings.HasPrefix(auth[1], apiKeyPrefix) {
+		return ""
+	}
+	return auth[1]
+}
+
+// checkAPIKey validates the specified API key against the stored key hashes
+// returns bool - true if the key is valid and not expired
+// returns map[string]interface{} - the settings of the matching API key
+func checkAPIKey(plaintext string) (bool, map[string]interface{}) {
+	hash := hashAPIKey(plaintext)
+	for _, key := range getAPIKeys() {
+		keyHash, _ := key["hash"].(string)
+		if subtle.ConstantTimeCompare([]byte(keyHash), []byte(hash)) != 1 {
+			continue
+		}
+
+		expires := jsonInt64(key["expires"])
+		if expires != 0 && time.Now().Unix() > expires {
+			logger.Info("Expired API key used: %v\n", key["id"])
+			return false, nil
+		}
+
+		id, _ := key["id"].(string)
+		touchAPIKey(id)
+		return true, key
+	}
+
+	logger.Info("Invalid API key used\n")
+	return false, nil
+}
+
+// hashAPIKey returns the hex encoded SHA-256 of the specified key
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// getAPIKeys returns the API keys stored in the accounts.apiKeys settings
+func getAPIKeys() []map[string]interface{} {
+	keysJSON, err := settings.GetSettings([]string{"accounts", "apiKeys"})
+	if err != nil {
+		return []map[string]interface{}{}
+	}
+	return apiKeysFromSettings(keysJSON)
+}
+
+// apiKeysFromSettings returns the API keys of the accounts.apiKeys settings value
+func apiKeysFromSettings(keysJSON interface{}) []map[string]interface{} {
+	keys := []map[string]interface{}{}
+	if keysJSON == nil {
+		return keys
+	}
+	keysSlice, ok := keysJSON.([]interface{})
+	if !ok {
+		logger.Warn("Invalid type of accounts apiKeys settings: %v\n", keysJSON)
+		return keys
+	}
+
+	for _, json := range keysSlice {
+		key, ok := json.(map[string]interface{})
+		if !ok {
+			logger.Warn("Invalid type of accounts apiKeys entry: %v\n", json)
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// updateAPIKeys applies the update function to the API keys and writes the result to the accounts.apiKeys
+// settings, see updateSettings
+func updateAPIKeys(update func(keys []map[string]interface{}) ([]map[string]interface{}, error)) error {
+	return updateSettings([]string{"accounts", "apiKeys"}, func(keysJSON interface{}) (interface{}, error) {
+		return update(apiKeysFromSettings(keysJSON))
+	})
+}
+
+// touchAPIKey records that the API key with the specified id was just used
+func touchAPIKey(id string) {
+	now := time.Now().Unix()
+
+	apiKeyMutex.Lock()
+	defer apiKeyMutex.Unlock()
+
+	loadAPIKeyLastUsed()
+	apiKeyLastUsed[id] = now
+	if now-apiKeyLastSaved[id] < int64(apiKeyLastUsedInterval.Seconds()) {
+		return
+	}
+	apiKeyLastSaved[id] = now
+
+	data, err := json.Marshal(apiKeyLastUsed)
+	if err != nil {
+		logger.Warn("Failed to serialize API key usage: %v\n", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(apiKeyLastUsedFile), 0700); err != nil {
+		logger.Warn("Failed to create %v: %v\n", filepath.Dir(apiKeyLastUsedFile), err)
+		return
+	}
+	if err := ioutil.WriteFile(apiKeyLastUsedFile, data, 0600); err != nil {
+		logger.Warn("Failed to write %v: %v\n", apiKeyLastUsedFile, err)
+	}
+}
+
+// getAPIKeyLastUsed returns the last time the API key with the specified id was used, or 0 if never
+func getAPIKeyLastUsed(id string) int64 {
+	apiKeyMutex.Lock()
+	defer apiKeyMutex.Unlock()
+
+	loadAPIKeyLastUsed()
+	return apiKeyLastUsed[id]
+}
+
+// loadAPIKeyLastUsed reads the last used timestamps from disk the first time they are needed
+// the caller must hold apiKeyMutex
+func loadAPIKeyLastUsed() {
+	if apiKeyLastUsed != nil {
+		return
+	}
+
+	apiKeyLastUsed = make(map[string]int64)
+	apiKeyLastSaved = make(map[string]int64)
+
+	data, err := ioutil.ReadFile(apiKeyLastUsedFile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &apiKeyLastUsed); err != nil {
+		logger.Warn("Failed to parse %v: %v\n", apiKeyLastUsedFile, err)
+		apiKeyLastUsed = make(map[string]int64)
+	}
+}
+
+// apiKeysList is the GET /api/account/keys handler
+// it returns the keys of the current user, or every key for users with PermAccountsAdmin
+func apiKeysList(c *gin.Context) {
+	username := getAuthUsername(c)
+	all := requestHasPermission(c, PermAccountsAdmin)
+
+	result := []map[string]interface{}{}
+	for _, key := range getAPIKeys() {
+		if !all && key["username"] != username {
+			continue
+		}
+		result = append(result, apiKeyPublic(key))
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// apiKeysCreate is the POST /api/account/keys handler
+// it generates a new key for the current user and returns it, this is the only time the key itself is available
+func apiKeysCreate(c *gin.Context) {
+	var request apiKeyCreateRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: missing name"})
+		return
+	}
+	if request.Expires != 0 && request.Expires <= time.Now().Unix() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: expires is in the past"})
+		return
+	}
+
+	// a key may never be granted more than its owner has
+	username := getAuthUsername(c)
+	userRole := getRequestRole(c)
+	if request.Role == "" {
+		request.Role = userRole
+	}
+	if _, ok := rolePermissions[request.Role]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: unknown role " + request.Role})
+		return
+	}
+	for _, p := range rolePermissions[request.Role] {
+		if !requestHasPermission(c, p) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied: missing permission " + string(p), "permission": p})
+			return
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key: " + err.Error()})
+		return
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key: " + err.Error()})
+		return
+	}
+	plaintext := apiKeyPrefix + id + "_" + secret
+
+	key := map[string]interface{}{
+		"id":       id,
+		"name":     request.Name,
+		"username": username,
+		"role":     request.Role,
+		"hash":     hashAPIKey(plaintext),
+		"created":  time.Now().Unix(),
+	}
+	if request.Expires != 0 {
+		key["expires"] = request.Expires
+	}
+
+	err = updateAPIKeys(func(keys []map[string]interface{}) ([]map[string]interface{}, error) {
+		return append(keys, key), nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save key: " + err.Error()})
+		return
+	}
+
+	logger.Info("Created API key %v (%v) for %v\n", id, request.Name, username)
+	result := apiKeyPublic(key)
+	result["key"] = plaintext
+	c.JSON(http.StatusOK, result)
+}
+
+// apiKeysRevoke is the DELETE /api/account/keys/:id handler
+// users may revoke their own keys, users with PermAccountsAdmin may revoke any key
+func apiKeysRevoke(c *gin.Context) {
+	id := c.Param("id")
+	username := getAuthUsername(c)
+	all := requestHasPermission(c, PermAccountsAdmin)
+
+	err := updateAPIKeys(func(keys []map[string]interface{}) ([]map[string]interface{}, error) {
+		for i, key := range keys {
+			if key["id"] == id && (all || key["username"] == username) {
+				return append(keys[:i], keys[i+1:]...), nil
+			}
+		}
+		return nil, &statusError{http.StatusNotFound, "Key not found"}
+	})
+	if err != nil {
+		sendStatusError(c, "Failed to revoke key", err)
+		return
+	}
+
+	logger.Info("Revoked API key %v by %v\n", id, username)
+	c.JSON(http.StatusOK, gin.H{"message": "Successfully revoked key"})
+}
+
+// apiKeyPublic returns a copy of the API key settings with the hash removed and the last used timestamp added
+func apiKeyPublic(key map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for k, v := range key {
+		if k != "hash" {
+			result[k] = v
+		}
+	}
+	id, _ := key["id"].(string)
+	result["lastUsed"] = getAPIKeyLastUsed(id)
+	return result
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// jsonInt64 converts a number read from the settings JSON to an int64, returning 0 for anything else
+func jsonInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case json.Number:
+		i, _ := v.Int64()
+		return i
+	}
+	return 0
+}
@@ -0,0 +1,326 @@
+package gind
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// audit events
+const (
+	auditEventLogin        = "login"
+	auditEventLoginFailure = "login_failure"
+	auditEventLogout       = "logout"
+	auditEventLockout      = "lockout"
+	auditEventRequest      = "request"
+)
+
+// auditSettingsPathsKey is the gin context key handlers use to record the settings paths a request touched
+const auditSettingsPathsKey = "auditSettingsPaths"
+
+// auditLogDir is the directory of the audit log, the file setting only names the file in it
+// so the settings can not make restd append to or rotate files elsewhere
+// it is only a variable so tests can log to a temporary directory
+var auditLogDir = "/var/log/restd"
+
+// defaultAuditLogName is the default name of the audit log in auditLogDir
+const defaultAuditLogName = "audit.log"
+
+// auditQueryMaxLimit is the maximum number of entries returned by a single audit query
+const auditQueryMaxLimit = 1000
+
+// auditEntry is a single record in the audit log, stored as one JSON object per line
+type auditEntry struct {
+	Time          int64    `json:"time"`
+	Event         string   `json:"event"`
+	Username      string   `json:"username,omitempty"`
+	SourceIP      string   `json:"sourceIP,omitempty"`
+	Method        string   `json:"method,omitempty"`
+	Path          string   `json:"path,omitempty"`
+	Status        int      `json:"status,omitempty"`
+	AuthMethod    string   `json:"authMethod,omitempty"`
+	SettingsPaths []string `json:"settingsPaths,omitempty"`
+	Detail        string   `json:"detail,omitempty"`
+}
+
+// auditConfig holds the system.restd.audit settings
+type auditConfig struct {
+	enabled       bool
+	file          string
+	maxSize       int64
+	maxFiles      int
+	syslog        bool
+	syslogNetwork string
+	syslogAddress string
+}
+
+var auditMutex sync.Mutex
+var auditSyslog *syslog.Writer
+var auditSyslogTarget string
+
+// getAuditConfig reads the audit settings, applying defaults for anything not configured
+// a path in the file setting is reduced to its file name, which is kept in auditLogDir
+func getAuditConfig() auditConfig {
+	jsonObject := getRestdSettings("audit")
+	name := filepath.Base(settingString(jsonObject, "file", defaultAuditLogName))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		logger.Warn("Invalid audit log name %v, using %v\n", name, defaultAuditLogName)
+		name = defaultAuditLogName
+	}
+	return auditConfig{
+		enabled:       settingBool(jsonObject, "enabled", true),
+		file:          filepath.Join(auditLogDir, name),
+		maxSize:       settingInt(jsonObject, "maxSizeKB", 1024) * 1024,
+		maxFiles:      int(settingInt(jsonObject, "maxFiles", 5)),
+		syslog:        settingBool(jsonObject, "syslog", false),
+		syslogNetwork: settingString(jsonObject, "syslogNetwork", ""),
+		syslogAddress: settingString(jsonObject, "syslogAddress", ""),
+	}
+}
+
+// auditLog appends the entry to the audit log and forwards it to syslog if configured
+func auditLog(entry auditEntry) {
+	config := getAuditConfig()
+	if !config.enabled {
+		return
+	}
+	if entry.Time == 0 {
+		entry.Time = time.Now().Unix()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Warn("Failed to serialize audit entry: %v\n", err)
+		return
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	rotateAuditLog(config)
+	if err := os.MkdirAll(auditLogDir, 0700); err != nil {
+		logger.Warn("Failed to create %v: %v\n", auditLogDir, err)
+	}
+	file, err := os.OpenFile(config.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logger.Warn("Failed to open %v: %v\n", config.file, err)
+	} else {
+		if _, err := file.Write(append(data, '\n')); err != nil {
+			logger.Warn("Failed to write %v: %v\n", config.file, err)
+		}
+		file.Close()
+	}
+
+	if config.syslog {
+		forwardAuditLog(config, string(data))
+	}
+}
+
+// auditEvent records an authentication event of the current request
+func auditEvent(c *gin.Context, event string, username string, authMethod string, detail string) {
+	auditLog(auditEntry{
+		Event:      event,
+		Username:   username,
+		SourceIP:   requestSourceIP(c.Request),
+		Method:     c.Request.Method,
+		Path:       c.Request.URL.Path,
+		AuthMethod: authMethod,
+		Detail:     detail,
+	})
+}
+
+// rotateAuditLog renames the audit log to <file>.1, shifting the older files up, once it exceeds maxSize
+// files beyond maxFiles are removed
+// the caller must hold auditMutex
+func rotateAuditLog(config auditConfig) {
+	info, err := os.Stat(config.file)
+	if err != nil || info.Size() < config.maxSize {
+		return
+	}
+
+	for i := config.maxFiles - 1; i >= 1; i-- {
+		older := config.file + "." + strconv.Itoa(i)
+		if _, err := os.Stat(older); err != nil {
+			continue
+		}
+		if i == config.maxFiles-1 {
+			os.Remove(older)
+			continue
+		}
+		os.Rename(older, config.file+"."+strconv.Itoa(i+1))
+	}
+	if config.maxFiles > 1 {
+		if err := os.Rename(config.file, config.file+".1"); err != nil {
+			logger.Warn("Failed to rotate %v: %v\n", config.file, err)
+		}
+	} else {
+		os.Remove(config.file)
+	}
+}
+
+// forwardAuditLog sends the audit entry to the local or remote syslog
+// the caller must hold auditMutex
+func forwardAuditLog(config auditConfig, message string) {
+	target := config.syslogNetwork + "://" + config.syslogAddress
+	if auditSyslog == nil || auditSyslogTarget != target {
+		if auditSyslog != nil {
+			auditSyslog.Close()
+			auditSyslog = nil
+		}
+		writer, err := syslog.Dial(config.syslogNetwork, config.syslogAddress, syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "restd-audit")
+		if err != nil {
+			logger.Warn("Failed to connect to syslog %v: %v\n", target, err)
+			return
+		}
+		auditSyslog = writer
+		auditSyslogTarget = target
+	}
+
+	if err := auditSyslog.Info(message); err != nil {
+		logger.Warn("Failed to forward audit entry to syslog: %v\n", err)
+		auditSyslog.Close()
+		auditSyslog = nil
+	}
+}
+
+// auditRequests is a middleware that records every mutating /api request once it has been handled
+func auditRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		method := c.Request.Method
+		if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions {
+			return
+		}
+
+		var paths []string
+		if value, ok := c.Get(auditSettingsPathsKey); ok {
+			paths, _ = value.([]string)
+		} else if path := c.Param("path"); path != "" && strings.HasPrefix(c.FullPath(), "/api/settings/") {
+			paths = []string{strings.Trim(path, "/")}
+		}
+
+		auditLog(auditEntry{
+			Event:         auditEventRequest,
+			Username:      getAuthUsername(c),
+			SourceIP:      requestSourceIP(c.Request),
+			Method:        method,
+			Path:          c.Request.URL.Path,
+			Status:        c.Writer.Status(),
+			SettingsPaths: paths,
+		})
+	}
+}
+
+// auditQuery holds the filters of a GET /api/audit request
+type auditQuery struct {
+	event    string
+	username string
+	sourceIP string
+	method   string
+	path     string
+	since    int64
+	until    int64
+}
+
+// matches returns true if the entry passes every filter of the query
+func (q auditQuery) matches(entry *auditEntry) bool {
+	switch {
+	case q.event != "" && entry.Event != q.event:
+	case q.username != "" && entry.Username != q.username:
+	case q.sourceIP != "" && entry.SourceIP != q.sourceIP:
+	case q.method != "" && !strings.EqualFold(entry.Method, q.method):
+	case q.path != "" && !strings.HasPrefix(entry.Path, q.path):
+	case q.since != 0 && entry.Time < q.since:
+	case q.until != 0 && entry.Time > q.until:
+	default:
+		return true
+	}
+	return false
+}
+
+// readAuditLog returns the entries of the audit log files matching the query, newest first
+func readAuditLog(config auditConfig, query auditQuery, limit int) []*auditEntry {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	// read the rotated files oldest first so entries are collected in chronological order
+	files := []string{}
+	for i := config.maxFiles - 1; i >= 1; i-- {
+		files = append(files, config.file+"."+strconv.Itoa(i))
+	}
+	files = append(files, config.file)
+
+	entries := []*auditEntry{}
+	for _, filename := range files {
+		file, err := os.Open(filename)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			entry := &auditEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+				continue
+			}
+			if !query.matches(entry) {
+				continue
+			}
+			entries = append(entries, entry)
+			if len(entries) > limit {
+				entries = entries[1:]
+			}
+		}
+		file.Close()
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+// auditList is the GET /api/audit handler
+// it supports the event, username, ip, method, path (prefix), since, until and limit query arguments
+func auditList(c *gin.Context) {
+	query := auditQuery{
+		event:    c.Query("event"),
+		username: c.Query("username"),
+		sourceIP: c.Query("ip"),
+		method:   c.Query("method"),
+		path:     c.Query("path"),
+	}
+
+	var err error
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit: " + value})
+			return
+		}
+		if limit > auditQueryMaxLimit {
+			limit = auditQueryMaxLimit
+		}
+	}
+	for name, target := range map[string]*int64{"since": &query.since, "until": &query.until} {
+		if value := c.Query(name); value != "" {
+			if *target, err = strconv.ParseInt(value, 10, 64); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %v: %v", name, value)})
+				return
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, readAuditLog(getAuditConfig(), query, limit))
+}
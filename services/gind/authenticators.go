@@ -0,0 +1,156 @@
+package gind
+
+import (
+	"strings"
+
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// Authenticator verifies a username and password against an account database
+type Authenticator interface {
+	// Name returns the name of the authenticator used in the settings and logs
+	Name() string
+	// Authenticate checks the username and password
+	// an error is returned if the account database could not be reached, in which case
+	// the next authenticator is tried
+	Authenticate(username string, password string) (authResult, error)
+}
+
+// authResult is the result of an Authenticator
+type authResult struct {
+	// valid is true if the username and password are valid and the user may log in
+	valid bool
+	// role is the role granted by a directory, local accounts use the role in their credentials
+	role string
+}
+
+// local account fallback modes
+const (
+	// localFallbackUnreachable only checks the local accounts if every directory is unreachable
+	localFallbackUnreachable = "unreachable"
+	// localFallbackAlways checks the local accounts if no directory accepted the login
+	localFallbackAlways = "always"
+)
+
+// roleRank orders the roles from least to most privileged
+var roleRank = map[string]int{
+	RoleReadOnly: 1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// authenticationConfig holds the system.restd.authentication settings
+type authenticationConfig struct {
+	directories   []Authenticator
+	localFallback string
+}
+
+// getAuthenticationConfig reads the authentication settings and creates the enabled directory authenticators
+func getAuthenticationConfig() authenticationConfig {
+	jsonObject := getRestdSettings("authentication")
+	config := authenticationConfig{
+		directories:   []Authenticator{},
+		localFallback: settingString(jsonObject, "localFallback", localFallbackUnreachable),
+	}
+
+	if ldapObject, ok := jsonObject["ldap"].(map[string]interface{}); ok && settingBool(ldapObject, "enabled", false) {
+		config.directories = append(config.directories, newLDAPAuthenticator(ldapObject))
+	}
+	if radiusObject, ok := jsonObject["radius"].(map[string]interface{}); ok && settingBool(radiusObject, "enabled", false) {
+		config.directories = append(config.directories, newRADIUSAuthenticator(radiusObject))
+	}
+	return config
+}
+
+// authenticate checks the username and password against the directories and the local accounts
+// the local accounts are only checked when no directory is configured, when every directory is
+// unreachable, or when localFallback is "always"
+func authenticate(config authenticationConfig, local Authenticator, username string, password string) authResult {
+	unreachable := 0
+	for _, authenticator := range config.directories {
+		result, err := authenticator.Authenticate(username, password)
+		if err != nil {
+			logger.Warn("%v authentication unavailable: %v\n", authenticator.Name(), err)
+			unreachable++
+			continue
+		}
+		if result.valid {
+			logger.Info("Successful %v authentication: %v (%v)\n", authenticator.Name(), username, result.role)
+			return result
+		}
+	}
+
+	if len(config.directories) > 0 && unreachable < len(config.directories) && config.localFallback != localFallbackAlways {
+		logger.Info("Failed authentication: %v\n", username)
+		return authResult{}
+	}
+
+	result, err := local.Authenticate(username, password)
+	if err != nil {
+		logger.Warn("%v authentication unavailable: %v\n", local.Name(), err)
+		return authResult{}
+	}
+	return result
+}
+
+// directoryRole returns the most privileged role mapped from the specified directory groups or attributes
+// returns defaultRole if none of them is mapped
+func directoryRole(values []string, roleMap map[string]interface{}, defaultRole string) string {
+	role := ""
+	for _, value := range values {
+		for key, mapped := range roleMap {
+			mappedRole, ok := mapped.(string)
+			if !ok || !equalFoldTrim(key, value) {
+				continue
+			}
+			if roleRank[mappedRole] > roleRank[role] {
+				role = mappedRole
+			}
+		}
+	}
+	if role == "" {
+		return defaultRole
+	}
+	return role
+}
+
+// equalFoldTrim compares two directory names ignoring case and surrounding whitespace
+func equalFoldTrim(a string, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+// localAuthenticator checks the accounts.credentials settings
+type localAuthenticator struct{}
+
+// Name returns the name of the authenticator
+func (localAuthenticator) Name() string {
+	return "local"
+}
+
+// Authenticate checks the password against the hash stored in the credentials
+// the hash is upgraded to the configured algorithm after a successful login
+func (localAuthenticator) Authenticate(username string, password string) (authResult, error) {
+	credentialsJSON := getCredentials(username)
+	if credentialsJSON == nil {
+		logger.Warn("Failed to find credentials for user %v\n", username)
+		return authResult{}, nil
+	}
+	hash, ok := getPasswordHash(credentialsJSON)
+	if !ok {
+		logger.Warn("Credentials for %v missing password hash\n", username)
+		return authResult{}, nil
+	}
+	if credentialsJSON["username"] != username {
+		logger.Warn("Assertion failed: getCredentials returned wrong credentials\n")
+		return authResult{}, nil
+	}
+
+	if verifyPassword(hash, password) {
+		logger.Info("Successful authentication: %v\n", username)
+		upgradePasswordHash(username, password, hash)
+		return authResult{valid: true}, nil
+	}
+
+	logger.Info("Failed authentication: %v\n", username)
+	return authResult{}, nil
+}
@@ -0,0 +1,162 @@
+package gind
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// fakeAuthenticator is an Authenticator with a fixed result that records the logins it was asked to check
+type fakeAuthenticator struct {
+	name   string
+	result authResult
+	err    error
+	calls  *[]string
+}
+
+func (a fakeAuthenticator) Name() string {
+	return a.name
+}
+
+func (a fakeAuthenticator) Authenticate(username string, password string) (authResult, error) {
+	*a.calls = append(*a.calls, a.name)
+	return a.result, a.err
+}
+
+func TestAuthenticateFallbackOrder(t *testing.T) {
+	errUnreachable := errors.New("connection refused")
+	accept := func(role string) authResult { return authResult{valid: true, role: role} }
+
+	tests := []struct {
+		name          string
+		directories   []fakeAuthenticator
+		local         fakeAuthenticator
+		localFallback string
+		want          authResult
+		wantCalls     []string
+	}{
+		{
+			name:      "no directories checks the local accounts",
+			local:     fakeAuthenticator{name: "local", result: accept("")},
+			want:      accept(""),
+			wantCalls: []string{"local"},
+		},
+		{
+			name: "first directory accepting wins",
+			directories: []fakeAuthenticator{
+				{name: "ldap", result: accept(RoleOperator)},
+				{name: "radius", result: accept(RoleAdmin)},
+			},
+			local:     fakeAuthenticator{name: "local", result: accept("")},
+			want:      accept(RoleOperator),
+			wantCalls: []string{"ldap"},
+		},
+		{
+			name: "rejected by the first directory tries the next",
+			directories: []fakeAuthenticator{
+				{name: "ldap"},
+				{name: "radius", result: accept(RoleReadOnly)},
+			},
+			local:     fakeAuthenticator{name: "local", result: accept("")},
+			want:      accept(RoleReadOnly),
+			wantCalls: []string{"ldap", "radius"},
+		},
+		{
+			name: "rejected by a reachable directory skips the local accounts",
+			directories: []fakeAuthenticator{
+				{name: "ldap"},
+				{name: "radius", err: errUnreachable},
+			},
+			local:     fakeAuthenticator{name: "local", result: accept("")},
+			want:      authResult{},
+			wantCalls: []string{"ldap", "radius"},
+		},
+		{
+			name: "every directory unreachable falls back to the local accounts",
+			directories: []fakeAuthenticator{
+				{name: "ldap", err: errUnreachable},
+				{name: "radius", err: errUnreachable},
+			},
+			local:     fakeAuthenticator{name: "local", result: accept("")},
+			want:      accept(""),
+			wantCalls: []string{"ldap", "radius", "local"},
+		},
+		{
+			name:          "always fallback checks the local accounts after a rejection",
+			directories:   []fakeAuthenticator{{name: "ldap"}},
+			local:         fakeAuthenticator{name: "local", result: accept("")},
+			localFallback: localFallbackAlways,
+			want:          accept(""),
+			wantCalls:     []string{"ldap", "local"},
+		},
+		{
+			name:          "always fallback does not override an accepting directory",
+			directories:   []fakeAuthenticator{{name: "ldap", result: accept(RoleOperator)}},
+			local:         fakeAuthenticator{name: "local", result: accept("")},
+			localFallback: localFallbackAlways,
+			want:          accept(RoleOperator),
+			wantCalls:     []string{"ldap"},
+		},
+		{
+			name:        "unreachable local accounts reject the login",
+			directories: []fakeAuthenticator{{name: "ldap", err: errUnreachable}},
+			local:       fakeAuthenticator{name: "local", err: errUnreachable},
+			want:        authResult{},
+			wantCalls:   []string{"ldap", "local"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := []string{}
+			config := authenticationConfig{directories: []Authenticator{}, localFallback: test.localFallback}
+			if config.localFallback == "" {
+				config.localFallback = localFallbackUnreachable
+			}
+			for _, directory := range test.directories {
+				directory.calls = &calls
+				config.directories = append(config.directories, directory)
+			}
+			local := test.local
+			local.calls = &calls
+
+			got := authenticate(config, local, "user", "password")
+			if got != test.want {
+				t.Errorf("authenticate() = %+v, want %+v", got, test.want)
+			}
+			if !reflect.DeepEqual(calls, test.wantCalls) {
+				t.Errorf("authenticators called = %v, want %v", calls, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDirectoryRole(t *testing.T) {
+	roleMap := map[string]interface{}{
+		"Network Admins": RoleAdmin,
+		"helpdesk":       RoleOperator,
+		"auditors":       RoleReadOnly,
+		"broken":         42,
+	}
+
+	tests := []struct {
+		name        string
+		values      []string
+		defaultRole string
+		want        string
+	}{
+		{"no values", nil, RoleReadOnly, RoleReadOnly},
+		{"unmapped values", []string{"staff"}, "", ""},
+		{"case and whitespace are ignored", []string{" network admins "}, "", RoleAdmin},
+		{"most privileged role wins", []string{"auditors", "helpdesk"}, "", RoleOperator},
+		{"invalid mappings are ignored", []string{"broken"}, RoleReadOnly, RoleReadOnly},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := directoryRole(test.values, roleMap, test.defaultRole); got != test.want {
+				t.Errorf("directoryRole(%v) = %q, want %q", test.values, got, test.want)
+			}
+		})
+	}
+}
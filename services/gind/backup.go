@@ -0,0 +1,635 @@
+package gind
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings"
+	"github.com/untangle/restd/services/certmanager"
+	"golang.org/x/crypto/argon2"
+)
+
+// backupFormat is the version of the backup archive layout
+const backupFormat = 1
+
+// backupManifestName is the archive entry describing the backup
+const backupManifestName = "manifest.json"
+
+// backupSettingsName is the archive entry holding settings.json
+// the accounts, API keys and second factor secrets are part of the settings
+const backupSettingsName = "settings.json"
+
+// backupCertificatesDir and backupRestdDir are the archive directories holding the
+// certificate manager files and the restd config files
+const backupCertificatesDir = "certificates"
+const backupRestdDir = "restd"
+
+// backupPassphraseHeader is the header in which clients send the backup passphrase
+const backupPassphraseHeader = "X-Backup-Passphrase"
+
+// backupMaxSize is the largest backup archive accepted by a restore
+const backupMaxSize = 64 << 20
+
+// backupEncryptedMagic starts every encrypted backup archive
+const backupEncryptedMagic = "RESTDBK1"
+
+// osReleaseFile holds the version of the system
+const osReleaseFile = "/etc/os-release"
+
+// backupExcludedFiles are the restd config files that are not configuration and are left out of backups
+var backupExcludedFiles = map[string]bool{
+	filepath.Base(sessionKeyFile):          true,
+	filepath.Base(apiKeyLastUsedFile):      true,
+	filepath.Base(settingsHistoryDir):      true,
+	filepath.Base(scheduledBackupsDir):     true,
+	filepath.Base(backupScheduleStateFile): true,
+}
+
+// backupManifest describes the system a backup was taken from and the files it holds
+type backupManifest struct {
+	Format   int                       `json:"format"`
+	Version  string                    `json:"version"`
+	UID      string                    `json:"uid"`
+	Hostname string                    `json:"hostname,omitempty"`
+	Created  int64                     `json:"created"`
+	Files    map[string]backupFileInfo `json:"files"`
+}
+
+// backupFileInfo is the size and checksum of an archive entry
+type backupFileInfo struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// systemVersion returns the version of the system from the os-release file, or "" if it is unknown
+func systemVersion() string {
+	file, err := os.Open(osReleaseFile)
+	if err != nil {
+		logger.Warn("Failed to read %v: %v\n", osReleaseFile, err)
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "VERSION_ID=") {
+			return strings.Trim(strings.TrimPrefix(line, "VERSION_ID="), `"'`)
+		}
+	}
+	return ""
+}
+
+// majorVersion returns the major part of a version such as v4.1.2, or "" if the version is unknown
+func majorVersion(version string) string {
+	return strings.SplitN(strings.TrimPrefix(strings.ToLower(version), "v"), ".", 2)[0]
+}
+
+// collectBackupFiles returns the files of a backup by archive entry name
+func collectBackupFiles() (map[string][]byte, error) {
+	files := map[string][]byte{}
+
+	jsonObject, err := settings.GetSettings(nil)
+	if err != nil {
+		return nil, err
+	}
+	if files[backupSettingsName], err = json.MarshalIndent(jsonObject, "", "  "); err != nil {
+		return nil, err
+	}
+
+	for _, file := range certmanager.GetCertificateFiles() {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			logger.Info("Not including %v in the backup: %v\n", file, err)
+			continue
+		}
+		files[path.Join(backupCertificatesDir, filepath.Base(file))] = data
+	}
+
+	err = filepath.Walk(restdConfigDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		name, err := filepath.Rel(restdConfigDir, file)
+		if err != nil || name == "." {
+			return err
+		}
+		if backupExcludedFiles[strings.Split(filepath.ToSlash(name), "/")[0]] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		files[path.Join(backupRestdDir, filepath.ToSlash(name))] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// createBackup creates a backup archive of the configuration, encrypted if a passphrase is specified
+// the archive is a gzip compressed tar file with the manifest as the first entry
+func createBackup(passphrase string) ([]byte, backupManifest, error) {
+	manifest := backupManifest{
+		Format:  backupFormat,
+		Version: systemVersion(),
+		Created: time.Now().Unix(),
+		Files:   map[string]backupFileInfo{},
+	}
+	uid, err := settings.GetUIDOpenwrt()
+	if err != nil {
+		logger.Warn("Failed to read the UID: %v\n", err)
+	}
+	manifest.UID = strings.TrimSpace(uid)
+	if hostname, err := settings.GetSettings([]string{"system", "hostName"}); err == nil {
+		manifest.Hostname, _ = hostname.(string)
+	}
+
+	files, err := collectBackupFiles()
+	if err != nil {
+		return nil, manifest, err
+	}
+	return writeBackupArchive(manifest, files, passphrase)
+}
+
+// writeBackupArchive creates the archive of the files, adding them to the manifest
+func writeBackupArchive(manifest backupManifest, files map[string][]byte, passphrase string) ([]byte, backupManifest, error) {
+	names := []string{}
+	for name, data := range files {
+		sum := sha256.Sum256(data)
+		manifest.Files[name] = backupFileInfo{Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, manifest, err
+	}
+
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	tw := tar.NewWriter(gz)
+	writeEntry := func(name string, data []byte) error {
+		header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Unix(manifest.Created, 0)}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := writeEntry(backupManifestName, manifestData); err != nil {
+		return nil, manifest, err
+	}
+	for _, name := range names {
+		if err := writeEntry(name, files[name]); err != nil {
+			return nil, manifest, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, manifest, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, manifest, err
+	}
+
+	if passphrase == "" {
+		return buffer.Bytes(), manifest, nil
+	}
+	encrypted, err := encryptBackup(buffer.Bytes(), passphrase)
+	return encrypted, manifest, err
+}
+
+// backupFileName returns the download file name of a backup archive
+func backupFileName(manifest backupManifest, encrypted bool) string {
+	name := "backup"
+	hostname := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			return r
+		}
+		return -1
+	}, manifest.Hostname)
+	if hostname != "" {
+		name += "-" + hostname
+	}
+	name += "-" + time.Unix(manifest.Created, 0).UTC().Format("20060102-150405") + ".tar.gz"
+	if encrypted {
+		name += ".enc"
+	}
+	return name
+}
+
+// backupKey derives the archive encryption key from the passphrase with argon2id
+func backupKey(passphrase string, salt []byte, passes uint32, memory uint32, threads uint8) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, passes, memory, threads, 32)
+}
+
+// encryptBackup encrypts a backup archive with AES-256-GCM
+// the encrypted archive is the magic, the argon2id parameters, the salt and the nonce followed by the ciphertext
+func encryptBackup(data []byte, passphrase string) ([]byte, error) {
+	config := getPasswordConfig()
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	header := bytes.NewBufferString(backupEncryptedMagic)
+	binary.Write(header, binary.BigEndian, config.argon2Time)
+	binary.Write(header, binary.BigEndian, config.argon2Memory)
+	header.WriteByte(config.argon2Threads)
+	header.Write(salt)
+
+	block, err := aes.NewCipher(backupKey(passphrase, salt, config.argon2Time, config.argon2Memory, config.argon2Threads))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header.Write(nonce)
+
+	// the header is authenticated so the key derivation parameters can not be changed
+	return gcm.Seal(header.Bytes(), nonce, data, header.Bytes()), nil
+}
+
+// isEncryptedBackup returns true if the archive was encrypted with a passphrase
+func isEncryptedBackup(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(backupEncryptedMagic))
+}
+
+// decryptBackup decrypts a backup archive encrypted by encryptBackup
+// the key derivation parameters of the archive must be within the argon2id limits
+func decryptBackup(data []byte, passphrase string) ([]byte, error) {
+	const saltOffset = len(backupEncryptedMagic) + 4 + 4 + 1
+	const nonceOffset = saltOffset + 16
+	if len(data) < nonceOffset+12 {
+		return nil, errors.New("truncated backup")
+	}
+	passes := binary.BigEndian.Uint32(data[len(backupEncryptedMagic):])
+	memory := binary.BigEndian.Uint32(data[len(backupEncryptedMagic)+4:])
+	threads := data[saltOffset-1]
+	// the parameters come from the uploaded file, so they are checked against the fixed limits rather than
+	// the settings, which a backup taken with a higher cost or a changed configuration could exceed
+	if err := checkArgon2Parameters(int64(passes), int64(memory), int64(threads)); err != nil {
+		return nil, fmt.Errorf("invalid backup encryption parameters: %v", err)
+	}
+
+	block, err := aes.NewCipher(backupKey(passphrase, data[saltOffset:nonceOffset], passes, memory, threads))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	headerSize := nonceOffset + gcm.NonceSize()
+	if len(data) < headerSize {
+		return nil, errors.New("truncated backup")
+	}
+	plaintext, err := gcm.Open(nil, data[nonceOffset:headerSize], data[headerSize:], data[:headerSize])
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted backup")
+	}
+	return plaintext, nil
+}
+
+// readBackup decrypts and unpacks a backup archive
+// every file listed in the manifest must be present with the listed checksum, and no other files are accepted
+func readBackup(data []byte, passphrase string) (backupManifest, map[string][]byte, error) {
+	var manifest backupManifest
+	if isEncryptedBackup(data) {
+		if passphrase == "" {
+			return manifest, nil, errors.New("the backup is encrypted, a passphrase is required")
+		}
+		var err error
+		if data, err = decryptBackup(data, passphrase); err != nil {
+			return manifest, nil, err
+		}
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return manifest, nil, errors.New("not a backup archive")
+	}
+	files := map[string][]byte{}
+	var total int64
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, nil, fmt.Errorf("invalid backup archive: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(tr, backupMaxSize+1-total))
+		if err != nil {
+			return manifest, nil, fmt.Errorf("invalid backup archive: %v", err)
+		}
+		if total += int64(len(content)); total > backupMaxSize {
+			return manifest, nil, errors.New("the backup is too large")
+		}
+		files[header.Name] = content
+	}
+
+	manifestData, ok := files[backupManifestName]
+	if !ok {
+		return manifest, nil, errors.New("the backup has no manifest")
+	}
+	delete(files, backupManifestName)
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return manifest, nil, fmt.Errorf("invalid backup manifest: %v", err)
+	}
+	if manifest.Format != backupFormat {
+		return manifest, nil, fmt.Errorf("unsupported backup format %d", manifest.Format)
+	}
+
+	for name, info := range manifest.Files {
+		content, ok := files[name]
+		if !ok {
+			return manifest, nil, fmt.Errorf("%v is missing from the backup", name)
+		}
+		sum := sha256.Sum256(content)
+		if int64(len(content)) != info.Size || hex.EncodeToString(sum[:]) != info.SHA256 {
+			return manifest, nil, fmt.Errorf("%v does not match its checksum", name)
+		}
+	}
+	for name := range files {
+		if _, ok := manifest.Files[name]; !ok {
+			return manifest, nil, fmt.Errorf("%v is not listed in the manifest", name)
+		}
+	}
+	if _, ok := files[backupSettingsName]; !ok {
+		return manifest, nil, errors.New("the backup has no settings")
+	}
+	return manifest, files, nil
+}
+
+// stagedBackupFile is a file of a backup written next to the file it replaces
+type stagedBackupFile struct {
+	tmpfile string
+	target  string
+}
+
+// stageBackupFiles writes the certificate and restd config files of a backup to temporary files next to
+// the files they replace, so a restore only changes the settings if all of them could be written
+// it returns true if a file only used at startup is restored
+// on error the files staged so far are removed
+func stageBackupFiles(files map[string][]byte) ([]stagedBackupFile, bool, error) {
+	certificates := map[string]string{}
+	for _, file := range certmanager.GetCertificateFiles() {
+		certificates[path.Join(backupCertificatesDir, filepath.Base(file))] = file
+	}
+
+	staged := []stagedBackupFile{}
+	restartRequired := false
+	for name, data := range files {
+		var target string
+		switch {
+		case name == backupSettingsName:
+			continue
+		case certificates[name] != "":
+			target = certificates[name]
+			restartRequired = true
+		case strings.HasPrefix(name, backupRestdDir+"/"):
+			relative := path.Clean(strings.TrimPrefix(name, backupRestdDir+"/"))
+			if relative == "." || strings.HasPrefix(relative, "../") || path.IsAbs(relative) || backupExcludedFiles[strings.Split(relative, "/")[0]] {
+				logger.Warn("Ignoring %v from the backup\n", name)
+				continue
+			}
+			target = filepath.Join(restdConfigDir, filepath.FromSlash(relative))
+		default:
+			logger.Warn("Ignoring %v from the backup\n", name)
+			continue
+		}
+
+		tmpfile, err := stageBackupFile(target, data)
+		if err != nil {
+			discardBackupFiles(staged)
+			return nil, restartRequired, err
+		}
+		staged = append(staged, stagedBackupFile{tmpfile: tmpfile, target: target})
+	}
+	return staged, restartRequired, nil
+}
+
+// stageBackupFile writes the data to a temporary file in the directory of the target and returns its name
+func stageBackupFile(target string, data []byte) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return "", err
+	}
+	tmpfile, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".restore.*")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmpfile.Write(data)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return "", err
+	}
+	return tmpfile.Name(), nil
+}
+
+// discardBackupFiles removes the staged files of a restore that is not completed
+func discardBackupFiles(staged []stagedBackupFile) {
+	for _, file := range staged {
+		os.Remove(file.tmpfile)
+	}
+}
+
+// restoreBackupFiles moves the staged files of a backup in place of the files they replace
+func restoreBackupFiles(staged []stagedBackupFile) error {
+	var result error
+	for _, file := range staged {
+		if err := os.Rename(file.tmpfile, file.target); err != nil {
+			os.Remove(file.tmpfile)
+			if result == nil {
+				result = err
+			}
+		}
+	}
+
+	// the signing keys are kept in memory, the other restd files are read when they are used
+	jwtKeysMutex.Lock()
+	jwtKeys = nil
+	jwtKeysMutex.Unlock()
+	rotateJWTKeys()
+	return result
+}
+
+// backupPassphrase returns the backup passphrase sent by the client
+func backupPassphrase(c *gin.Context) string {
+	if passphrase := c.GetHeader(backupPassphraseHeader); passphrase != "" {
+		return passphrase
+	}
+	return c.PostForm("passphrase")
+}
+
+// getBackup is the GET and POST /api/backup handler
+// it sends a backup archive of the configuration, encrypted if a passphrase is sent in the
+// X-Backup-Passphrase header or the passphrase form field
+func getBackup(c *gin.Context) {
+	passphrase := backupPassphrase(c)
+	data, manifest, err := createBackup(passphrase)
+	if err != nil {
+		logger.Warn("Failed to create backup: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create backup: " + err.Error()})
+		return
+	}
+
+	contentType := "application/gzip"
+	if passphrase != "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+backupFileName(manifest, passphrase != "")+`"`)
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// restoreBackup is the POST /api/restore handler
+// the archive is sent as the backup file of a multipart form or as the request body
+// a backup from another major version is refused unless the force query argument is set, and with
+// the dryRun query argument the settings of the backup are only previewed
+// if an If-Match header is sent the backup is only restored if the settings have not changed since the client read them
+func restoreBackup(c *gin.Context) {
+	setAuditSettingsPath(c, nil)
+	options, ok := getSettingsWriteOptions(c)
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, backupMaxSize)
+	var reader io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		file, _, err := c.Request.FormFile("backup")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing backup file: " + err.Error()})
+			return
+		}
+		defer file.Close()
+		reader = file
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read backup: " + err.Error()})
+		return
+	}
+
+	manifest, files, err := readBackup(data, backupPassphrase(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid backup: " + err.Error()})
+		return
+	}
+	var jsonObject map[string]interface{}
+	if err := json.Unmarshal(files[backupSettingsName], &jsonObject); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid backup settings: " + err.Error()})
+		return
+	}
+
+	version := systemVersion()
+	if !options.force && majorVersion(version) != majorVersion(manifest.Version) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":         "The backup is from version " + manifest.Version + ", the system runs version " + version,
+			"backupVersion": manifest.Version,
+			"systemVersion": version,
+		})
+		return
+	}
+
+	settingsWriteMutex.Lock()
+	defer settingsWriteMutex.Unlock()
+	if !checkSettingsPrecondition(c, nil) {
+		return
+	}
+	change := func(interface{}) interface{} { return jsonObject }
+	if !checkSettingsSchema(c, change) {
+		return
+	}
+	if options.dryRun {
+		previewSettings(c, change, options.force)
+		return
+	}
+
+	staged, restartRequired, err := stageBackupFiles(files)
+	if err != nil {
+		logger.Warn("Failed to restore backup files: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore backup files: " + err.Error()})
+		return
+	}
+
+	previous, err := currentSettingsSnapshot()
+	if err != nil {
+		logger.Warn("Failed to read settings for the history: %v\n", err)
+	}
+	jsonResult, err := settings.SetSettings(nil, jsonObject, options.force)
+	if err != nil {
+		discardBackupFiles(staged)
+		logger.Warn("Failed to restore settings: %v\n", err)
+		c.JSON(http.StatusInternalServerError, settingsErrorResponse(jsonResult, err))
+		return
+	}
+	message := settingsMessage(c)
+	if message == "" {
+		message = "Restore of backup from " + time.Unix(manifest.Created, 0).UTC().Format(time.RFC3339)
+	}
+	recordSettingsRevision(c, previous, []string{""}, message)
+	setSettingsETag(c, nil)
+
+	if err := restoreBackupFiles(staged); err != nil {
+		logger.Warn("Failed to restore backup files: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Settings restored, but restoring the other files failed: " + err.Error()})
+		return
+	}
+	logger.Notice("Restored backup of %v from %v\n", manifest.UID, time.Unix(manifest.Created, 0))
+	result, _ := jsonResult.(map[string]interface{})
+	c.JSON(http.StatusOK, gin.H{
+		"result":          "OK",
+		"output":          result["output"],
+		"version":         manifest.Version,
+		"uid":             manifest.UID,
+		"restartRequired": restartRequired,
+	})
+}
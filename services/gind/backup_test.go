@@ -0,0 +1,236 @@
+package gind
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testBackupFiles are the files of the backups created by the tests
+var testBackupFiles = map[string][]byte{
+	backupSettingsName:                     []byte(`{"system":{"hostName":"host-a"}}`),
+	backupCertificatesDir + "/cert.pem":    []byte("certificate"),
+	backupRestdDir + "/jwt-keys.json":      []byte("[]"),
+	backupRestdDir + "/client-ca/root.pem": []byte("ca"),
+}
+
+// testBackupEntry is an entry of an archive written by writeTestArchive
+type testBackupEntry struct {
+	name string
+	data []byte
+}
+
+// writeTestArchive writes the entries as a gzip compressed tar file, without checking them
+func writeTestArchive(t *testing.T, entries []testBackupEntry) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0600, Size: int64(len(entry.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// testManifest returns the manifest entry listing the files with their checksums
+func testManifest(t *testing.T, files map[string][]byte) testBackupEntry {
+	t.Helper()
+	manifest := backupManifest{Format: backupFormat, Version: "4.1", Created: 1767225600, Files: map[string]backupFileInfo{}}
+	for name, data := range files {
+		sum := sha256.Sum256(data)
+		manifest.Files[name] = backupFileInfo{Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testBackupEntry{backupManifestName, data}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	for _, passphrase := range []string{"", "correct horse"} {
+		manifest := backupManifest{Format: backupFormat, Version: "4.1", UID: "uid", Hostname: "host-a", Created: 1767225600, Files: map[string]backupFileInfo{}}
+		data, manifest, err := writeBackupArchive(manifest, testBackupFiles, passphrase)
+		if err != nil {
+			t.Fatalf("writeBackupArchive() error = %v", err)
+		}
+		if isEncryptedBackup(data) != (passphrase != "") {
+			t.Errorf("backup with passphrase %q encrypted = %v", passphrase, isEncryptedBackup(data))
+		}
+
+		gotManifest, gotFiles, err := readBackup(data, passphrase)
+		if err != nil {
+			t.Fatalf("readBackup() with passphrase %q error = %v", passphrase, err)
+		}
+		if !reflect.DeepEqual(gotManifest, manifest) {
+			t.Errorf("readBackup() manifest = %+v, want %+v", gotManifest, manifest)
+		}
+		if !reflect.DeepEqual(gotFiles, testBackupFiles) {
+			t.Errorf("readBackup() files = %v, want %v", gotFiles, testBackupFiles)
+		}
+	}
+}
+
+func TestEncryptedBackupIntegrity(t *testing.T) {
+	plaintext := writeTestArchive(t, []testBackupEntry{testManifest(t, testBackupFiles)})
+	encrypted, err := encryptBackup(plaintext, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const saltOffset = len(backupEncryptedMagic) + 4 + 4 + 1
+
+	if _, _, err := readBackup(encrypted, ""); err == nil || !strings.Contains(err.Error(), "passphrase is required") {
+		t.Errorf("readBackup() without a passphrase error = %v, want a passphrase required error", err)
+	}
+	if _, err := decryptBackup(encrypted, "wrong"); err == nil {
+		t.Errorf("decryptBackup() with a wrong passphrase succeeded")
+	}
+
+	tamper := func(offset int, change func([]byte)) []byte {
+		data := append([]byte{}, encrypted...)
+		change(data[offset:])
+		return data
+	}
+	flip := func(b []byte) { b[0] ^= 1 }
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"key derivation passes", tamper(len(backupEncryptedMagic), func(b []byte) { binary.BigEndian.PutUint32(b, binary.BigEndian.Uint32(b)-1) })},
+		{"key derivation memory", tamper(len(backupEncryptedMagic)+4, func(b []byte) { binary.BigEndian.PutUint32(b, binary.BigEndian.Uint32(b)+1024) })},
+		{"salt", tamper(saltOffset, flip)},
+		{"nonce", tamper(saltOffset+16, flip)},
+		{"ciphertext", tamper(len(encrypted)-20, flip)},
+		{"authentication tag", tamper(len(encrypted)-1, flip)},
+		{"passes above the limit", tamper(len(backupEncryptedMagic), func(b []byte) { binary.BigEndian.PutUint32(b, argon2MaxTime+1) })},
+		{"memory above the limit", tamper(len(backupEncryptedMagic)+4, func(b []byte) { binary.BigEndian.PutUint32(b, argon2MaxMemoryKiB+1) })},
+		{"no threads", tamper(saltOffset-1, func(b []byte) { b[0] = 0 })},
+		{"truncated", encrypted[:saltOffset+16]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decryptBackup(test.data, "secret"); err == nil {
+				t.Errorf("decryptBackup() of a backup with a changed %v succeeded", test.name)
+			}
+		})
+	}
+
+	if decrypted, err := decryptBackup(encrypted, "secret"); err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("decryptBackup() = %v, want the archive", err)
+	}
+}
+
+func TestReadBackupChecksManifest(t *testing.T) {
+	settings := testBackupEntry{backupSettingsName, testBackupFiles[backupSettingsName]}
+	certificate := testBackupEntry{backupCertificatesDir + "/cert.pem", []byte("certificate")}
+
+	tests := []struct {
+		name    string
+		entries []testBackupEntry
+		wantErr string
+	}{
+		{
+			name:    "valid",
+			entries: []testBackupEntry{testManifest(t, map[string][]byte{settings.name: settings.data, certificate.name: certificate.data}), settings, certificate},
+		},
+		{
+			name:    "checksum mismatch",
+			entries: []testBackupEntry{testManifest(t, map[string][]byte{settings.name: settings.data, certificate.name: []byte("certificatE")}), settings, certificate},
+			wantErr: "does not match its checksum",
+		},
+		{
+			name:    "size mismatch",
+			entries: []testBackupEntry{testManifest(t, map[string][]byte{settings.name: settings.data, certificate.name: []byte("cert")}), settings, certificate},
+			wantErr: "does not match its checksum",
+		},
+		{
+			name:    "entry not listed in the manifest",
+			entries: []testBackupEntry{testManifest(t, map[string][]byte{settings.name: settings.data}), settings, certificate},
+			wantErr: "is not listed in the manifest",
+		},
+		{
+			name:    "listed entry missing",
+			entries: []testBackupEntry{testManifest(t, map[string][]byte{settings.name: settings.data, certificate.name: certificate.data}), settings},
+			wantErr: "is missing from the backup",
+		},
+		{
+			name:    "no settings",
+			entries: []testBackupEntry{testManifest(t, map[string][]byte{certificate.name: certificate.data}), certificate},
+			wantErr: "has no settings",
+		},
+		{
+			name:    "no manifest",
+			entries: []testBackupEntry{settings},
+			wantErr: "has no manifest",
+		},
+		{
+			name:    "unsupported format",
+			entries: []testBackupEntry{{backupManifestName, []byte(`{"format":2,"files":{}}`)}, settings},
+			wantErr: "unsupported backup format",
+		},
+		{
+			name:    "too large",
+			entries: []testBackupEntry{testManifest(t, map[string][]byte{settings.name: settings.data}), settings, {backupRestdDir + "/large", make([]byte, backupMaxSize)}},
+			wantErr: "too large",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, files, err := readBackup(writeTestArchive(t, test.entries), "")
+			if test.wantErr == "" {
+				if err != nil || len(files) != len(test.entries)-1 {
+					t.Errorf("readBackup() = %v files, %v, want %v files", len(files), err, len(test.entries)-1)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("readBackup() error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+
+	if _, _, err := readBackup([]byte("not an archive"), ""); err == nil {
+		t.Errorf("readBackup() of a file that is not an archive succeeded")
+	}
+}
+
+func TestStageBackupFilesIgnoresUnsafeEntries(t *testing.T) {
+	files := map[string][]byte{
+		backupSettingsName:                                              []byte("{}"),
+		backupRestdDir + "/../x":                                        []byte("x"),
+		backupRestdDir + "/a/../../y":                                   []byte("y"),
+		backupRestdDir + "/":                                            []byte("directory"),
+		backupRestdDir + "/" + filepath.Base(sessionKeyFile):            []byte("key"),
+		backupRestdDir + "/" + filepath.Base(settingsHistoryDir) + "/1": []byte("revision"),
+		backupCertificatesDir + "/../z":                                 []byte("z"),
+		"/etc/passwd":                                                   []byte("root"),
+	}
+	staged, restartRequired, err := stageBackupFiles(files)
+	if err != nil {
+		t.Fatalf("stageBackupFiles() error = %v", err)
+	}
+	defer discardBackupFiles(staged)
+	if len(staged) != 0 || restartRequired {
+		t.Errorf("stageBackupFiles() = %v, %v, want nothing staged", staged, restartRequired)
+	}
+}
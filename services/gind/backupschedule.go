@@ -0,0 +1,596 @@
+package gind
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// scheduledBackupsDir is the default directory of the local backup target, a configured directory must be in it
+const scheduledBackupsDir = restdConfigDir + "/backups"
+
+// backupScheduleStateFile stores the result of the last scheduled backup so a restart does not repeat it
+const backupScheduleStateFile = restdConfigDir + "/backup-schedule.json"
+
+// backupScheduleCheckInterval is how often the schedule is checked
+const backupScheduleCheckInterval = 1 * time.Minute
+
+// backup target types
+const (
+	BackupTargetLocal  = "local"
+	BackupTargetHTTP   = "http"
+	BackupTargetWebDAV = "webdav"
+	BackupTargetSFTP   = "sftp"
+)
+
+// backupScheduleConfig holds the system.restd.backupSchedule settings
+type backupScheduleConfig struct {
+	enabled    bool
+	frequency  string
+	hour       int
+	weekday    int
+	keep       int
+	passphrase string
+	target     backupTargetConfig
+}
+
+// backupTargetConfig holds the target part of the system.restd.backupSchedule settings
+type backupTargetConfig struct {
+	kind         string
+	directory    string
+	url          string
+	username     string
+	password     string
+	caFile       string
+	identityFile string
+	timeout      time.Duration
+}
+
+// backupScheduleStatus is the result of the last scheduled backup
+type backupScheduleStatus struct {
+	Running       bool   `json:"running"`
+	LastRun       int64  `json:"lastRun,omitempty"`
+	LastSuccess   int64  `json:"lastSuccess,omitempty"`
+	LastFile      string `json:"lastFile,omitempty"`
+	LastSize      int64  `json:"lastSize,omitempty"`
+	LastError     string `json:"lastError,omitempty"`
+	LastErrorTime int64  `json:"lastErrorTime,omitempty"`
+}
+
+// errBackupRunning is returned when a backup is requested while another one is running
+var errBackupRunning = errors.New("a backup is already running")
+
+var backupScheduleMutex sync.Mutex
+var backupSchedule backupScheduleStatus
+var backupScheduleStarted = time.Now()
+
+// backupNamePattern matches the names backupFileName gives to backup archives
+// the first group is the part before the time, which is the same for every backup of a system
+var backupNamePattern = regexp.MustCompile(`^(backup(-[A-Za-z0-9.-]+)?-)[0-9]{8}-[0-9]{6}\.tar\.gz(\.enc)?$`)
+
+// getBackupScheduleConfig reads the backup schedule settings, applying defaults for anything not configured
+// the settings are in system.restd, so only users with PermSystemAdmin can change them
+func getBackupScheduleConfig() backupScheduleConfig {
+	jsonObject := getRestdSettings("backupSchedule")
+	target, ok := jsonObject["target"].(map[string]interface{})
+	if !ok {
+		target = map[string]interface{}{}
+	}
+	config := backupScheduleConfig{
+		enabled:    settingBool(jsonObject, "enabled", false),
+		frequency:  settingString(jsonObject, "frequency", "daily"),
+		hour:       int(settingInt(jsonObject, "hour", 2)),
+		weekday:    int(settingInt(jsonObject, "weekday", 0)),
+		keep:       int(settingInt(jsonObject, "keep", 7)),
+		passphrase: settingString(jsonObject, "passphrase", ""),
+		target: backupTargetConfig{
+			kind:         settingString(target, "type", BackupTargetLocal),
+			directory:    backupDirectory(settingString(target, "directory", scheduledBackupsDir)),
+			url:          settingString(target, "url", ""),
+			username:     settingString(target, "username", ""),
+			password:     settingString(target, "password", ""),
+			caFile:       settingString(target, "caFile", ""),
+			identityFile: settingString(target, "identityFile", ""),
+			timeout:      time.Duration(settingInt(target, "timeoutSeconds", 60)) * time.Second,
+		},
+	}
+
+	if config.frequency != "daily" && config.frequency != "weekly" {
+		logger.Warn("Invalid backup frequency %v, using daily\n", config.frequency)
+		config.frequency = "daily"
+	}
+	if config.hour < 0 || config.hour > 23 {
+		config.hour = 2
+	}
+	if config.weekday < 0 || config.weekday > 6 {
+		config.weekday = 0
+	}
+	if config.keep < 1 {
+		config.keep = 1
+	}
+	return config
+}
+
+// backupDirectory returns the directory of the local target, which must be in scheduledBackupsDir
+// a relative directory is relative to scheduledBackupsDir
+func backupDirectory(directory string) string {
+	if !filepath.IsAbs(directory) {
+		directory = filepath.Join(scheduledBackupsDir, directory)
+	}
+	directory = filepath.Clean(directory)
+	if directory != scheduledBackupsDir && !strings.HasPrefix(directory, scheduledBackupsDir+"/") {
+		logger.Warn("Backup directory %v is not in %v, using %v\n", directory, scheduledBackupsDir, scheduledBackupsDir)
+		return scheduledBackupsDir
+	}
+	return directory
+}
+
+// nextBackupTime returns the first scheduled backup time after the specified time
+func nextBackupTime(config backupScheduleConfig, after time.Time) time.Time {
+	next := time.Date(after.Year(), after.Month(), after.Day(), config.hour, 0, 0, 0, after.Location())
+	for !next.After(after) || (config.frequency == "weekly" && int(next.Weekday()) != config.weekday) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// loadBackupScheduleStatus reads the result of the last scheduled backup
+func loadBackupScheduleStatus() {
+	data, err := ioutil.ReadFile(backupScheduleStateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Failed to read %v: %v\n", backupScheduleStateFile, err)
+		}
+		return
+	}
+	backupScheduleMutex.Lock()
+	defer backupScheduleMutex.Unlock()
+	if err := json.Unmarshal(data, &backupSchedule); err != nil {
+		logger.Warn("Failed to parse %v: %v\n", backupScheduleStateFile, err)
+	}
+	backupSchedule.Running = false
+}
+
+// saveBackupScheduleStatus writes the result of the last scheduled backup
+// the caller must hold backupScheduleMutex
+func saveBackupScheduleStatus() {
+	data, err := json.Marshal(backupSchedule)
+	if err != nil {
+		logger.Warn("Failed to serialize backup schedule status: %v\n", err)
+		return
+	}
+	if err := os.MkdirAll(restdConfigDir, 0700); err != nil {
+		logger.Warn("Failed to create %v: %v\n", restdConfigDir, err)
+		return
+	}
+	if err := ioutil.WriteFile(backupScheduleStateFile, data, 0600); err != nil {
+		logger.Warn("Failed to write %v: %v\n", backupScheduleStateFile, err)
+	}
+}
+
+// startBackupSchedule runs the scheduled backups until the service is shut down
+// a backup missed while restd was not running is taken on the next check
+func startBackupSchedule() {
+	loadBackupScheduleStatus()
+
+	go func() {
+		ticker := time.NewTicker(backupScheduleCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-serviceShutdown:
+				return
+			case <-ticker.C:
+				checkBackupSchedule()
+			}
+		}
+	}()
+}
+
+// checkBackupSchedule takes a backup if one is due
+func checkBackupSchedule() {
+	config := getBackupScheduleConfig()
+	if !config.enabled {
+		return
+	}
+	backupScheduleMutex.Lock()
+	last := backupScheduleStarted
+	if backupSchedule.LastRun != 0 {
+		last = time.Unix(backupSchedule.LastRun, 0)
+	}
+	backupScheduleMutex.Unlock()
+
+	if time.Now().Before(nextBackupTime(config, last)) {
+		return
+	}
+	runScheduledBackup(config)
+}
+
+// runScheduledBackup takes a backup, sends it to the target and removes the oldest backups beyond
+// the number to keep, recording the result in the schedule status
+func runScheduledBackup(config backupScheduleConfig) (backupScheduleStatus, error) {
+	backupScheduleMutex.Lock()
+	if backupSchedule.Running {
+		status := backupSchedule
+		backupScheduleMutex.Unlock()
+		return status, errBackupRunning
+	}
+	backupSchedule.Running = true
+	backupSchedule.LastRun = time.Now().Unix()
+	backupScheduleMutex.Unlock()
+
+	data, manifest, err := createBackup(config.passphrase)
+	name := backupFileName(manifest, config.passphrase != "")
+	if err == nil {
+		err = storeBackup(config, name, data)
+	}
+
+	backupScheduleMutex.Lock()
+	defer backupScheduleMutex.Unlock()
+	backupSchedule.Running = false
+	if err != nil {
+		logger.Warn("Scheduled backup to %v target failed: %v\n", config.target.kind, err)
+		backupSchedule.LastError = err.Error()
+		backupSchedule.LastErrorTime = time.Now().Unix()
+	} else {
+		logger.Info("Scheduled backup %v stored on %v target\n", name, config.target.kind)
+		backupSchedule.LastSuccess = time.Now().Unix()
+		backupSchedule.LastFile = name
+		backupSchedule.LastSize = int64(len(data))
+		backupSchedule.LastError = ""
+		backupSchedule.LastErrorTime = 0
+	}
+	saveBackupScheduleStatus()
+	return backupSchedule, err
+}
+
+// storeBackup sends the backup archive to the target
+// backups only leave the system encrypted, a passphrase is required for every target other than local
+func storeBackup(config backupScheduleConfig, name string, data []byte) error {
+	if config.target.kind != BackupTargetLocal && config.passphrase == "" {
+		return errors.New("a passphrase is required for the " + config.target.kind + " backup target")
+	}
+	switch config.target.kind {
+	case BackupTargetLocal:
+		return storeLocalBackup(config, name, data)
+	case BackupTargetHTTP:
+		return storeHTTPBackup(config, name, data)
+	case BackupTargetWebDAV:
+		return storeWebDAVBackup(config, name, data)
+	case BackupTargetSFTP:
+		return storeSFTPBackup(config, name, data)
+	}
+	return errors.New("unsupported backup target " + config.target.kind)
+}
+
+// backupNamePrefix returns the part of a backup archive name before the time, or "" if it is not one
+func backupNamePrefix(name string) string {
+	match := backupNamePattern.FindStringSubmatch(name)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// expiredBackups returns the backup archives beyond the number to keep, oldest first
+// only the backups with the same name prefix as the backup just stored are counted, so the backups of
+// other systems sharing the target are never removed
+func expiredBackups(names []string, stored string, keep int) []string {
+	prefix := backupNamePrefix(stored)
+	backups := []string{}
+	for _, name := range names {
+		if prefix != "" && backupNamePrefix(name) == prefix {
+			backups = append(backups, name)
+		}
+	}
+	// the names only differ in the time, which sorts in time order
+	sort.Strings(backups)
+	if len(backups) <= keep {
+		return []string{}
+	}
+	return backups[:len(backups)-keep]
+}
+
+// storeLocalBackup writes the backup archive to the target directory
+func storeLocalBackup(config backupScheduleConfig, name string, data []byte) error {
+	directory := config.target.directory
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return err
+	}
+	tmpfile := filepath.Join(directory, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmpfile, data, 0600); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	if err := os.Rename(tmpfile, filepath.Join(directory, name)); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			names = append(names, file.Name())
+		}
+	}
+	for _, expired := range expiredBackups(names, name, config.keep) {
+		logger.Info("Removing old backup %v\n", expired)
+		if err := os.Remove(filepath.Join(directory, expired)); err != nil {
+			logger.Warn("Failed to remove old backup %v: %v\n", expired, err)
+		}
+	}
+	return nil
+}
+
+// backupHTTPClient returns the HTTP client for the HTTP and WebDAV targets
+func backupHTTPClient(target backupTargetConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if target.caFile != "" {
+		data, err := ioutil.ReadFile(target.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no CA certificates found in " + target.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &http.Client{
+		Timeout:   target.timeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// backupRequest sends a request to the HTTP or WebDAV target and returns the response body
+// any status other than 2xx is an error
+func backupRequest(client *http.Client, target backupTargetConfig, method string, requestURL string, body []byte, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(method, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if target.username != "" {
+		req.SetBasicAuth(target.username, target.password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	response, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%v %v returned %v", method, requestURL, resp.Status)
+	}
+	return response, nil
+}
+
+// storeHTTPBackup posts the backup archive to the target URL
+// the receiving server is responsible for keeping the number of backups
+func storeHTTPBackup(config backupScheduleConfig, name string, data []byte) error {
+	client, err := backupHTTPClient(config.target)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	_, err = backupRequest(client, config.target, http.MethodPost, config.target.url, data, header)
+	return err
+}
+
+// webdavMultistatus is the part of a PROPFIND response listing the collection members
+type webdavMultistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+	} `xml:"response"`
+}
+
+// storeWebDAVBackup uploads the backup archive to the target collection
+func storeWebDAVBackup(config backupScheduleConfig, name string, data []byte) error {
+	client, err := backupHTTPClient(config.target)
+	if err != nil {
+		return err
+	}
+	collection := strings.TrimSuffix(config.target.url, "/") + "/"
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	if _, err := backupRequest(client, config.target, "PUT", collection+url.PathEscape(name), data, header); err != nil {
+		return err
+	}
+
+	header = http.Header{}
+	header.Set("Depth", "1")
+	header.Set("Content-Type", "application/xml")
+	listing, err := backupRequest(client, config.target, "PROPFIND", collection, []byte(`<?xml version="1.0"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`), header)
+	if err != nil {
+		return fmt.Errorf("backup stored, listing old backups failed: %v", err)
+	}
+	var multistatus webdavMultistatus
+	if err := xml.Unmarshal(listing, &multistatus); err != nil {
+		return fmt.Errorf("backup stored, listing old backups failed: %v", err)
+	}
+	names := []string{}
+	for _, response := range multistatus.Responses {
+		if href, err := url.PathUnescape(response.Href); err == nil {
+			names = append(names, path.Base(href))
+		}
+	}
+	for _, expired := range expiredBackups(names, name, config.keep) {
+		logger.Info("Removing old backup %v\n", expired)
+		if _, err := backupRequest(client, config.target, http.MethodDelete, collection+url.PathEscape(expired), nil, nil); err != nil {
+			logger.Warn("Failed to remove old backup %v: %v\n", expired, err)
+		}
+	}
+	return nil
+}
+
+// runCurl runs curl for the SFTP target and returns its output
+// the credentials are passed in a config file on stdin, so they do not show up in the process list
+func runCurl(config backupScheduleConfig, args ...string) (string, error) {
+	args = append([]string{"--silent", "--show-error", "--max-time", fmt.Sprint(int(config.target.timeout.Seconds()))}, args...)
+	if config.target.identityFile != "" {
+		args = append(args, "--key", config.target.identityFile)
+	}
+	cmd := exec.Command("curl", args...)
+	if config.target.username != "" {
+		cmd.Args = append(cmd.Args, "--config", "-")
+		cmd.Stdin = strings.NewReader("user = " + curlConfigQuote(config.target.username+":"+config.target.password) + "\n")
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("%v: %v", err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// curlConfigQuote returns the value as a quoted string of a curl config file
+func curlConfigQuote(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// sftpTarget returns the SFTP URL of the target without its userinfo
+// credentials in the URL are moved to the returned target, so runCurl passes them on stdin instead of
+// in the arguments of curl, the username and password settings take precedence over them
+func sftpTarget(target backupTargetConfig) (*url.URL, backupTargetConfig, error) {
+	parsed, err := url.Parse(target.url)
+	if err != nil || parsed.Scheme != "sftp" || parsed.Host == "" {
+		// the URL is not included as it may hold a password
+		return nil, target, errors.New("invalid SFTP URL")
+	}
+	if parsed.User != nil && target.username == "" {
+		target.username = parsed.User.Username()
+		target.password, _ = parsed.User.Password()
+	}
+	parsed.User = nil
+	target.url = parsed.String()
+	return parsed, target, nil
+}
+
+// storeSFTPBackup uploads the backup archive to the target directory with curl
+// the server host key must already be in the known hosts of the root user
+func storeSFTPBackup(config backupScheduleConfig, name string, data []byte) error {
+	target, targetConfig, err := sftpTarget(config.target)
+	if err != nil {
+		return err
+	}
+	config.target = targetConfig
+	directory := strings.TrimSuffix(target.Path, "/") + "/"
+	target.Path = directory
+
+	tmpfile, err := ioutil.TempFile("", "backup.*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	_, err = tmpfile.Write(data)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := runCurl(config, "--upload-file", tmpfile.Name(), target.String()+url.PathEscape(name)); err != nil {
+		return err
+	}
+
+	listing, err := runCurl(config, "--list-only", target.String())
+	if err != nil {
+		return fmt.Errorf("backup stored, listing old backups failed: %v", err)
+	}
+	for _, expired := range expiredBackups(strings.Split(strings.Replace(listing, "\r", "", -1), "\n"), name, config.keep) {
+		logger.Info("Removing old backup %v\n", expired)
+		if _, err := runCurl(config, "--quote", "rm "+directory+expired, target.String()); err != nil {
+			logger.Warn("Failed to remove old backup %v: %v\n", expired, err)
+		}
+	}
+	return nil
+}
+
+// backupScheduleResponse returns the schedule settings and status sent by the schedule endpoints
+// the passphrase and target credentials are not included
+// the http target can not list or remove backups, so keep is reported as not applied for it
+func backupScheduleResponse(config backupScheduleConfig, status backupScheduleStatus) gin.H {
+	response := gin.H{
+		"enabled":   config.enabled,
+		"frequency": config.frequency,
+		"hour":      config.hour,
+		"keep":      config.keep,
+		"encrypted": config.passphrase != "",
+		"target":    config.target.kind,
+		"status":    status,
+	}
+	if config.frequency == "weekly" {
+		response["weekday"] = config.weekday
+	}
+	if config.target.kind == BackupTargetHTTP {
+		delete(response, "keep")
+		response["keepApplied"] = false
+	}
+	if config.enabled {
+		last := backupScheduleStarted
+		if status.LastRun != 0 {
+			last = time.Unix(status.LastRun, 0)
+		}
+		response["nextRun"] = nextBackupTime(config, last).Unix()
+	}
+	return response
+}
+
+// getBackupSchedule is the GET /api/backup/schedule handler
+// the schedule is configured in the system.restd.backupSchedule settings
+func getBackupSchedule(c *gin.Context) {
+	backupScheduleMutex.Lock()
+	status := backupSchedule
+	backupScheduleMutex.Unlock()
+	c.JSON(http.StatusOK, backupScheduleResponse(getBackupScheduleConfig(), status))
+}
+
+// runBackupSchedule is the POST /api/backup/schedule/run handler
+// it takes a backup to the configured target immediately, even if the schedule is disabled
+func runBackupSchedule(c *gin.Context) {
+	config := getBackupScheduleConfig()
+	status, err := runScheduledBackup(config)
+	response := backupScheduleResponse(config, status)
+	if err != nil {
+		response["error"] = err.Error()
+		if err == errBackupRunning {
+			c.JSON(http.StatusConflict, response)
+		} else {
+			c.JSON(http.StatusInternalServerError, response)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
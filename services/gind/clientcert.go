@@ -0,0 +1,269 @@
+package gind
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// clientCAFile is the default location of the PEM bundle of CAs trusted to issue client certificates
+const clientCAFile = restdConfigDir + "/client-ca.pem"
+
+// clientCertConfig holds the system.restd.clientCertificates settings
+type clientCertConfig struct {
+	enabled bool
+	// required rejects TLS connections without a valid client certificate, otherwise one is only verified if presented
+	required bool
+	caFile   string
+	caBundle string
+	// users maps certificate identities to local accounts
+	users []clientCertUser
+	// matchCommonName maps certificates to the local account named by their subject common name
+	// it is off by default, so any certificate of a trusted CA does not log in as the account it names
+	matchCommonName bool
+}
+
+// clientCertUser maps a certificate identity, the subject common name, a DNS, email or URI
+// subject alternative name or the "sha256:" fingerprint of the certificate, to a local account
+// role optionally limits the certificate to a less privileged role than the account
+type clientCertUser struct {
+	match    string
+	username string
+	role     string
+}
+
+var clientCAMutex sync.Mutex
+var clientCAPool *x509.CertPool
+var clientCASource string
+var clientCAModTime time.Time
+
+// getClientCertConfig reads the client certificate settings, applying defaults for anything not configured
+func getClientCertConfig() clientCertConfig {
+	jsonObject := getRestdSettings("clientCertificates")
+	config := clientCertConfig{
+		enabled:         settingBool(jsonObject, "enabled", false),
+		required:        settingBool(jsonObject, "required", false),
+		caFile:          settingString(jsonObject, "caFile", clientCAFile),
+		caBundle:        settingString(jsonObject, "caBundle", ""),
+		users:           []clientCertUser{},
+		matchCommonName: settingBool(jsonObject, "matchCommonName", false),
+	}
+
+	users, _ := jsonObject["users"].([]interface{})
+	for _, value := range users {
+		user, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		mapping := clientCertUser{
+			match:    settingString(user, "match", ""),
+			username: settingString(user, "username", ""),
+			role:     strings.ToLower(settingString(user, "role", "")),
+		}
+		if mapping.match == "" || mapping.username == "" {
+			logger.Warn("Ignoring client certificate mapping without match or username: %v\n", user)
+			continue
+		}
+		config.users = append(config.users, mapping)
+	}
+	return config
+}
+
+// getClientCAPool returns the pool of CAs trusted to issue client certificates
+// the bundle file is only parsed again after it changes
+func getClientCAPool(config clientCertConfig) (*x509.CertPool, error) {
+	clientCAMutex.Lock()
+	defer clientCAMutex.Unlock()
+
+	var data []byte
+	var modTime time.Time
+	source := config.caBundle
+	if source == "" {
+		info, err := os.Stat(config.caFile)
+		if err != nil {
+			return nil, err
+		}
+		source = config.caFile
+		modTime = info.ModTime()
+		if clientCAPool != nil && clientCASource == source && clientCAModTime.Equal(modTime) {
+			return clientCAPool, nil
+		}
+		if data, err = ioutil.ReadFile(config.caFile); err != nil {
+			return nil, err
+		}
+	} else {
+		if clientCAPool != nil && clientCASource == source {
+			return clientCAPool, nil
+		}
+		data = []byte(config.caBundle)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no CA certificates found")
+	}
+	clientCAPool = pool
+	clientCASource = source
+	clientCAModTime = modTime
+	return pool, nil
+}
+
+// clientCertTLSConfig returns the TLS configuration of the HTTPS listener
+// the client certificate settings are applied to each handshake so they take effect without a restart
+func clientCertTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	base := &tls.Config{Certificates: []tls.Certificate{cert}}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		config := getClientCertConfig()
+		if !config.enabled {
+			return nil, nil
+		}
+		pool, err := getClientCAPool(config)
+		if err != nil {
+			logger.Warn("Failed to load client CA bundle: %v\n", err)
+			if config.required {
+				return nil, err
+			}
+			return nil, nil
+		}
+
+		tlsConfig := base.Clone()
+		tlsConfig.GetConfigForClient = nil
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.required {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		return tlsConfig, nil
+	}
+	return base, nil
+}
+
+// runTLS serves the engine over HTTPS on the specified address, verifying client certificates when enabled
+func runTLS(engine *gin.Engine, addr string, certFile string, keyFile string) {
+	tlsConfig, err := clientCertTLSConfig(certFile, keyFile)
+	if err != nil {
+		logger.Warn("Failed to load the HTTPS certificate: %v\n", err)
+		return
+	}
+
+	server := &http.Server{Addr: addr, Handler: engine, TLSConfig: tlsConfig}
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		logger.Warn("HTTPS listener on %v failed: %v\n", addr, err)
+	}
+}
+
+// clientCertIdentities returns the subject common name and the DNS, email and URI subject alternative names of the certificate
+func clientCertIdentities(cert *x509.Certificate) []string {
+	identities := []string{}
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+// clientCertFingerprint returns the SHA-256 fingerprint of the certificate as "sha256:<hex>"
+func clientCertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// mapClientCert returns the local account and role limit of the certificate, or "" if it is not mapped
+// the explicit mappings are checked before the common name
+// fingerprints may be written with colons between the bytes, as most tools print them
+func mapClientCert(config clientCertConfig, cert *x509.Certificate) (string, string) {
+	identities := clientCertIdentities(cert)
+	fingerprint := clientCertFingerprint(cert)
+	for _, user := range config.users {
+		if strings.HasPrefix(strings.ToLower(user.match), "sha256:") {
+			if equalFoldTrim(strings.Replace(user.match[len("sha256:"):], ":", "", -1), fingerprint[len("sha256:"):]) {
+				return user.username, user.role
+			}
+			continue
+		}
+		for _, identity := range identities {
+			if equalFoldTrim(user.match, identity) {
+				return user.username, user.role
+			}
+		}
+	}
+	if config.matchCommonName && cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, ""
+	}
+	return "", ""
+}
+
+// checkClientCert checks for a client certificate verified by the TLS listener
+// returns true and the username if the certificate maps to a local account
+// the request is aborted if a verified certificate does not map to a usable account
+func checkClientCert(c *gin.Context) (bool, string) {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		return false, ""
+	}
+	return clientCertAuth(c, getClientCertConfig())
+}
+
+// clientCertAuth checks the verified client certificate of the request with the specified settings
+// the certificate replaces the password, not the second factor: accounts with TOTP enabled must send
+// a code in the X-Restd-TOTP header with each request, like basic auth clients, and accounts that must
+// enroll are limited to enrollment
+func clientCertAuth(c *gin.Context, config clientCertConfig) (bool, string) {
+	if !config.enabled {
+		return false, ""
+	}
+
+	cert := c.Request.TLS.VerifiedChains[0][0]
+	username, role := mapClientCert(config, cert)
+	_, roleValid := rolePermissions[role]
+	reason := ""
+	switch {
+	case username == "":
+		reason = "certificate not mapped to an account"
+	case getCredentials(username) == nil:
+		reason = "no local account " + username
+	case role != "" && !roleValid:
+		reason = "invalid role " + role
+	}
+	if reason != "" {
+		logger.Info("Rejected client certificate %v: %v\n", cert.Subject.String(), reason)
+		auditEvent(c, auditEventLoginFailure, username, authMethodCertificate, reason)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Authorization failed: Client certificate not authorized"})
+		c.Abort()
+		return false, ""
+	}
+
+	c.Set(authUsernameKey, username)
+	if role != "" {
+		c.Set(authKeyRoleKey, role)
+	}
+
+	if code := c.GetHeader(totpHeader); code != "" && throttleLogin(c, username, requestSourceIP(c.Request)) {
+		return false, ""
+	}
+	requireSecondFactor(c, username, authMethodCertificate, c.GetHeader(totpHeader))
+	if c.IsAborted() {
+		return false, ""
+	}
+	markTOTPEnrollment(c, username)
+	return true, username
+}
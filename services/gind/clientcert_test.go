@@ -0,0 +1,260 @@
+package gind
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testCA issues client certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+// issue returns a client certificate with the common name and subject alternative names
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames []string, emails []string, uris []string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: commonName},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:       dnsNames,
+		EmailAddresses: emails,
+	}
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestMapClientCert(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	cert := ca.issue(t, "alice", []string{"alice.example"}, []string{"alice@example.com"}, []string{"spiffe://example/alice"})
+	fingerprint := clientCertFingerprint(cert)
+	colons := []string{}
+	for i := len("sha256:"); i < len(fingerprint); i += 2 {
+		colons = append(colons, strings.ToUpper(fingerprint[i:i+2]))
+	}
+
+	tests := []struct {
+		name         string
+		config       clientCertConfig
+		wantUsername string
+		wantRole     string
+	}{
+		{
+			name:   "common name is not mapped by default",
+			config: clientCertConfig{},
+		},
+		{
+			name:         "common name when enabled",
+			config:       clientCertConfig{matchCommonName: true},
+			wantUsername: "alice",
+		},
+		{
+			name:         "DNS name",
+			config:       clientCertConfig{users: []clientCertUser{{match: "ALICE.example", username: "alice-dns", role: RoleReadOnly}}},
+			wantUsername: "alice-dns",
+			wantRole:     RoleReadOnly,
+		},
+		{
+			name:         "email address",
+			config:       clientCertConfig{users: []clientCertUser{{match: "alice@example.com", username: "alice-email"}}},
+			wantUsername: "alice-email",
+		},
+		{
+			name:         "URI",
+			config:       clientCertConfig{users: []clientCertUser{{match: "spiffe://example/alice", username: "alice-uri"}}},
+			wantUsername: "alice-uri",
+		},
+		{
+			name:         "fingerprint",
+			config:       clientCertConfig{users: []clientCertUser{{match: fingerprint, username: "alice-fingerprint"}}},
+			wantUsername: "alice-fingerprint",
+		},
+		{
+			name:         "fingerprint with colons",
+			config:       clientCertConfig{users: []clientCertUser{{match: "SHA256:" + strings.Join(colons, ":"), username: "alice-fingerprint"}}},
+			wantUsername: "alice-fingerprint",
+		},
+		{
+			name:   "fingerprint of another certificate",
+			config: clientCertConfig{users: []clientCertUser{{match: clientCertFingerprint(ca.cert), username: "ca"}}},
+		},
+		{
+			name: "explicit mapping before the common name",
+			config: clientCertConfig{
+				users:           []clientCertUser{{match: "alice", username: "bob", role: RoleOperator}},
+				matchCommonName: true,
+			},
+			wantUsername: "bob",
+			wantRole:     RoleOperator,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			username, role := mapClientCert(test.config, cert)
+			if username != test.wantUsername || role != test.wantRole {
+				t.Errorf("mapClientCert() = %q, %q, want %q, %q", username, role, test.wantUsername, test.wantRole)
+			}
+		})
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	previousAuditLogDir := auditLogDir
+	auditLogDir = dir
+	defer func() { auditLogDir = previousAuditLogDir }()
+	gin.SetMode(gin.TestMode)
+
+	ca := newTestCA(t, "Test CA")
+	other := newTestCA(t, "Other CA")
+	config := clientCertConfig{enabled: true, caBundle: ca.pem, users: []clientCertUser{{match: "mapped.example", username: "nobody"}}}
+	pool, err := getClientCAPool(config)
+	if err != nil {
+		t.Fatalf("getClientCAPool() error = %v", err)
+	}
+
+	// connectionState returns the state of a TLS connection that verified the certificate against the pool
+	connectionState := func(cert *x509.Certificate) *tls.ConnectionState {
+		chains, err := cert.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+		if err != nil {
+			t.Fatalf("certificate of %v not verified: %v", cert.Subject.CommonName, err)
+		}
+		return &tls.ConnectionState{HandshakeComplete: true, PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: chains}
+	}
+
+	if _, err := other.issue(t, "mallory", nil, nil, nil).Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err == nil {
+		t.Errorf("certificate of another CA verified against the client CA bundle")
+	}
+
+	tests := []struct {
+		name       string
+		config     clientCertConfig
+		state      *tls.ConnectionState
+		wantStatus int
+	}{
+		{
+			name:   "plain HTTP",
+			config: config,
+		},
+		{
+			name:   "certificate not verified",
+			config: config,
+			state:  &tls.ConnectionState{HandshakeComplete: true, PeerCertificates: []*x509.Certificate{ca.issue(t, "mapped", []string{"mapped.example"}, nil, nil)}},
+		},
+		{
+			name:   "disabled",
+			config: clientCertConfig{caBundle: ca.pem, users: config.users},
+			state:  connectionState(ca.issue(t, "mapped", []string{"mapped.example"}, nil, nil)),
+		},
+		{
+			name:       "not mapped",
+			config:     config,
+			state:      connectionState(ca.issue(t, "root", nil, nil, nil)),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "mapped to a missing account",
+			config:     config,
+			state:      connectionState(ca.issue(t, "mapped", []string{"mapped.example"}, nil, nil)),
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "https://restd.example/api/status", nil)
+			c.Request.TLS = test.state
+
+			var ok bool
+			if test.state == nil || len(test.state.VerifiedChains) == 0 {
+				ok, _ = checkClientCert(c)
+			} else {
+				ok, _ = clientCertAuth(c, test.config)
+			}
+			if ok {
+				t.Fatalf("certificate authenticated, want it rejected")
+			}
+			if test.wantStatus == 0 && c.IsAborted() {
+				t.Errorf("request aborted with %v, want it passed to the next authentication method", w.Code)
+			}
+			if test.wantStatus != 0 && (!c.IsAborted() || w.Code != test.wantStatus) {
+				t.Errorf("request = %v (aborted %v), want %v", w.Code, c.IsAborted(), test.wantStatus)
+			}
+			if _, ok := c.Get(authUsernameKey); ok {
+				t.Errorf("rejected certificate set the request user")
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package gind
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings"
+)
+
+// commandCenterCacheMaxSize is the maximum number of token verification results kept in the cache
+const commandCenterCacheMaxSize = 1024
+
+// commandCenterConfig holds the system.restd.commandCenter settings
+type commandCenterConfig struct {
+	url         string
+	caFile      string
+	authRequest string
+	timeout     time.Duration
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+}
+
+// commandCenterResult is a cached token verification result
+type commandCenterResult struct {
+	valid   bool
+	expires time.Time
+}
+
+// commandCenterMetrics counts the command center token verifications
+type commandCenterMetrics struct {
+	Verifications    int64  `json:"verifications"`
+	CacheHits        int64  `json:"cacheHits"`
+	Accepted         int64  `json:"accepted"`
+	Rejected         int64  `json:"rejected"`
+	Failures         int64  `json:"failures"`
+	LastFailure      string `json:"lastFailure,omitempty"`
+	LastFailureTime  int64  `json:"lastFailureTime,omitempty"`
+	LatencyTotalMs   int64  `json:"latencyTotalMs"`
+	LatencyMaxMs     int64  `json:"latencyMaxMs"`
+	LatencyLastMs    int64  `json:"latencyLastMs"`
+	LatencyAverageMs int64  `json:"latencyAverageMs"`
+	CacheSize        int    `json:"cacheSize"`
+}
+
+var commandCenterMutex sync.Mutex
+var commandCenterCache = make(map[string]commandCenterResult)
+var commandCenterStats commandCenterMetrics
+var commandCenterClient *http.Client
+var commandCenterClientKey string
+
+// commandCenterUID returns the UID of the device the token must grant access to
+var commandCenterUID = settings.GetUIDOpenwrt
+
+// getCommandCenterConfig reads the command center settings, applying defaults for anything not configured
+func getCommandCenterConfig() commandCenterConfig {
+	jsonObject := getRestdSettings("commandCenter")
+	return commandCenterConfig{
+		url:         settingString(jsonObject, "url", "https://auth.untangle.com/v1/CheckTokenAccess"),
+		caFile:      settingString(jsonObject, "caFile", ""),
+		authRequest: settingString(jsonObject, "authRequest", "93BE7735-E9F2-487A-9DD4-9D05B95640F5"),
+		timeout:     time.Duration(settingInt(jsonObject, "timeoutSeconds", 5)) * time.Second,
+		positiveTTL: time.Duration(settingInt(jsonObject, "cacheSeconds", 300)) * time.Second,
+		negativeTTL: time.Duration(settingInt(jsonObject, "negativeCacheSeconds", 30)) * time.Second,
+	}
+}
+
+// getCommandCenterClient returns the HTTP client used to verify tokens
+// the client is reused until the CA or timeout settings change so connections to the server are kept alive
+func getCommandCenterClient(config commandCenterConfig) (*http.Client, error) {
+	commandCenterMutex.Lock()
+	defer commandCenterMutex.Unlock()
+
+	key := fmt.Sprintf("%v|%v", config.caFile, config.timeout)
+	if commandCenterClient != nil && commandCenterClientKey == key {
+		return commandCenterClient, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.caFile != "" {
+		data, err := ioutil.ReadFile(config.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no CA certificates found in " + config.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}
+	commandCenterClient = &http.Client{Transport: transport, Timeout: config.timeout}
+	commandCenterClientKey = key
+	return commandCenterClient, nil
+}
+
+// commandCenterTokenKey returns the cache key of the token, so the cache does not hold the tokens themselves
+func commandCenterTokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// getCachedCommandCenterResult returns the cached result of the token and true if there is an unexpired one
+func getCachedCommandCenterResult(key string) (bool, bool) {
+	commandCenterMutex.Lock()
+	defer commandCenterMutex.Unlock()
+
+	result, ok := commandCenterCache[key]
+	if !ok {
+		return false, false
+	}
+	if time.Now().After(result.expires) {
+		delete(commandCenterCache, key)
+		return false, false
+	}
+	commandCenterStats.CacheHits++
+	return result.valid, true
+}
+
+// cacheCommandCenterResult stores the verification result of the token for the configured TTL
+func cacheCommandCenterResult(config commandCenterConfig, key string, valid bool) {
+	ttl := config.negativeTTL
+	if valid {
+		ttl = config.positiveTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	commandCenterMutex.Lock()
+	defer commandCenterMutex.Unlock()
+
+	now := time.Now()
+	if len(commandCenterCache) >= commandCenterCacheMaxSize {
+		for k, result := range commandCenterCache {
+			if now.After(result.expires) {
+				delete(commandCenterCache, k)
+			}
+		}
+		// still full of live results, drop an arbitrary one
+		for k := range commandCenterCache {
+			if len(commandCenterCache) < commandCenterCacheMaxSize {
+				break
+			}
+			delete(commandCenterCache, k)
+		}
+	}
+	commandCenterCache[key] = commandCenterResult{valid: valid, expires: now.Add(ttl)}
+}
+
+// recordCommandCenterVerification updates the metrics after a call to the command center
+func recordCommandCenterVerification(latency time.Duration, valid bool, err error) {
+	commandCenterMutex.Lock()
+	defer commandCenterMutex.Unlock()
+
+	ms := int64(latency / time.Millisecond)
+	commandCenterStats.Verifications++
+	commandCenterStats.LatencyTotalMs += ms
+	commandCenterStats.LatencyLastMs = ms
+	if ms > commandCenterStats.LatencyMaxMs {
+		commandCenterStats.LatencyMaxMs = ms
+	}
+
+	switch {
+	case err != nil:
+		commandCenterStats.Failures++
+		commandCenterStats.LastFailure = err.Error()
+		commandCenterStats.LastFailureTime = time.Now().Unix()
+	case valid:
+		commandCenterStats.Accepted++
+	default:
+		commandCenterStats.Rejected++
+	}
+}
+
+// verifyCommandCenterToken checks the token with the command center, using the cached result if there is one
+// failures to reach the command center are not cached
+func verifyCommandCenterToken(config commandCenterConfig, token string) bool {
+	key := commandCenterTokenKey(token)
+	if valid, ok := getCachedCommandCenterResult(key); ok {
+		logger.Debug("Token verification cached: %v\n", valid)
+		return valid
+	}
+
+	start := time.Now()
+	valid, err := requestCommandCenterTokenAccess(config, token)
+	recordCommandCenterVerification(time.Since(start), valid, err)
+	if err != nil {
+		logger.Warn("Failed to verify token: %s\n", err.Error())
+		return false
+	}
+
+	cacheCommandCenterResult(config, key, valid)
+	if valid {
+		logger.Debug("Token verification successful \n")
+	} else {
+		logger.Debug("Token verification failed\n")
+	}
+	return valid
+}
+
+// requestCommandCenterTokenAccess asks the command center if the token grants access to this device
+func requestCommandCenterTokenAccess(config commandCenterConfig, token string) (bool, error) {
+	uid, err := commandCenterUID()
+	if err != nil {
+		return false, fmt.Errorf("failed to read UID: %v", err)
+	}
+
+	postdata := map[string]interface{}{
+		"token":      token,
+		"resourceId": uid,
+	}
+	bytesdata, err := json.Marshal(postdata)
+	if err != nil {
+		return false, err
+	}
+
+	client, err := getCommandCenterClient(config)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("POST", config.url, bytes.NewBuffer(bytesdata))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if config.authRequest != "" {
+		req.Header.Add("AuthRequest", config.authRequest)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	logger.Debug("Checking response... %v %v\n", resp.Status, string(b))
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return strings.TrimSpace(string(b)) == "true", nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return false, nil
+	}
+	return false, fmt.Errorf("command center returned %v", resp.Status)
+}
+
+// statusCommandCenter is the GET /api/status/commandcenter handler
+// it returns the token verification metrics
+func statusCommandCenter(c *gin.Context) {
+	commandCenterMutex.Lock()
+	stats := commandCenterStats
+	stats.CacheSize = len(commandCenterCache)
+	commandCenterMutex.Unlock()
+
+	if stats.Verifications > 0 {
+		stats.LatencyAverageMs = stats.LatencyTotalMs / stats.Verifications
+	}
+	c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,227 @@
+package gind
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// commandCenterStub is a local HTTPS command center answering token checks by token
+type commandCenterStub struct {
+	server *httptest.Server
+	caFile string
+	mutex  sync.Mutex
+	calls  map[string]int
+}
+
+func newCommandCenterStub(t *testing.T) *commandCenterStub {
+	stub := &commandCenterStub{calls: map[string]int{}}
+	stub.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request["resourceId"] != "test-uid" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		stub.mutex.Lock()
+		stub.calls[request["token"]]++
+		stub.mutex.Unlock()
+
+		switch request["token"] {
+		case "valid":
+			w.Write([]byte("true\n"))
+		case "invalid":
+			w.Write([]byte("false"))
+		case "forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	dir, err := ioutil.TempDir("", "commandcenter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.caFile = filepath.Join(dir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: stub.server.Certificate().Raw})
+	if err := ioutil.WriteFile(stub.caFile, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return stub
+}
+
+func (stub *commandCenterStub) close() {
+	stub.server.Close()
+	os.RemoveAll(filepath.Dir(stub.caFile))
+}
+
+func (stub *commandCenterStub) callCount(token string) int {
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+	return stub.calls[token]
+}
+
+// resetCommandCenterState clears the cache, metrics and client shared by the verifications
+func resetCommandCenterState() {
+	commandCenterMutex.Lock()
+	defer commandCenterMutex.Unlock()
+	commandCenterCache = make(map[string]commandCenterResult)
+	commandCenterStats = commandCenterMetrics{}
+	commandCenterClient = nil
+	commandCenterClientKey = ""
+}
+
+func TestVerifyCommandCenterToken(t *testing.T) {
+	stub := newCommandCenterStub(t)
+	defer stub.close()
+
+	savedUID := commandCenterUID
+	commandCenterUID = func() (string, error) { return "test-uid", nil }
+	defer func() { commandCenterUID = savedUID }()
+
+	config := commandCenterConfig{
+		url:         stub.server.URL,
+		caFile:      stub.caFile,
+		timeout:     5 * time.Second,
+		positiveTTL: time.Minute,
+		negativeTTL: time.Minute,
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		config    func(commandCenterConfig) commandCenterConfig
+		want      bool
+		wantCalls int
+		wantStats commandCenterMetrics
+	}{
+		{
+			name:      "accepted token is cached",
+			token:     "valid",
+			want:      true,
+			wantCalls: 1,
+			wantStats: commandCenterMetrics{Verifications: 1, Accepted: 1, CacheHits: 1},
+		},
+		{
+			name:      "rejected token is cached",
+			token:     "invalid",
+			want:      false,
+			wantCalls: 1,
+			wantStats: commandCenterMetrics{Verifications: 1, Rejected: 1, CacheHits: 1},
+		},
+		{
+			name:      "client error rejects the token",
+			token:     "forbidden",
+			want:      false,
+			wantCalls: 1,
+			wantStats: commandCenterMetrics{Verifications: 1, Rejected: 1, CacheHits: 1},
+		},
+		{
+			name:      "server error is not cached",
+			token:     "broken",
+			want:      false,
+			wantCalls: 2,
+			wantStats: commandCenterMetrics{Verifications: 2, Failures: 2},
+		},
+		{
+			name:  "zero TTL disables the cache",
+			token: "valid",
+			config: func(config commandCenterConfig) commandCenterConfig {
+				config.positiveTTL = 0
+				return config
+			},
+			want:      true,
+			wantCalls: 2,
+			wantStats: commandCenterMetrics{Verifications: 2, Accepted: 2},
+		},
+		{
+			name:  "untrusted server certificate fails",
+			token: "valid",
+			config: func(config commandCenterConfig) commandCenterConfig {
+				config.caFile = ""
+				return config
+			},
+			want:      false,
+			wantCalls: 0,
+			wantStats: commandCenterMetrics{Verifications: 2, Failures: 2},
+		},
+		{
+			name:  "missing CA file fails",
+			token: "valid",
+			config: func(config commandCenterConfig) commandCenterConfig {
+				config.caFile = filepath.Join(filepath.Dir(stub.caFile), "missing.pem")
+				return config
+			},
+			want:      false,
+			wantCalls: 0,
+			wantStats: commandCenterMetrics{Verifications: 2, Failures: 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetCommandCenterState()
+			stub.mutex.Lock()
+			stub.calls = map[string]int{}
+			stub.mutex.Unlock()
+			testConfig := config
+			if test.config != nil {
+				testConfig = test.config(config)
+			}
+
+			// the second verification is answered from the cache unless the first one was not cached
+			for i := 0; i < 2; i++ {
+				if got := verifyCommandCenterToken(testConfig, test.token); got != test.want {
+					t.Errorf("verification %d = %v, want %v", i+1, got, test.want)
+				}
+			}
+			if calls := stub.callCount(test.token); calls != test.wantCalls {
+				t.Errorf("command center called %d times, want %d", calls, test.wantCalls)
+			}
+
+			commandCenterMutex.Lock()
+			stats := commandCenterStats
+			commandCenterMutex.Unlock()
+			if stats.Verifications != test.wantStats.Verifications || stats.CacheHits != test.wantStats.CacheHits ||
+				stats.Accepted != test.wantStats.Accepted || stats.Rejected != test.wantStats.Rejected ||
+				stats.Failures != test.wantStats.Failures {
+				t.Errorf("metrics = %+v, want %+v", stats, test.wantStats)
+			}
+		})
+	}
+}
+
+func TestCommandCenterCacheExpiry(t *testing.T) {
+	resetCommandCenterState()
+	defer resetCommandCenterState()
+
+	config := commandCenterConfig{positiveTTL: time.Minute, negativeTTL: time.Minute}
+	cacheCommandCenterResult(config, "live", true)
+	commandCenterMutex.Lock()
+	commandCenterCache["expired"] = commandCenterResult{valid: true, expires: time.Now().Add(-time.Second)}
+	commandCenterMutex.Unlock()
+
+	if valid, ok := getCachedCommandCenterResult("live"); !ok || !valid {
+		t.Errorf("live result = %v, %v, want true, true", valid, ok)
+	}
+	if _, ok := getCachedCommandCenterResult("expired"); ok {
+		t.Error("expired result was returned")
+	}
+	if _, ok := commandCenterCache["expired"]; ok {
+		t.Error("expired result was not removed")
+	}
+
+	for i := 0; i < commandCenterCacheMaxSize+10; i++ {
+		cacheCommandCenterResult(config, commandCenterTokenKey(string(rune(i))), false)
+	}
+	if size := len(commandCenterCache); size > commandCenterCacheMaxSize {
+		t.Errorf("cache size = %d, want at most %d", size, commandCenterCacheMaxSize)
+	}
+}
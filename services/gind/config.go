@@ -0,0 +1,77 @@
+package gind
+
+import (
+	"github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings"
+)
+
+// restdConfigDir is where restd keeps the state it generates itself, such as signing keys
+const restdConfigDir = "/etc/config/restd"
+
+// getRestdSettings returns the restd settings object with the specified name
+// these are stored in the settings under system.restd
+// returns an empty map if the settings are missing or invalid so that defaults apply
+func getRestdSettings(name string) map[string]interface{} {
+	jsonObject, err := settings.GetSettings([]string{"system", "restd", name})
+	if err != nil || jsonObject == nil {
+		logger.Debug("Using default restd %v settings\n", name)
+		return map[string]interface{}{}
+	}
+	result, ok := jsonObject.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid type of restd %v settings: %v\n", name, jsonObject)
+		return map[string]interface{}{}
+	}
+	return result
+}
+
+// settingString returns the string setting with the specified key, or def if missing
+func settingString(jsonObject map[string]interface{}, key string, def string) string {
+	value, ok := jsonObject[key].(string)
+	if !ok || value == "" {
+		return def
+	}
+	return value
+}
+
+// settingInt returns the numeric setting with the specified key, or def if missing
+func settingInt(jsonObject map[string]interface{}, key string, def int64) int64 {
+	if _, ok := jsonObject[key]; !ok {
+		return def
+	}
+	return jsonInt64(jsonObject[key])
+}
+
+// settingIntRange returns the numeric setting with the specified key limited to the range [min, max], or def if missing
+func settingIntRange(jsonObject map[string]interface{}, key string, def int64, min int64, max int64) int64 {
+	value := settingInt(jsonObject, key, def)
+	if value < min || value > max {
+		logger.Warn("Setting %v %v is out of range [%v, %v]\n", key, value, min, max)
+		if value < min {
+			return min
+		}
+		return max
+	}
+	return value
+}
+
+// settingStrings returns the string array setting with the specified key, or an empty array if missing
+func settingStrings(jsonObject map[string]interface{}, key string) []string {
+	result := []string{}
+	values, _ := jsonObject[key].([]interface{})
+	for _, value := range values {
+		if str, ok := value.(string); ok && str != "" {
+			result = append(result, str)
+		}
+	}
+	return result
+}
+
+// settingBool returns the boolean setting with the specified key, or def if missing
+func settingBool(jsonObject map[string]interface{}, key string, def bool) bool {
+	value, ok := jsonObject[key].(bool)
+	if !ok {
+		return def
+	}
+	return value
+}
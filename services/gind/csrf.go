@@ -0,0 +1,108 @@
+package gind
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// csrfCookieName is the cookie holding the CSRF token, readable by the admin UI scripts
+const csrfCookieName = "XSRF-TOKEN"
+
+// csrfHeaderName is the header in which clients must echo the CSRF token
+const csrfHeaderName = "X-XSRF-TOKEN"
+
+// csrfSessionKey is the session value holding the CSRF token of the session
+const csrfSessionKey = "csrfToken"
+
+// sessionOptions returns the options of the auth session cookie with the specified lifetime
+// the cookie is only marked Secure on HTTPS connections since the admin UI is also served on port 80
+func sessionOptions(c *gin.Context, maxAge int) sessions.Options {
+	return sessions.Options{
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   c.Request.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// setCSRFToken generates a new CSRF token for the session and sends it in the CSRF cookie
+// the caller must save the session
+func setCSRFToken(c *gin.Context, session sessions.Session) string {
+	token, err := randomHex(32)
+	if err != nil {
+		logger.Warn("Failed to generate CSRF token: %v\n", err)
+		return ""
+	}
+	session.Set(csrfSessionKey, token)
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   sessionMaxAge,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// csrfExempt returns true if the request is not authenticated by a cookie the browser adds on its own
+func csrfExempt(c *gin.Context) bool {
+	// API keys and JWTs sent as bearer tokens can not be added by a cross site request
+	auth := strings.SplitN(c.Request.Header.Get("Authorization"), " ", 2)
+	if len(auth) == 2 && auth[0] == "Bearer" {
+		return true
+	}
+	if cookie, _ := c.Cookie("jwt"); cookie != "" {
+		return false
+	}
+	session := sessions.Default(c)
+	return session.Get("username") == nil
+}
+
+// csrfProtection is a middleware that requires the session CSRF token in the X-XSRF-TOKEN header
+// of every unsafe request authenticated by the session or JWT cookie
+// it must run before authRequired so that sessions created by the request itself, from credentials
+// it carries, are not mistaken for a session cookie sent by the browser
+func csrfProtection() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if csrfExempt(c) {
+			c.Next()
+			return
+		}
+
+		session := sessions.Default(c)
+		hasSession := session.Get("username") != nil
+		expected, _ := session.Get(csrfSessionKey).(string)
+		if !hasSession {
+			// a JWT cookie has no session to keep the token, the cookie is compared to the header instead
+			expected, _ = c.Cookie(csrfCookieName)
+		}
+
+		method := c.Request.Method
+		if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions {
+			// sessions created before CSRF protection get their token on the next safe request
+			if expected == "" && setCSRFToken(c, session) != "" && hasSession {
+				if err := session.Save(); err != nil {
+					logger.Warn("Error saving session: %s\n", err.Error())
+				}
+			}
+			c.Next()
+			return
+		}
+
+		token := c.GetHeader(csrfHeaderName)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			logger.Info("Rejected %v %v: missing or invalid CSRF token\n", method, c.Request.URL.Path)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
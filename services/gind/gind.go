@@ -7,11 +7,9 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"path"
-	"reflect"
 	"strings"
 
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/untangle/golang-shared/services/logger"
 	"github.com/untangle/golang-shared/services/settings"
@@ -22,6 +20,12 @@ import (
 var engine *gin.Engine
 var logsrc = "gin"
 
+// authSessionName is the name of the session cookie
+const authSessionName = "auth_session"
+
+// serviceShutdown is closed to stop the background routines of the gind service
+var serviceShutdown = make(chan struct{})
+
 // Startup starts the gin server
 func Startup() {
 	// Set some gin properties
@@ -38,9 +42,10 @@ func Startup() {
 	engine.Use(gin.Recovery())
 	engine.Use(addHeaders)
 
-	store := cookie.NewStore([]byte(GenerateRandomString(32)))
+	sessionStore = newServerSessionStore(sessionDir, getSessionKey())
+	sessionStore.purgeLegacy()
 
-	engine.Use(sessions.Sessions("auth_session", store))
+	engine.Use(sessions.Sessions(authSessionName, sessionStore))
 	engine.Use(addTokenToSession)
 
 	engine.GET("/", rootHandler)
@@ -50,14 +55,40 @@ func Startup() {
 	engine.GET("/testInfo", testInfo)
 	//engine.GET("/testError")
 
-	engine.POST("/account/login", authRequired())
+	engine.POST(loginPath, authRequired())
 	engine.POST("/account/logout", authLogout)
 	engine.GET("/account/logout", authLogout)
 	engine.GET("/account/status", authStatus)
+	engine.GET("/account/jwks", authJWKS)
+	engine.POST("/account/token", authToken)
+	engine.GET("/account/oidc/login", authOIDCLogin)
+	engine.GET("/account/oidc/callback", authOIDCCallback)
 
 	api := engine.Group("/api")
+	api.Use(auditRequests())
+	api.Use(csrfProtection())
 	api.Use(authRequired())
+	api.Use(permissionRequired())
 	api.GET("/status/uid", statusUID)
+	api.GET("/status/commandcenter", statusCommandCenter)
+
+	api.GET("/account/keys", apiKeysList)
+	api.POST("/account/keys", apiKeysCreate)
+	api.DELETE("/account/keys/:id", apiKeysRevoke)
+	api.GET("/account/sessions", accountSessionsList)
+	api.DELETE("/account/sessions/:id", accountSessionsRevoke)
+	api.GET("/account/lockouts", accountLockoutsList)
+	api.DELETE("/account/lockouts", accountLockoutsClear)
+	api.POST("/account/totp", accountTOTPEnroll)
+	api.POST("/account/totp/verify", accountTOTPVerify)
+	api.DELETE("/account/totp", accountTOTPDisable)
+	api.POST("/account/password", accountPasswordChange)
+	api.GET("/accounts", accountsList)
+	api.POST("/accounts", accountsCreate)
+	api.GET("/accounts/:username", accountsGet)
+	api.PUT("/accounts/:username", accountsUpdate)
+	api.DELETE("/accounts/:username", accountsDelete)
+	api.GET("/audit", auditList)
 
 	// replace packetdProxy with handlers
 	api.GET("/status/sessions", packetdProxy)
@@ -85,11 +116,29 @@ func Startup() {
 	// todo replace with threatprevention host
 	api.GET("/threatprevention/lookup/:host", packetdProxy)
 
-	// todo replace with settings routes
-	api.Any("/settings/*path", packetdProxy)
+	api.GET("/settings", getSettings)
+	api.GET("/settings/*path", getSettings)
+	api.POST("/settings", setSettings)
+	api.POST("/settings/*path", setSettings)
+	api.PATCH("/settings", patchSettings)
+	api.PATCH("/settings/*path", patchSettings)
+	api.DELETE("/settings/*path", trimSettings)
+
+	api.GET("/settings-schema", settingsSchemaStatusHandler)
+
+	api.GET("/settings-history", settingsHistoryList)
+	api.GET("/settings-history/:id", settingsHistoryGet)
+	api.GET("/settings-history/:id/diff", settingsHistoryDiff)
+	api.POST("/settings-history/:id/rollback", settingsHistoryRollback)
+
+	api.GET("/defaults", getDefaultSettings)
+	api.GET("/defaults/*path", getDefaultSettings)
 
-	// todo replace with defaults routes
-	api.Any("/defaults/*path", packetdProxy)
+	api.GET("/backup", getBackup)
+	api.POST("/backup", getBackup)
+	api.GET("/backup/schedule", getBackupSchedule)
+	api.POST("/backup/schedule/run", runBackupSchedule)
+	api.POST("/restore", restoreBackup)
 
 	// todo replace with reports routes
 	api.Any("/reports/*path", packetdProxy)
@@ -149,11 +198,22 @@ func Startup() {
 	// handle 404 routes
 	engine.NoRoute(noRouteHandler)
 
+	startJWTKeyRotation()
+	startSetupCode()
+	startSessionCleanup()
+	startBackupSchedule()
+
+	// warns at startup if settings can not be validated
+	getSettingsSchema()
+
 	// listen and serve on 0.0.0.0:80
 	go engine.Run(":80")
 
 	cert, key := certmanager.GetConfiguredCert()
-	go engine.RunTLS(":443", cert, key)
+	go runTLS(engine, ":443", cert, key)
+
+	// listen and serve on the local socket
+	go runLocalSocket(engine)
 
 	logger.Info("The RestD engine has been started\n")
 
@@ -161,7 +221,7 @@ func Startup() {
 
 // Shutdown function here to stop gind service
 func Shutdown() {
-
+	close(serviceShutdown)
 }
 
 func packetdProxy(c *gin.Context) {
@@ -173,8 +233,23 @@ func packetdProxy(c *gin.Context) {
 	proxy := httputil.NewSingleHostReverseProxy(remote)
 	//Define the director func
 
+	// packetd gets a short-lived token identifying the user instead of their credentials
+	header := make(http.Header)
+	for k, v := range c.Request.Header {
+		header[k] = v
+	}
+	header.Del(derivedTokenHeader)
+	if username := getAuthUsername(c); username != "" {
+		token, err := createDerivedToken(username, requestTokenRole(c))
+		if err != nil {
+			logger.Warn("Failed to create derived token for %v: %v\n", username, err)
+		} else {
+			header.Set(derivedTokenHeader, string(token))
+		}
+	}
+
 	proxy.Director = func(req *http.Request) {
-		req.Header = c.Request.Header
+		req.Header = header
 		req.Host = remote.Host
 		req.URL.Scheme = remote.Scheme
 		req.URL.Host = remote.Host
@@ -246,7 +321,7 @@ func testInfo(c *gin.Context) {
 		return
 	}
 
-	logger.Debug("received reply: ", reply)
+	logger.Debug("received reply: %v\n", reply)
 
 	// Retrieve the TEST_INFO information
 	info, err := messenger.RetrievePacketdReplyItem(reply, messenger.TestInfo)
@@ -267,24 +342,9 @@ func rootHandler(c *gin.Context) {
 }
 
 // returns true if the setup wizard is completed, or false if not
-// if any error occurs it returns true (assumes the wizard is completed)
+// if the setting can not be read it returns true (assumes the wizard is completed)
 func isSetupWizardCompleted() bool {
-	wizardCompletedJSON, err := settings.GetSettings([]string{"system", "setupWizard", "completed"})
-	if err != nil {
-		logger.Warn("Failed to read setup wizard completed settings: %v\n", err.Error())
-		return true
-	}
-	if wizardCompletedJSON == nil {
-		logger.Warn("Failed to read setup wizard completed settings: %v\n", wizardCompletedJSON)
-		return true
-	}
-	wizardCompletedBool, ok := wizardCompletedJSON.(bool)
-	if !ok {
-		logger.Warn("Invalid type of setup wizard completed setting: %v %v\n", wizardCompletedJSON, reflect.TypeOf(wizardCompletedJSON))
-		return true
-	}
-
-	return wizardCompletedBool
+	return !setupModeActive()
 }
 
 // statusUID returns the UID of the system
@@ -303,11 +363,15 @@ func statusUID(c *gin.Context) {
 // addTokenToSession checks for a "token" argument, and adds it to the session
 // this is easier than passing it around among redirects
 func addTokenToSession(c *gin.Context) {
+	// only links followed by the browser may carry the token, an unsafe request could be forged
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return
+	}
 	token := c.Query("token")
 	if token == "" {
 		return
 	}
-	logger.Info("Saving token in session: %v\n", token)
+	logger.Info("Saving command center token in session\n")
 	session := sessions.Default(c)
 	session.Set("token", token)
 	err := session.Save()
@@ -0,0 +1,397 @@
+package gind
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// jwtKeysFile stores the JWT signing keys, including retired keys still valid for verification
+const jwtKeysFile = restdConfigDir + "/jwt-keys.json"
+
+// jwtRotationCheckInterval is how often the signing key age is checked
+const jwtRotationCheckInterval = 1 * time.Hour
+
+// derivedTokenHeader is the header carrying the derived token on requests proxied to packetd
+const derivedTokenHeader = "X-Restd-Token"
+
+// derivedTokenAudience is the audience of the derived tokens passed to packetd
+const derivedTokenAudience = "packetd"
+
+// derivedTokenLifetime is the lifetime of the derived tokens passed to packetd
+const derivedTokenLifetime = 1 * time.Minute
+
+// jwtKey is a JWT signing key as stored in jwtKeysFile
+type jwtKey struct {
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Created   int64  `json:"created"`
+	Key       string `json:"key"`
+
+	signer     jwt.Signer
+	verifier   jwt.Verifier
+	privateKey interface{}
+}
+
+// jwtConfig holds the system.restd.jwt settings
+type jwtConfig struct {
+	enabled       bool
+	algorithm     string
+	audience      string
+	tokenLifetime time.Duration
+	rotation      time.Duration
+}
+
+var jwtKeys []*jwtKey
+var jwtKeysMutex sync.RWMutex
+
+// getJWTConfig reads the JWT settings, applying defaults for anything not configured
+func getJWTConfig() jwtConfig {
+	jsonObject := getRestdSettings("jwt")
+	return jwtConfig{
+		enabled:       settingBool(jsonObject, "enabled", true),
+		algorithm:     settingString(jsonObject, "algorithm", "ES256"),
+		audience:      settingString(jsonObject, "audience", "restd"),
+		tokenLifetime: time.Duration(settingInt(jsonObject, "tokenLifetime", 3600)) * time.Second,
+		rotation:      time.Duration(settingInt(jsonObject, "rotationDays", 30)) * 24 * time.Hour,
+	}
+}
+
+// startJWTKeyRotation loads the signing keys and rotates them on schedule until the service is shut down
+func startJWTKeyRotation() {
+	rotateJWTKeys()
+
+	go func() {
+		ticker := time.NewTicker(jwtRotationCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-serviceShutdown:
+				return
+			case <-ticker.C:
+				rotateJWTKeys()
+			}
+		}
+	}()
+}
+
+// rotateJWTKeys generates a new signing key if the current one is older than the rotation period
+// and removes retired keys once every token they could have signed has expired
+func rotateJWTKeys() {
+	config := getJWTConfig()
+	now := time.Now()
+
+	jwtKeysMutex.Lock()
+	defer jwtKeysMutex.Unlock()
+
+	if jwtKeys == nil {
+		jwtKeys = loadJWTKeys()
+	}
+
+	changed := false
+	current := currentJWTKey()
+	if current == nil || current.Algorithm != config.algorithm || now.Sub(time.Unix(current.Created, 0)) >= config.rotation {
+		key, err := generateJWTKey(config.algorithm)
+		if err != nil {
+			logger.Warn("Failed to generate JWT signing key: %v\n", err)
+		} else {
+			logger.Info("Generated new JWT signing key %v (%v)\n", key.KeyID, key.Algorithm)
+			jwtKeys = append(jwtKeys, key)
+			changed = true
+		}
+	}
+
+	// a retired key is kept for verification until the key that replaced it
+	// has been signing for longer than the token lifetime
+	kept := []*jwtKey{}
+	for i, key := range jwtKeys {
+		if i < len(jwtKeys)-1 {
+			replaced := time.Unix(jwtKeys[i+1].Created, 0)
+			if now.Sub(replaced) > config.tokenLifetime {
+				logger.Info("Removing retired JWT signing key %v\n", key.KeyID)
+				changed = true
+				continue
+			}
+		}
+		kept = append(kept, key)
+	}
+	jwtKeys = kept
+
+	if changed {
+		saveJWTKeys(jwtKeys)
+	}
+}
+
+// currentJWTKey returns the newest key, which is used for signing
+// the caller must hold jwtKeysMutex
+func currentJWTKey() *jwtKey {
+	if len(jwtKeys) == 0 {
+		return nil
+	}
+	return jwtKeys[len(jwtKeys)-1]
+}
+
+// getSigningJWTKey returns the key that should be used to sign new tokens
+func getSigningJWTKey() *jwtKey {
+	jwtKeysMutex.RLock()
+	defer jwtKeysMutex.RUnlock()
+	return currentJWTKey()
+}
+
+// findJWTKey returns the key with the specified kid, or nil if there is no such key
+func findJWTKey(kid string) *jwtKey {
+	jwtKeysMutex.RLock()
+	defer jwtKeysMutex.RUnlock()
+	for _, key := range jwtKeys {
+		if key.KeyID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// generateJWTKey creates a new signing key for the specified algorithm
+func generateJWTKey(algorithm string) (*jwtKey, error) {
+	var privateKey interface{}
+	var err error
+
+	switch algorithm {
+	case "RS256":
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, errors.New("Unsupported JWT algorithm: " + algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &jwtKey{
+		KeyID:     kid,
+		Algorithm: algorithm,
+		Created:   time.Now().Unix(),
+		Key:       string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	}
+	if err := key.init(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// init parses the PEM private key and creates the signer and verifier
+func (key *jwtKey) init() error {
+	block, _ := pem.Decode([]byte(key.Key))
+	if block == nil {
+		return errors.New("Invalid PEM data in JWT key " + key.KeyID)
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if key.Algorithm != "RS256" {
+			return errors.New("Algorithm mismatch in JWT key " + key.KeyID)
+		}
+		signer := jwt.NewRSA(jwt.SHA256, k, &k.PublicKey)
+		key.signer, key.verifier = signer, signer
+	case *ecdsa.PrivateKey:
+		if key.Algorithm != "ES256" {
+			return errors.New("Algorithm mismatch in JWT key " + key.KeyID)
+		}
+		signer := jwt.NewECDSA(jwt.SHA256, k, &k.PublicKey)
+		key.signer, key.verifier = signer, signer
+	default:
+		return errors.New("Unsupported key type in JWT key " + key.KeyID)
+	}
+	key.privateKey = privateKey
+	return nil
+}
+
+// loadJWTKeys reads the keys from jwtKeysFile, skipping any that are invalid
+func loadJWTKeys() []*jwtKey {
+	keys := []*jwtKey{}
+
+	data, err := ioutil.ReadFile(jwtKeysFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Failed to read %v: %v\n", jwtKeysFile, err)
+		}
+		return keys
+	}
+
+	var stored []*jwtKey
+	if err := json.Unmarshal(data, &stored); err != nil {
+		logger.Warn("Failed to parse %v: %v\n", jwtKeysFile, err)
+		return keys
+	}
+
+	for _, key := range stored {
+		if err := key.init(); err != nil {
+			logger.Warn("Ignoring JWT key: %v\n", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// saveJWTKeys writes the keys to jwtKeysFile
+func saveJWTKeys(keys []*jwtKey) {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		logger.Warn("Failed to serialize JWT keys: %v\n", err)
+		return
+	}
+	if err := os.MkdirAll(restdConfigDir, 0700); err != nil {
+		logger.Warn("Failed to create %v: %v\n", restdConfigDir, err)
+		return
+	}
+	if err := ioutil.WriteFile(jwtKeysFile, data, 0600); err != nil {
+		logger.Warn("Failed to write %v: %v\n", jwtKeysFile, err)
+	}
+}
+
+// publicJWK returns the public part of the key in JWK format (RFC 7517)
+func (key *jwtKey) publicJWK() map[string]interface{} {
+	jwk := map[string]interface{}{
+		"kid": key.KeyID,
+		"alg": key.Algorithm,
+		"use": "sig",
+	}
+
+	enc := base64.RawURLEncoding
+	switch k := key.privateKey.(type) {
+	case *rsa.PrivateKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = enc.EncodeToString(k.PublicKey.N.Bytes())
+		jwk["e"] = enc.EncodeToString(big.NewInt(int64(k.PublicKey.E)).Bytes())
+	case *ecdsa.PrivateKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk["kty"] = "EC"
+		jwk["crv"] = k.Curve.Params().Name
+		jwk["x"] = enc.EncodeToString(padBytes(k.PublicKey.X.Bytes(), size))
+		jwk["y"] = enc.EncodeToString(padBytes(k.PublicKey.Y.Bytes(), size))
+	}
+	return jwk
+}
+
+// padBytes left pads b with zeros to the specified size
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// createDerivedToken creates a short-lived token for the specified user and role that downstream services
+// such as packetd can verify against the JWKS instead of being handed the user's credentials
+func createDerivedToken(username string, role string) ([]byte, error) {
+	config := getJWTConfig()
+	config.audience = derivedTokenAudience
+	config.tokenLifetime = derivedTokenLifetime
+	return createJWTToken(username, role, config)
+}
+
+// requestTokenRole returns the role to put in a token issued for the request
+// requests limited by the role of an API key or client certificate get the narrower of that role and
+// the role of the user, so the token can not be used to regain the permissions the key leaves out
+func requestTokenRole(c *gin.Context) string {
+	role := getRequestRole(c)
+	keyRole, ok := c.Get(authKeyRoleKey)
+	if !ok {
+		return role
+	}
+	narrower, _ := keyRole.(string)
+	for _, permission := range rolePermissions[narrower] {
+		if !roleHasPermission(role, permission) {
+			return role
+		}
+	}
+	return narrower
+}
+
+// authJWKS is the /account/jwks handler
+// it returns the public keys that may have signed a currently valid token
+func authJWKS(c *gin.Context) {
+	jwtKeysMutex.RLock()
+	defer jwtKeysMutex.RUnlock()
+
+	keys := []map[string]interface{}{}
+	for _, key := range jwtKeys {
+		keys = append(keys, key.publicJWK())
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// authToken is the /account/token handler
+// it issues a signed access token to the user of the current session
+func authToken(c *gin.Context) {
+	username := getAuthUsername(c)
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not logged in"})
+		return
+	}
+	if username == setupUsername {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed in setup mode"})
+		return
+	}
+	// a token would outlive the enrollment restriction of the session
+	if totpEnrollmentPending(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied: two-factor enrollment required", "twoFactorEnrollRequired": true})
+		return
+	}
+
+	config := getJWTConfig()
+	if !config.enabled {
+		c.JSON(http.StatusNotFound, gin.H{"error": "JWT authentication is disabled"})
+		return
+	}
+
+	role := requestTokenRole(c)
+	if _, ok := rolePermissions[role]; !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied: no role for user " + username})
+		return
+	}
+
+	token, err := createJWTToken(username, role, config)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": string(token),
+		"token_type":   "Bearer",
+		"expires_in":   int64(config.tokenLifetime.Seconds()),
+	})
+}
@@ -0,0 +1,104 @@
+package gind
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+	"github.com/gin-gonic/gin"
+)
+
+// setupJWTTest replaces the signing keys with a new key
+func setupJWTTest(t *testing.T) (*jwtKey, func()) {
+	t.Helper()
+	key, err := generateJWTKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := jwtKeys
+	jwtKeys = []*jwtKey{key}
+	return key, func() { jwtKeys = previous }
+}
+
+// jwtTestContext returns a context of a request carrying the token as a bearer token
+func jwtTestContext(token []byte) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/status", nil)
+	c.Request.Header.Set("Authorization", "Bearer "+string(token))
+	return c
+}
+
+func TestCheckJWTTokenRole(t *testing.T) {
+	key, cleanup := setupJWTTest(t)
+	defer cleanup()
+	config := getJWTConfig()
+
+	// a directory user named like a builtin account only has the role of the token
+	token, err := createJWTToken("root", RoleReadOnly, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, username, role := checkJWTToken(jwtTestContext(token))
+	if !ok || username != "root" || role != RoleReadOnly {
+		t.Fatalf("checkJWTToken() = %v, %v, %v, want root with role %v", ok, username, role, RoleReadOnly)
+	}
+	c := jwtTestContext(token)
+	c.Set(authUsernameKey, username)
+	c.Set(authDirectoryRoleKey, role)
+	if requestHasPermission(c, PermSystemAdmin) || !requestHasPermission(c, PermStatusRead) {
+		t.Errorf("permissions of a %v token are not those of its role", RoleReadOnly)
+	}
+
+	// tokens without a valid role are rejected
+	now := time.Now()
+	for _, role := range []string{"", "superuser"} {
+		payload := CustomJWTPayload{
+			Payload: jwt.Payload{
+				Issuer:         jwtIssuer,
+				Subject:        "root",
+				Audience:       jwt.Audience{config.audience},
+				ExpirationTime: now.Add(time.Minute).Unix(),
+				IssuedAt:       now.Unix(),
+			},
+			Role: role,
+		}
+		token, err := jwt.Sign(jwt.Header{KeyID: key.KeyID}, payload, key.signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _, _ := checkJWTToken(jwtTestContext(token)); ok {
+			t.Errorf("checkJWTToken() accepted a token with role %q", role)
+		}
+	}
+}
+
+func TestRequestTokenRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    string
+		keyRole string
+		want    string
+	}{
+		{name: "session role", role: RoleOperator, want: RoleOperator},
+		{name: "narrower key role", role: RoleAdmin, keyRole: RoleReadOnly, want: RoleReadOnly},
+		{name: "wider key role", role: RoleReadOnly, keyRole: RoleAdmin, want: RoleReadOnly},
+		{name: "invalid key role is kept and grants nothing", role: RoleAdmin, keyRole: "superuser", want: "superuser"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := jwtTestContext(nil)
+			c.Set(authUsernameKey, "alice")
+			c.Set(authDirectoryRoleKey, test.role)
+			if test.keyRole != "" {
+				c.Set(authKeyRoleKey, test.keyRole)
+			}
+			if got := requestTokenRole(c); got != test.want {
+				t.Errorf("requestTokenRole() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package gind
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// ldapAuthenticator checks the username and password by binding to an LDAP directory
+// the user entry is found with a search, optionally bound as a service account, and the
+// role is mapped from the groups listed in the user entry
+type ldapAuthenticator struct {
+	url                string
+	startTLS           bool
+	insecureSkipVerify bool
+	timeout            time.Duration
+	bindDN             string
+	bindPassword       string
+	baseDN             string
+	userFilter         string
+	groupAttribute     string
+	groupRoles         map[string]interface{}
+	defaultRole        string
+}
+
+// newLDAPAuthenticator creates an LDAP authenticator from the system.restd.authentication.ldap settings
+func newLDAPAuthenticator(jsonObject map[string]interface{}) *ldapAuthenticator {
+	groupRoles, _ := jsonObject["groupRoles"].(map[string]interface{})
+	return &ldapAuthenticator{
+		url:                settingString(jsonObject, "url", "ldap://localhost:389"),
+		startTLS:           settingBool(jsonObject, "startTLS", false),
+		insecureSkipVerify: settingBool(jsonObject, "insecureSkipVerify", false),
+		timeout:            time.Duration(settingInt(jsonObject, "timeoutSeconds", 5)) * time.Second,
+		bindDN:             settingString(jsonObject, "bindDN", ""),
+		bindPassword:       settingString(jsonObject, "bindPassword", ""),
+		baseDN:             settingString(jsonObject, "baseDN", ""),
+		userFilter:         settingString(jsonObject, "userFilter", "(&(objectClass=person)(uid=%s))"),
+		groupAttribute:     settingString(jsonObject, "groupAttribute", "memberOf"),
+		groupRoles:         groupRoles,
+		defaultRole:        settingString(jsonObject, "defaultRole", ""),
+	}
+}
+
+// Name returns the name of the authenticator
+func (a *ldapAuthenticator) Name() string {
+	return "ldap"
+}
+
+// Authenticate looks up the user entry and binds as it with the password
+func (a *ldapAuthenticator) Authenticate(username string, password string) (authResult, error) {
+	// an empty password would be an unauthenticated bind, which always succeeds
+	if username == "" || password == "" {
+		return authResult{}, nil
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return authResult{}, err
+	}
+	defer conn.Close()
+
+	if a.bindDN != "" {
+		err = conn.Bind(a.bindDN, a.bindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return authResult{}, fmt.Errorf("service bind failed: %v", err)
+	}
+
+	search := ldap.NewSearchRequest(
+		a.baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.timeout.Seconds()), false,
+		fmt.Sprintf(a.userFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", a.groupAttribute},
+		nil,
+	)
+	result, err := conn.Search(search)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return authResult{}, fmt.Errorf("search failed: %v", err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		logger.Info("LDAP user %v not found or not unique\n", username)
+		return authResult{}, nil
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			logger.Info("Failed LDAP authentication: %v\n", username)
+			return authResult{}, nil
+		}
+		return authResult{}, fmt.Errorf("user bind failed: %v", err)
+	}
+
+	role := directoryRole(entry.GetAttributeValues(a.groupAttribute), a.groupRoles, a.defaultRole)
+	if _, ok := rolePermissions[role]; !ok {
+		logger.Info("LDAP user %v is not a member of any group mapped to a role\n", username)
+		return authResult{}, nil
+	}
+	return authResult{valid: true, role: role}, nil
+}
+
+// dial connects to the directory, upgrading the connection with StartTLS if configured
+func (a *ldapAuthenticator) dial() (*ldap.Conn, error) {
+	parsed, err := url.Parse(a.url)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "ldap" && parsed.Scheme != "ldaps" {
+		return nil, errors.New("Unsupported LDAP URL scheme: " + parsed.Scheme)
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         parsed.Hostname(),
+		InsecureSkipVerify: a.insecureSkipVerify,
+	}
+
+	conn, err := ldap.DialURL(a.url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.timeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.timeout)
+
+	if a.startTLS && parsed.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,286 @@
+package gind
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// testLDAPEntry is an entry of the test LDAP directory
+type testLDAPEntry struct {
+	uid      string
+	password string
+	memberOf []string
+}
+
+// testLDAPDirectory is a minimal LDAP server answering simple binds and the user search of ldapAuthenticator
+type testLDAPDirectory struct {
+	listener net.Listener
+	entries  map[string]testLDAPEntry
+	requests chan string
+}
+
+// startTestLDAPDirectory runs the test LDAP directory on a local TCP port
+// a description of each request it receives is sent to requests, the caller closes the listener
+func startTestLDAPDirectory(t *testing.T, entries map[string]testLDAPEntry) *testLDAPDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := &testLDAPDirectory{listener: listener, entries: entries, requests: make(chan string, 20)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go directory.serve(conn)
+		}
+	}()
+	return directory
+}
+
+// url returns the URL of the test LDAP directory
+func (d *testLDAPDirectory) url() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+// serve answers the requests of one connection until it is unbound or closed
+func (d *testLDAPDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+		messageID := request.Children[0].Value
+		op := request.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			d.requests <- "bind " + dn
+			entry, ok := d.entries[dn]
+			code := ldap.LDAPResultSuccess
+			if dn != "" && (!ok || entry.password != password) {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			conn.Write(testLDAPResponse(messageID, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			d.requests <- "search " + filter
+			for dn, entry := range d.entries {
+				if entry.uid == "" || !strings.Contains(filter, "(uid="+entry.uid+")") {
+					continue
+				}
+				conn.Write(testLDAPSearchEntry(messageID, dn, op.Children[7], entry).Bytes())
+			}
+			conn.Write(testLDAPResponse(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+// testLDAPResponse creates a response message with the specified result code
+func testLDAPResponse(messageID interface{}, application int, code int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(application), nil, "Response")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return testLDAPMessage(messageID, result)
+}
+
+// testLDAPSearchEntry creates a search result entry message with the requested attributes of the entry
+func testLDAPSearchEntry(messageID interface{}, dn string, requested *ber.Packet, entry testLDAPEntry) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "objectName"))
+	attributes := ber.NewSequence("attributes")
+	for _, name := range requested.Children {
+		if name.Value.(string) != "memberOf" {
+			continue
+		}
+		attribute := ber.NewSequence("attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "memberOf", "type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, group := range entry.memberOf {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, group, "value"))
+		}
+		attribute.AppendChild(values)
+		attributes.AppendChild(attribute)
+	}
+	result.AppendChild(attributes)
+	return testLDAPMessage(messageID, result)
+}
+
+// testLDAPMessage wraps a protocol operation in an LDAP message
+func testLDAPMessage(messageID interface{}, op *ber.Packet) *ber.Packet {
+	message := ber.NewSequence("LDAP Message")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "messageID"))
+	message.AppendChild(op)
+	return message
+}
+
+// receivedLDAPRequests returns the requests the test LDAP directory has received so far
+func receivedLDAPRequests(requests chan string) []string {
+	var received []string
+	for {
+		select {
+		case request := <-requests:
+			received = append(received, request)
+		default:
+			return received
+		}
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	const serviceDN = "cn=restd,dc=example,dc=com"
+	const aliceDN = "uid=alice,ou=people,dc=example,dc=com"
+	const bobDN = "uid=bob,ou=people,dc=example,dc=com"
+	const carolDN = "uid=carol,ou=people,dc=example,dc=com"
+	const adminsDN = "cn=admins,ou=groups,dc=example,dc=com"
+	const operatorsDN = "cn=operators,ou=groups,dc=example,dc=com"
+
+	directory := startTestLDAPDirectory(t, map[string]testLDAPEntry{
+		serviceDN: {password: "service-password"},
+		aliceDN:   {uid: "alice", password: "alice-password", memberOf: []string{operatorsDN, adminsDN}},
+		bobDN:     {uid: "bob", password: "bob-password", memberOf: []string{operatorsDN}},
+		carolDN:   {uid: "carol", password: "carol-password", memberOf: []string{"cn=staff,ou=groups,dc=example,dc=com"}},
+	})
+	defer directory.listener.Close()
+
+	groupRoles := map[string]interface{}{
+		" CN=Admins,OU=Groups,DC=example,DC=com": RoleAdmin,
+		operatorsDN:                              RoleOperator,
+	}
+	userSearch := func(uid string) string {
+		return "search (&(objectClass=person)(uid=" + uid + "))"
+	}
+
+	tests := []struct {
+		name         string
+		bindDN       string
+		bindPassword string
+		username     string
+		password     string
+		defaultRole  string
+		want         authResult
+		wantErr      bool
+		wantRequests []string
+	}{
+		{
+			name:         "the highest role of the groups is granted",
+			bindDN:       serviceDN,
+			bindPassword: "service-password",
+			username:     "alice",
+			password:     "alice-password",
+			want:         authResult{valid: true, role: RoleAdmin},
+			wantRequests: []string{"bind " + serviceDN, userSearch("alice"), "bind " + aliceDN},
+		},
+		{
+			name:         "anonymous search",
+			username:     "bob",
+			password:     "bob-password",
+			want:         authResult{valid: true, role: RoleOperator},
+			wantRequests: []string{"bind ", userSearch("bob"), "bind " + bobDN},
+		},
+		{
+			name:         "wrong password is rejected",
+			username:     "bob",
+			password:     "alice-password",
+			wantRequests: []string{"bind ", userSearch("bob"), "bind " + bobDN},
+		},
+		{
+			name:         "unknown user is rejected without a user bind",
+			username:     "mallory",
+			password:     "mallory-password",
+			wantRequests: []string{"bind ", userSearch("mallory")},
+		},
+		{
+			name:         "filter characters in the username are escaped",
+			username:     "*",
+			password:     "alice-password",
+			wantRequests: []string{"bind ", userSearch(`\2a`)},
+		},
+		{
+			name:         "no group mapped to a role is rejected",
+			username:     "carol",
+			password:     "carol-password",
+			wantRequests: []string{"bind ", userSearch("carol"), "bind " + carolDN},
+		},
+		{
+			name:         "no group mapped to a role gets the default role",
+			username:     "carol",
+			password:     "carol-password",
+			defaultRole:  RoleReadOnly,
+			want:         authResult{valid: true, role: RoleReadOnly},
+			wantRequests: []string{"bind ", userSearch("carol"), "bind " + carolDN},
+		},
+		{
+			name:     "empty password is rejected without connecting",
+			username: "alice",
+		},
+		{
+			name:         "failed service bind is an error",
+			bindDN:       serviceDN,
+			bindPassword: "wrong",
+			username:     "alice",
+			password:     "alice-password",
+			wantErr:      true,
+			wantRequests: []string{"bind " + serviceDN},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authenticator := &ldapAuthenticator{
+				url:            directory.url(),
+				timeout:        2 * time.Second,
+				bindDN:         test.bindDN,
+				bindPassword:   test.bindPassword,
+				baseDN:         "dc=example,dc=com",
+				userFilter:     "(&(objectClass=person)(uid=%s))",
+				groupAttribute: "memberOf",
+				groupRoles:     groupRoles,
+				defaultRole:    test.defaultRole,
+			}
+
+			got, err := authenticator.Authenticate(test.username, test.password)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("Authenticate() = %+v, want %+v", got, test.want)
+			}
+
+			// the directory records each request before answering it, so all of them have been received
+			if received := receivedLDAPRequests(directory.requests); !reflect.DeepEqual(received, test.wantRequests) {
+				t.Errorf("directory received %q, want %q", received, test.wantRequests)
+			}
+		})
+	}
+}
+
+func TestLDAPDial(t *testing.T) {
+	authenticator := &ldapAuthenticator{url: "http://localhost", timeout: time.Second}
+	if _, err := authenticator.Authenticate("alice", "alice-password"); err == nil {
+		t.Error("Authenticate() with an http URL did not fail")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator.url = "ldap://" + listener.Addr().String()
+	listener.Close()
+	if _, err := authenticator.Authenticate("alice", "alice-password"); err == nil {
+		t.Error("Authenticate() without a directory listening did not fail")
+	}
+}
@@ -0,0 +1,190 @@
+package gind
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// peerCredPrefix starts the RemoteAddr of requests received on the local socket
+const peerCredPrefix = "peercred:"
+
+// localSocketConfig holds the system.restd.localSocket settings
+type localSocketConfig struct {
+	enabled bool
+	path    string
+	mode    os.FileMode
+	// uidRoles maps the uid of the connecting process to a role, unmapped uids must authenticate otherwise
+	uidRoles map[string]interface{}
+}
+
+// peerCredentials identifies the process at the other end of a local socket connection
+type peerCredentials struct {
+	uid int
+	gid int
+	pid int
+}
+
+// peerCredConn is a local socket connection that reports the peer credentials as its remote address
+// the credentials reach the request handlers through http.Request.RemoteAddr
+type peerCredConn struct {
+	net.Conn
+	creds peerCredentials
+}
+
+// RemoteAddr returns the peer credentials of the connection as a net.Addr
+func (c *peerCredConn) RemoteAddr() net.Addr {
+	return c.creds
+}
+
+// Network returns the network of the local socket
+func (p peerCredentials) Network() string {
+	return "unix"
+}
+
+// String returns the peer credentials in the form peercred:<uid>:<gid>:<pid>
+func (p peerCredentials) String() string {
+	return fmt.Sprintf("%s%d:%d:%d", peerCredPrefix, p.uid, p.gid, p.pid)
+}
+
+// peerCredListener is a Unix socket listener that reads the peer credentials of each accepted connection
+type peerCredListener struct {
+	*net.UnixListener
+}
+
+// Accept waits for the next connection and reads the credentials of the connecting process
+// connections whose credentials can not be read are closed
+func (l peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		creds, err := getPeerCredentials(conn)
+		if err != nil {
+			logger.Warn("Failed to read local socket peer credentials: %v\n", err)
+			conn.Close()
+			continue
+		}
+		return &peerCredConn{Conn: conn, creds: creds}, nil
+	}
+}
+
+// getLocalSocketConfig reads the local socket settings, applying defaults for anything not configured
+// the socket is only writable by root and its group by default, other users can not connect to it
+func getLocalSocketConfig() localSocketConfig {
+	jsonObject := getRestdSettings("localSocket")
+	mode, err := strconv.ParseUint(settingString(jsonObject, "mode", "0660"), 8, 32)
+	if err != nil {
+		logger.Warn("Invalid local socket mode: %v\n", err)
+		mode = 0660
+	}
+	uidRoles, ok := jsonObject["uidRoles"].(map[string]interface{})
+	if !ok {
+		uidRoles = map[string]interface{}{"0": RoleAdmin}
+	}
+	return localSocketConfig{
+		enabled:  settingBool(jsonObject, "enabled", true),
+		path:     settingString(jsonObject, "path", "/var/run/restd.sock"),
+		mode:     os.FileMode(mode),
+		uidRoles: uidRoles,
+	}
+}
+
+// runLocalSocket serves the engine on the local Unix socket, where callers are identified by their uid
+func runLocalSocket(engine *gin.Engine) {
+	config := getLocalSocketConfig()
+	if !config.enabled {
+		return
+	}
+
+	// remove the socket left behind by a previous run
+	if info, err := os.Lstat(config.path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(config.path)
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: config.path, Net: "unix"})
+	if err != nil {
+		logger.Warn("Failed to listen on %v: %v\n", config.path, err)
+		return
+	}
+	if err := os.Chmod(config.path, config.mode); err != nil {
+		logger.Warn("Failed to set the mode of %v: %v\n", config.path, err)
+	}
+
+	logger.Info("Listening on local socket %v\n", config.path)
+	server := &http.Server{Handler: engine}
+	if err := server.Serve(peerCredListener{listener}); err != nil {
+		logger.Warn("Local socket listener on %v failed: %v\n", config.path, err)
+	}
+}
+
+// parsePeerCredentials returns the peer credentials of a request received on the local socket
+func parsePeerCredentials(remoteAddr string) (peerCredentials, bool) {
+	if !strings.HasPrefix(remoteAddr, peerCredPrefix) {
+		return peerCredentials{}, false
+	}
+	var creds peerCredentials
+	parts := strings.Split(strings.TrimPrefix(remoteAddr, peerCredPrefix), ":")
+	if len(parts) != 3 {
+		return peerCredentials{}, false
+	}
+	for i, target := range []*int{&creds.uid, &creds.gid, &creds.pid} {
+		value, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return peerCredentials{}, false
+		}
+		*target = value
+	}
+	return creds, true
+}
+
+// localSocketRole returns the role the uid of the peer is mapped to, or "" if it is not mapped to a valid role
+func localSocketRole(creds peerCredentials, config localSocketConfig) string {
+	uid := strconv.Itoa(creds.uid)
+	role, _ := config.uidRoles[uid].(string)
+	if role == "" {
+		logger.Debug("Local socket uid %v is not mapped to a role\n", uid)
+		return ""
+	}
+	if _, ok := rolePermissions[role]; !ok {
+		logger.Warn("Invalid role for local socket uid %v: %v\n", uid, role)
+		return ""
+	}
+	return role
+}
+
+// checkPeerCredentials checks if the request was received on the local socket from a process whose uid is mapped to a role
+// returns true and the name of the user running the process
+func checkPeerCredentials(c *gin.Context) (bool, string) {
+	return peerCredentialsAuth(c, getLocalSocketConfig())
+}
+
+// peerCredentialsAuth authenticates the local socket request with the specified configuration
+func peerCredentialsAuth(c *gin.Context, config localSocketConfig) (bool, string) {
+	creds, ok := parsePeerCredentials(c.Request.RemoteAddr)
+	if !ok {
+		return false, ""
+	}
+	role := localSocketRole(creds, config)
+	if role == "" {
+		return false, ""
+	}
+
+	uid := strconv.Itoa(creds.uid)
+	username := "uid:" + uid
+	if account, err := user.LookupId(uid); err == nil {
+		username = account.Username
+	}
+	logger.Debug("Local socket connection from %v (pid %v)\n", username, creds.pid)
+
+	c.Set(authUsernameKey, username)
+	c.Set(authDirectoryRoleKey, role)
+	return true, username
+}
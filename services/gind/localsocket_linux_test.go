@@ -0,0 +1,116 @@
+package gind
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startTestLocalSocket serves a handler reporting the local socket identity of the caller on a temporary Unix socket
+// returns a client connected through it, the caller closes the returned listener
+func startTestLocalSocket(t *testing.T, directory string, config localSocketConfig) (*net.UnixListener, *http.Client) {
+	path := filepath.Join(directory, "restd.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/whoami", func(c *gin.Context) {
+		ok, username := peerCredentialsAuth(c, config)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"remoteAddr": c.Request.RemoteAddr})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"username": username, "role": getRequestRole(c), "remoteAddr": c.Request.RemoteAddr})
+	})
+	go http.Serve(peerCredListener{listener}, engine)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	return listener, client
+}
+
+func TestLocalSocketPeerCredentials(t *testing.T) {
+	uid := strconv.Itoa(os.Getuid())
+	wantAddr := peerCredentials{uid: os.Getuid(), gid: os.Getgid(), pid: os.Getpid()}.String()
+
+	tests := []struct {
+		name       string
+		uidRoles   map[string]interface{}
+		wantStatus int
+		wantRole   string
+	}{
+		{
+			name:       "uid mapped to a role",
+			uidRoles:   map[string]interface{}{uid: RoleOperator},
+			wantStatus: http.StatusOK,
+			wantRole:   RoleOperator,
+		},
+		{
+			name:       "unmapped uid must authenticate",
+			uidRoles:   map[string]interface{}{uid + "0": RoleAdmin},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "uid mapped to an invalid role must authenticate",
+			uidRoles:   map[string]interface{}{uid: "root"},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "localsocket")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+			listener, client := startTestLocalSocket(t, directory, localSocketConfig{enabled: true, uidRoles: test.uidRoles})
+			defer listener.Close()
+
+			response, err := client.Get("http://restd/whoami")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			var body map[string]string
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+
+			if response.StatusCode != test.wantStatus {
+				t.Errorf("status = %v, want %v", response.StatusCode, test.wantStatus)
+			}
+			// the remote address carries the SO_PEERCRED credentials of this process
+			if body["remoteAddr"] != wantAddr {
+				t.Errorf("remoteAddr = %q, want %q", body["remoteAddr"], wantAddr)
+			}
+			if body["role"] != test.wantRole {
+				t.Errorf("role = %q, want %q", body["role"], test.wantRole)
+			}
+		})
+	}
+}
+
+func TestLocalSocketConfigDefaults(t *testing.T) {
+	config := getLocalSocketConfig()
+	if config.mode&0007 != 0 {
+		t.Errorf("default mode %v grants access to other users", config.mode)
+	}
+	if config.uidRoles["0"] != RoleAdmin || len(config.uidRoles) != 1 {
+		t.Errorf("default uidRoles = %v, want only root mapped to admin", config.uidRoles)
+	}
+}
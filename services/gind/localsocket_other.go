@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package gind
+
+import (
+	"errors"
+	"net"
+)
+
+// getPeerCredentials is only supported on Linux
+func getPeerCredentials(conn *net.UnixConn) (peerCredentials, error) {
+	return peerCredentials{}, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,292 @@
+package gind
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// lockoutConfig holds the system.restd.lockout settings
+type lockoutConfig struct {
+	enabled     bool
+	maxFailures int64
+	lockout     time.Duration
+	backoffBase time.Duration
+	backoffMax  time.Duration
+}
+
+// loginFailures tracks the failed logins of a single username or source IP
+type loginFailures struct {
+	count       int64
+	lastFailure time.Time
+	retryAt     time.Time
+}
+
+// loginFailureMapMax limits the number of usernames and source IPs with failures recorded, so failed
+// logins with random usernames can not grow loginFailureMap without bound
+const loginFailureMapMax = 10000
+
+// loginFailureMap is keyed by "username:<name>" or "ip:<address>"
+var loginFailureMap = make(map[string]*loginFailures)
+var loginFailureMutex sync.Mutex
+
+// getLockoutConfig reads the lockout settings, applying defaults for anything not configured
+func getLockoutConfig() lockoutConfig {
+	jsonObject := getRestdSettings("lockout")
+	return lockoutConfig{
+		enabled:     settingBool(jsonObject, "enabled", true),
+		maxFailures: settingInt(jsonObject, "maxFailures", 5),
+		lockout:     time.Duration(settingInt(jsonObject, "lockoutSeconds", 900)) * time.Second,
+		backoffBase: time.Duration(settingInt(jsonObject, "backoffSeconds", 1)) * time.Second,
+		backoffMax:  time.Duration(settingInt(jsonObject, "backoffMaxSeconds", 60)) * time.Second,
+	}
+}
+
+// loginFailureKeys returns the loginFailureMap keys of the specified username and source IP
+func loginFailureKeys(username string, ip string) []string {
+	return []string{"username:" + username, "ip:" + ip}
+}
+
+// loginRetryAfter returns how long the specified username and source IP must wait before trying to log in again
+// returns 0 if a login attempt is allowed now
+func loginRetryAfter(username string, ip string) time.Duration {
+	config := getLockoutConfig()
+	if !config.enabled {
+		return 0
+	}
+
+	loginFailureMutex.Lock()
+	defer loginFailureMutex.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range loginFailureKeys(username, ip) {
+		failures := loginFailureMap[key]
+		if failures == nil {
+			continue
+		}
+		// failures are forgotten once the lockout period has passed without a new one
+		if now.Sub(failures.lastFailure) > config.lockout {
+			delete(loginFailureMap, key)
+			continue
+		}
+		if failures.retryAt.Sub(now) > wait {
+			wait = failures.retryAt.Sub(now)
+		}
+	}
+	return wait
+}
+
+// recordLoginFailure counts a failed login for the specified username and source IP
+// each failure doubles the delay before the next attempt, and reaching maxFailures locks out
+// further attempts for the lockout period
+func recordLoginFailure(username string, ip string) {
+	config := getLockoutConfig()
+	if !config.enabled {
+		return
+	}
+
+	loginFailureMutex.Lock()
+	defer loginFailureMutex.Unlock()
+
+	now := time.Now()
+	for _, key := range loginFailureKeys(username, ip) {
+		failures := loginFailureMap[key]
+		if failures == nil {
+			if len(loginFailureMap) >= loginFailureMapMax {
+				removeExpiredLoginFailures(config, now)
+			}
+			if len(loginFailureMap) >= loginFailureMapMax {
+				evictLoginFailure(now)
+			}
+			failures = &loginFailures{}
+			loginFailureMap[key] = failures
+		}
+		failures.count++
+		failures.lastFailure = now
+
+		if failures.count >= config.maxFailures {
+			failures.retryAt = now.Add(config.lockout)
+			logger.Warn("Locking out %v for %v after %v failed logins\n", key, config.lockout, failures.count)
+			auditLog(auditEntry{
+				Event:    auditEventLockout,
+				Username: username,
+				SourceIP: ip,
+				Detail:   fmt.Sprintf("%v locked out for %v after %v failed logins", key, config.lockout, failures.count),
+			})
+			continue
+		}
+
+		backoff := time.Duration(float64(config.backoffBase) * math.Pow(2, float64(failures.count-1)))
+		if backoff > config.backoffMax {
+			backoff = config.backoffMax
+		}
+		failures.retryAt = now.Add(backoff)
+	}
+}
+
+// expireLoginFailures removes the failures whose lockout period has passed without a new one
+func expireLoginFailures() {
+	config := getLockoutConfig()
+
+	loginFailureMutex.Lock()
+	defer loginFailureMutex.Unlock()
+	removeExpiredLoginFailures(config, time.Now())
+}
+
+// removeExpiredLoginFailures removes the failures older than the lockout period
+// the caller must hold loginFailureMutex
+func removeExpiredLoginFailures(config lockoutConfig, now time.Time) {
+	for key, failures := range loginFailureMap {
+		if now.Sub(failures.lastFailure) > config.lockout {
+			delete(loginFailureMap, key)
+		}
+	}
+}
+
+// evictLoginFailure removes the entry with the oldest failure to make room for a new one
+// entries that can log in again are evicted before the ones still waiting, so filling the map
+// does not lift a lockout unless every entry is locked out
+// the caller must hold loginFailureMutex
+func evictLoginFailure(now time.Time) {
+	oldest := ""
+	oldestWaiting := false
+	for key, failures := range loginFailureMap {
+		waiting := failures.retryAt.After(now)
+		if oldest == "" || (oldestWaiting && !waiting) ||
+			(oldestWaiting == waiting && failures.lastFailure.Before(loginFailureMap[oldest].lastFailure)) {
+			oldest = key
+			oldestWaiting = waiting
+		}
+	}
+	delete(loginFailureMap, oldest)
+}
+
+// recordLoginSuccess clears the failures of the specified username after a successful login
+// the source IP failures are kept so that one valid account cannot be used to reset them
+func recordLoginSuccess(username string) {
+	loginFailureMutex.Lock()
+	defer loginFailureMutex.Unlock()
+	delete(loginFailureMap, "username:"+username)
+}
+
+// validateLogin validates the username/password, enforcing the login backoff and lockout
+// if the login is throttled it sends a 429 with a Retry-After header and aborts the request
+// returns true if the username/password is valid, false otherwise
+func validateLogin(c *gin.Context, username string, password string) bool {
+	return checkLogin(c, username, password, validate)
+}
+
+// validateLocalPassword is validateLogin against the local accounts only
+// it is used where the password of the local account itself is required, a directory password of
+// the same username is not accepted
+func validateLocalPassword(c *gin.Context, username string, password string) bool {
+	return checkLogin(c, username, password, func(username string, password string) (bool, string) {
+		result, err := localAuthenticator{}.Authenticate(username, password)
+		return err == nil && result.valid, ""
+	})
+}
+
+// checkLogin checks the username/password with the validate function, enforcing the login backoff and lockout
+func checkLogin(c *gin.Context, username string, password string, validate func(string, string) (bool, string)) bool {
+	ip := requestSourceIP(c.Request)
+	if throttleLogin(c, username, ip) {
+		return false
+	}
+
+	valid, role := validate(username, password)
+	if !valid {
+		auditEvent(c, auditEventLoginFailure, username, "", "invalid username or password")
+		recordLoginFailure(username, ip)
+		return false
+	}
+
+	recordLoginSuccess(username)
+	if role != "" {
+		c.Set(authDirectoryRoleKey, role)
+	}
+	return true
+}
+
+// throttleLogin sends a 429 with a Retry-After header and aborts the request if the username and source IP
+// must wait before trying to log in again
+// returns true if the login was throttled
+func throttleLogin(c *gin.Context, username string, ip string) bool {
+	wait := loginRetryAfter(username, ip)
+	if wait <= 0 {
+		return false
+	}
+	seconds := int64(math.Ceil(wait.Seconds()))
+	logger.Info("Throttled login for %v from %v, retry after %v seconds\n", username, ip, seconds)
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	auditEvent(c, auditEventLoginFailure, username, "", "throttled")
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts", "retryAfter": seconds})
+	c.Abort()
+	return true
+}
+
+// accountLockoutsList is the GET /api/account/lockouts handler
+// it returns every username and source IP that currently has failed logins recorded
+func accountLockoutsList(c *gin.Context) {
+	config := getLockoutConfig()
+
+	loginFailureMutex.Lock()
+	defer loginFailureMutex.Unlock()
+
+	now := time.Now()
+	result := []map[string]interface{}{}
+	for key, failures := range loginFailureMap {
+		if now.Sub(failures.lastFailure) > config.lockout {
+			continue
+		}
+		parts := strings.SplitN(key, ":", 2)
+		retryAfter := int64(0)
+		if failures.retryAt.After(now) {
+			retryAfter = int64(math.Ceil(failures.retryAt.Sub(now).Seconds()))
+		}
+		result = append(result, map[string]interface{}{
+			"type":        parts[0],
+			"value":       parts[1],
+			"failures":    failures.count,
+			"lastFailure": failures.lastFailure.Unix(),
+			"locked":      failures.count >= config.maxFailures && retryAfter > 0,
+			"retryAfter":  retryAfter,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i]["lastFailure"].(int64) > result[j]["lastFailure"].(int64)
+	})
+	c.JSON(http.StatusOK, result)
+}
+
+// accountLockoutsClear is the DELETE /api/account/lockouts handler
+// it clears the failures of the "username" and/or "ip" query arguments, or every failure if neither is specified
+func accountLockoutsClear(c *gin.Context) {
+	username := c.Query("username")
+	ip := c.Query("ip")
+
+	loginFailureMutex.Lock()
+	defer loginFailureMutex.Unlock()
+
+	if username == "" && ip == "" {
+		loginFailureMap = make(map[string]*loginFailures)
+	}
+	if username != "" {
+		delete(loginFailureMap, "username:"+username)
+	}
+	if ip != "" {
+		delete(loginFailureMap, "ip:"+ip)
+	}
+
+	logger.Info("Cleared login lockouts (username: %v, ip: %v) by %v\n", username, ip, getAuthUsername(c))
+	c.JSON(http.StatusOK, gin.H{"message": "Successfully cleared lockouts"})
+}
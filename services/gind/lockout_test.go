@@ -0,0 +1,138 @@
+package gind
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupLockoutTest clears the login failures and logs audit events to a temporary directory
+func setupLockoutTest(t *testing.T) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "lockout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousAuditLogDir := auditLogDir
+	auditLogDir = dir
+	loginFailureMap = make(map[string]*loginFailures)
+	return func() {
+		auditLogDir = previousAuditLogDir
+		loginFailureMap = make(map[string]*loginFailures)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoginRetryAfter(t *testing.T) {
+	defer setupLockoutTest(t)()
+	config := getLockoutConfig()
+
+	// the default settings double the delay from one second and lock out at the fifth failure
+	for i, want := range []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, config.lockout} {
+		recordLoginFailure("alice", "192.0.2.1")
+		wait := loginRetryAfter("alice", "192.0.2.1")
+		if wait > want || wait < want-time.Second {
+			t.Errorf("loginRetryAfter() after %v failures = %v, want %v", i+1, wait, want)
+		}
+	}
+
+	// the source IP is throttled for every username, the username from every source IP
+	if wait := loginRetryAfter("bob", "192.0.2.1"); wait < config.lockout-time.Second {
+		t.Errorf("loginRetryAfter() of another user from the source IP = %v, want %v", wait, config.lockout)
+	}
+	if wait := loginRetryAfter("alice", "192.0.2.2"); wait < config.lockout-time.Second {
+		t.Errorf("loginRetryAfter() of the user from another source IP = %v, want %v", wait, config.lockout)
+	}
+	if wait := loginRetryAfter("bob", "192.0.2.2"); wait != 0 {
+		t.Errorf("loginRetryAfter() of another user from another source IP = %v, want 0", wait)
+	}
+
+	// a success clears the username but not the source IP
+	recordLoginSuccess("alice")
+	if wait := loginRetryAfter("alice", "192.0.2.2"); wait != 0 {
+		t.Errorf("loginRetryAfter() after a success = %v, want 0", wait)
+	}
+	if wait := loginRetryAfter("alice", "192.0.2.1"); wait == 0 {
+		t.Errorf("loginRetryAfter() of the source IP after a success = 0, want the lockout")
+	}
+
+	// the failures are forgotten once the lockout period passed without a new one
+	recordLoginFailure("alice", "192.0.2.1")
+	for _, key := range loginFailureKeys("alice", "192.0.2.1") {
+		loginFailureMap[key].lastFailure = time.Now().Add(-config.lockout - time.Second)
+	}
+	if wait := loginRetryAfter("alice", "192.0.2.1"); wait != 0 {
+		t.Errorf("loginRetryAfter() after the lockout period = %v, want 0", wait)
+	}
+	if len(loginFailureMap) != 0 {
+		t.Errorf("failures after the lockout period = %v, want none", loginFailureMap)
+	}
+}
+
+func TestCheckLoginRetryAfterHeader(t *testing.T) {
+	defer setupLockoutTest(t)()
+	gin.SetMode(gin.TestMode)
+	invalid := func(string, string) (bool, string) { return false, "" }
+
+	check := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/account/login", nil)
+		c.Request.RemoteAddr = "192.0.2.1:40000"
+		checkLogin(c, "alice", "wrong", invalid)
+		return w
+	}
+
+	if w := check(); w.Code == http.StatusTooManyRequests {
+		t.Fatalf("first login = %v, want it to be checked", w.Code)
+	}
+	w := check()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("login during the backoff = %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+	if seconds, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || seconds != 1 {
+		t.Errorf("Retry-After = %q, want 1", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestLoginFailureMapLimit(t *testing.T) {
+	defer setupLockoutTest(t)()
+	now := time.Now()
+
+	loginFailureMap["username:victim"] = &loginFailures{count: 5, lastFailure: now.Add(-10 * time.Minute), retryAt: now.Add(5 * time.Minute)}
+	for i := 1; i < loginFailureMapMax; i++ {
+		loginFailureMap["username:user-"+strconv.Itoa(i)] = &loginFailures{count: 1, lastFailure: now.Add(-time.Minute), retryAt: now.Add(-time.Minute)}
+	}
+
+	recordLoginFailure("alice", "192.0.2.1")
+	if len(loginFailureMap) != loginFailureMapMax {
+		t.Errorf("failures recorded = %v, want %v", len(loginFailureMap), loginFailureMapMax)
+	}
+	for _, key := range append(loginFailureKeys("alice", "192.0.2.1"), "username:victim") {
+		if loginFailureMap[key] == nil {
+			t.Errorf("failures of %v were evicted", key)
+		}
+	}
+}
+
+func TestExpireLoginFailures(t *testing.T) {
+	defer setupLockoutTest(t)()
+	config := getLockoutConfig()
+	now := time.Now()
+
+	loginFailureMap["username:old"] = &loginFailures{count: 5, lastFailure: now.Add(-config.lockout - time.Second)}
+	loginFailureMap["ip:192.0.2.1"] = &loginFailures{count: 1, lastFailure: now.Add(-time.Second)}
+	expireLoginFailures()
+	if _, ok := loginFailureMap["username:old"]; ok {
+		t.Errorf("expired failures were kept")
+	}
+	if _, ok := loginFailureMap["ip:192.0.2.1"]; !ok {
+		t.Errorf("recent failures were removed")
+	}
+}
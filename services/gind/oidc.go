@@ -0,0 +1,605 @@
+package gind
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// oidcLoginLifetime is how long the user has to complete the login at the provider
+const oidcLoginLifetime = 10 * time.Minute
+
+// oidcDiscoveryLifetime is how long the provider metadata and keys are cached
+const oidcDiscoveryLifetime = 1 * time.Hour
+
+// oidcClockSkew is the clock difference tolerated when validating ID token timestamps
+const oidcClockSkew = 1 * time.Minute
+
+// oidcConfig holds the system.restd.oidc settings
+type oidcConfig struct {
+	enabled       bool
+	issuer        string
+	clientID      string
+	clientSecret  string
+	redirectURI   string
+	scopes        []string
+	usernameClaim string
+	roleClaim     string
+	claimRoles    map[string]interface{}
+	defaultRole   string
+	accounts      []oidcAccountMapping
+	timeout       time.Duration
+}
+
+// oidcAccountMapping maps the OIDC identity of an issuer and subject to a local account
+type oidcAccountMapping struct {
+	issuer   string
+	subject  string
+	username string
+}
+
+// oidcProvider is the provider metadata from the discovery document and its signing keys
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+// oidcIDTokenClaims are the registered claims of an ID token checked by restd
+type oidcIDTokenClaims struct {
+	jwt.Payload
+	Nonce           string `json:"nonce"`
+	AuthorizedParty string `json:"azp"`
+}
+
+var oidcProviderCache *oidcProvider
+var oidcProviderMutex sync.Mutex
+
+// getOIDCConfig reads the OIDC settings, applying defaults for anything not configured
+func getOIDCConfig() oidcConfig {
+	jsonObject := getRestdSettings("oidc")
+	claimRoles, _ := jsonObject["claimRoles"].(map[string]interface{})
+	scopes := settingStrings(jsonObject, "scopes")
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	issuer := strings.TrimRight(settingString(jsonObject, "issuer", ""), "/")
+	accounts := []oidcAccountMapping{}
+	accountsJSON, _ := jsonObject["accounts"].([]interface{})
+	for _, value := range accountsJSON {
+		entry, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		accounts = append(accounts, oidcAccountMapping{
+			issuer:   strings.TrimRight(settingString(entry, "issuer", issuer), "/"),
+			subject:  settingString(entry, "subject", ""),
+			username: settingString(entry, "username", ""),
+		})
+	}
+	return oidcConfig{
+		enabled:       settingBool(jsonObject, "enabled", false),
+		issuer:        issuer,
+		clientID:      settingString(jsonObject, "clientId", ""),
+		clientSecret:  settingString(jsonObject, "clientSecret", ""),
+		redirectURI:   settingString(jsonObject, "redirectUri", ""),
+		scopes:        scopes,
+		usernameClaim: settingString(jsonObject, "usernameClaim", "preferred_username"),
+		roleClaim:     settingString(jsonObject, "roleClaim", "groups"),
+		claimRoles:    claimRoles,
+		defaultRole:   settingString(jsonObject, "defaultRole", ""),
+		accounts:      accounts,
+		timeout:       time.Duration(settingInt(jsonObject, "timeoutSeconds", 10)) * time.Second,
+	}
+}
+
+// getOIDCProvider returns the provider metadata, fetching the discovery document and keys when
+// the cache is empty, stale or for a different issuer
+// refresh forces the keys to be fetched again, which is needed after the provider rotates them
+func getOIDCProvider(config oidcConfig, refresh bool) (*oidcProvider, error) {
+	oidcProviderMutex.Lock()
+	defer oidcProviderMutex.Unlock()
+
+	cached := oidcProviderCache
+	if cached != nil && !refresh && strings.TrimRight(cached.Issuer, "/") == config.issuer && time.Since(cached.fetched) < oidcDiscoveryLifetime {
+		return cached, nil
+	}
+
+	client := &http.Client{Timeout: config.timeout}
+	provider := &oidcProvider{}
+	if err := oidcGetJSON(client, config.issuer+"/.well-known/openid-configuration", provider); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(provider.Issuer, "/") != config.issuer {
+		return nil, fmt.Errorf("discovery issuer %v does not match %v", provider.Issuer, config.issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+
+	var jwks struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := oidcGetJSON(client, provider.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	provider.keys = make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		kid, _ := jwk["kid"].(string)
+		key, err := parseJWK(jwk)
+		if err != nil {
+			logger.Debug("Ignoring OIDC key %v: %v\n", kid, err)
+			continue
+		}
+		provider.keys[kid] = key
+	}
+
+	provider.fetched = time.Now()
+	oidcProviderCache = provider
+	return provider, nil
+}
+
+// oidcGetJSON fetches the URL and parses the JSON response into result
+func oidcGetJSON(client *http.Client, target string, result interface{}) error {
+	resp, err := client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v returned %v", target, resp.Status)
+	}
+	return json.Unmarshal(body, result)
+}
+
+// parseJWK converts an RSA or EC public key in JWK format (RFC 7517) to an *rsa.PublicKey or *ecdsa.PublicKey
+func parseJWK(jwk map[string]interface{}) (interface{}, error) {
+	if use, ok := jwk["use"].(string); ok && use != "sig" {
+		return nil, errors.New("not a signing key")
+	}
+
+	decode := func(name string) (*big.Int, error) {
+		value, _ := jwk[name].(string)
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil || len(data) == 0 {
+			return nil, fmt.Errorf("invalid %v", name)
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+
+	switch jwk["kty"] {
+	case "RSA":
+		n, err := decode("n")
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e")
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk["crv"] {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", jwk["crv"])
+		}
+		x, err := decode("x")
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y")
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %v", jwk["kty"])
+}
+
+// oidcVerifier returns the verifier of the specified algorithm for the key, or nil if they do not match
+func oidcVerifier(algorithm string, key interface{}) jwt.Verifier {
+	hashes := map[string]jwt.Hash{"256": jwt.SHA256, "384": jwt.SHA384, "512": jwt.SHA512}
+	if len(algorithm) != 5 {
+		return nil
+	}
+	hash, ok := hashes[algorithm[2:]]
+	if !ok {
+		return nil
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(algorithm, "RS") {
+			return jwt.NewRSA(hash, nil, k)
+		}
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(algorithm, "ES") && k.Curve.Params().BitSize == map[string]int{"256": 256, "384": 384, "512": 521}[algorithm[2:]] {
+			return jwt.NewECDSA(hash, nil, k)
+		}
+	}
+	return nil
+}
+
+// verifyIDToken verifies the signature and claims of the ID token and returns all of its claims
+func verifyIDToken(config oidcConfig, provider *oidcProvider, token string, nonce string) (map[string]interface{}, error) {
+	raw, err := jwt.Parse([]byte(token))
+	if err != nil {
+		return nil, err
+	}
+	var claims oidcIDTokenClaims
+	head, err := raw.Decode(&claims)
+	if err != nil {
+		return nil, err
+	}
+	allClaims := make(map[string]interface{})
+	if _, err := raw.Decode(&allClaims); err != nil {
+		return nil, err
+	}
+
+	key, ok := provider.keys[head.KeyID]
+	if !ok {
+		// the provider may have rotated its keys since they were fetched
+		if provider, err = getOIDCProvider(config, true); err != nil {
+			return nil, err
+		}
+		if key, ok = provider.keys[head.KeyID]; !ok {
+			return nil, fmt.Errorf("unknown key %v", head.KeyID)
+		}
+	}
+	verifier := oidcVerifier(head.Algorithm, key)
+	if verifier == nil {
+		return nil, fmt.Errorf("algorithm %v does not match key %v", head.Algorithm, head.KeyID)
+	}
+	if err := raw.Verify(verifier); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := claims.Validate(
+		jwt.IssuedAtValidator(now.Add(oidcClockSkew)),
+		jwt.ExpirationTimeValidator(now.Add(-oidcClockSkew), true),
+		jwt.NotBeforeValidator(now.Add(oidcClockSkew)),
+		jwt.IssuerValidator(provider.Issuer),
+		jwt.AudienceValidator(jwt.Audience{config.clientID}),
+	); err != nil {
+		return nil, err
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != config.clientID {
+		return nil, errors.New("azp does not match the client ID")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("nonce mismatch")
+	}
+	return allClaims, nil
+}
+
+// oidcRedirectURI returns the configured redirect URI, or the callback URL of the current host
+func oidcRedirectURI(c *gin.Context, config oidcConfig) string {
+	if config.redirectURI != "" {
+		return config.redirectURI
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + "/account/oidc/callback"
+}
+
+// oidcReturnPath returns the local path to send the user to after login
+// only paths on this host are allowed so the login can not be used as an open redirect
+func oidcReturnPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/admin"
+	}
+	return path
+}
+
+// oidcClaimStrings returns the claim as a list of strings, accepting a string or an array of strings
+func oidcClaimStrings(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		result := []string{}
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return []string{}
+}
+
+// oidcLocalAccount returns the local account mapped to the issuer and subject of an ID token, or "" if
+// the identity is not mapped
+// the subject is the stable identifier of the user at the issuer, unlike the username claims which
+// users can often change themselves
+func oidcLocalAccount(config oidcConfig, issuer string, subject string) string {
+	for _, mapping := range config.accounts {
+		if mapping.subject != "" && mapping.subject == subject && mapping.issuer == strings.TrimRight(issuer, "/") {
+			return mapping.username
+		}
+	}
+	return ""
+}
+
+// authOIDCLogin is the /account/oidc/login handler
+// it starts the authorization code flow with PKCE (RFC 7636) by redirecting to the provider
+func authOIDCLogin(c *gin.Context) {
+	oidcLogin(c, getOIDCConfig())
+}
+
+// oidcLogin starts the OIDC login with the specified settings
+func oidcLogin(c *gin.Context, config oidcConfig) {
+	if !config.enabled || config.issuer == "" || config.clientID == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OIDC authentication is disabled"})
+		return
+	}
+
+	provider, err := getOIDCProvider(config, false)
+	if err != nil {
+		logger.Warn("Failed to discover OIDC provider %v: %v\n", config.issuer, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "OIDC provider unavailable"})
+		return
+	}
+
+	state, err := randomHex(16)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login: " + err.Error()})
+		return
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login: " + err.Error()})
+		return
+	}
+	verifier, err := randomHex(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login: " + err.Error()})
+		return
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	redirectURI := oidcRedirectURI(c, config)
+
+	session := sessions.Default(c)
+	session.Set("oidcState", state)
+	session.Set("oidcNonce", nonce)
+	session.Set("oidcVerifier", verifier)
+	session.Set("oidcRedirectURI", redirectURI)
+	session.Set("oidcReturn", oidcReturnPath(c.Query("return")))
+	session.Set("oidcIssued", time.Now().Unix())
+	if session.Get("username") == nil {
+		session.Options(sessionOptions(c, int(oidcLoginLifetime.Seconds())))
+	}
+	if err := session.Save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session: " + err.Error()})
+		return
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", config.clientID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("scope", strings.Join(config.scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	c.Redirect(http.StatusFound, provider.AuthorizationEndpoint+separator+query.Encode())
+}
+
+// authOIDCCallback is the /account/oidc/callback handler
+// it exchanges the authorization code for an ID token and creates the auth session of the user it names
+// identities mapped to a local account with a second factor get a pending session instead, which is
+// completed by posting the code to the login route
+func authOIDCCallback(c *gin.Context) {
+	oidcCallback(c, getOIDCConfig())
+}
+
+// oidcCallback completes the OIDC login with the specified settings
+func oidcCallback(c *gin.Context, config oidcConfig) {
+	if !config.enabled {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OIDC authentication is disabled"})
+		return
+	}
+
+	session := sessions.Default(c)
+	state, _ := session.Get("oidcState").(string)
+	nonce, _ := session.Get("oidcNonce").(string)
+	verifier, _ := session.Get("oidcVerifier").(string)
+	redirectURI, _ := session.Get("oidcRedirectURI").(string)
+	returnPath, _ := session.Get("oidcReturn").(string)
+	issued, _ := session.Get("oidcIssued").(int64)
+	for _, key := range []string{"oidcState", "oidcNonce", "oidcVerifier", "oidcRedirectURI", "oidcReturn", "oidcIssued"} {
+		session.Delete(key)
+	}
+	session.Save()
+
+	if state == "" || time.Since(time.Unix(issued, 0)) > oidcLoginLifetime {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No OIDC login in progress"})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Query("state")), []byte(state)) != 1 {
+		auditEvent(c, auditEventLoginFailure, "", authMethodOIDC, "state mismatch")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OIDC state"})
+		return
+	}
+	if errorCode := c.Query("error"); errorCode != "" {
+		logger.Info("OIDC provider returned error: %v %v\n", errorCode, c.Query("error_description"))
+		auditEvent(c, auditEventLoginFailure, "", authMethodOIDC, "provider error "+errorCode)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "OIDC login failed: " + errorCode})
+		return
+	}
+
+	provider, err := getOIDCProvider(config, false)
+	if err != nil {
+		logger.Warn("Failed to discover OIDC provider %v: %v\n", config.issuer, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "OIDC provider unavailable"})
+		return
+	}
+
+	idToken, err := oidcExchangeCode(config, provider, c.Query("code"), redirectURI, verifier)
+	if err != nil {
+		logger.Warn("Failed to exchange OIDC code: %v\n", err)
+		auditEvent(c, auditEventLoginFailure, "", authMethodOIDC, "code exchange failed")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "OIDC login failed"})
+		return
+	}
+	claims, err := verifyIDToken(config, provider, idToken, nonce)
+	if err != nil {
+		logger.Warn("Invalid OIDC ID token: %v\n", err)
+		auditEvent(c, auditEventLoginFailure, "", authMethodOIDC, "invalid ID token")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "OIDC login failed"})
+		return
+	}
+
+	issuer, _ := claims["iss"].(string)
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		logger.Warn("OIDC ID token is missing the sub claim\n")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "OIDC login failed: missing sub"})
+		return
+	}
+
+	method := authMethodOIDC
+	username := oidcLocalAccount(config, issuer, subject)
+	if username != "" {
+		// identities mapped to a local account keep its role and its second factor
+		if builtinUsers[username] || getCredentials(username) == nil {
+			logger.Warn("OIDC subject %v is mapped to invalid account %v\n", subject, username)
+			auditEvent(c, auditEventLoginFailure, username, authMethodOIDC, "invalid account mapping")
+			c.JSON(http.StatusForbidden, gin.H{"error": "OIDC login failed: invalid account mapping for " + subject})
+			return
+		}
+		method = requireSecondFactor(c, username, authMethodOIDC, "")
+		if c.IsAborted() {
+			return
+		}
+	} else {
+		// other users get the role mapped from the claims and can never take over a local account
+		username, _ = claims[config.usernameClaim].(string)
+		if username == "" {
+			logger.Warn("OIDC ID token is missing the %v claim\n", config.usernameClaim)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "OIDC login failed: missing " + config.usernameClaim})
+			return
+		}
+		if builtinUsers[username] || getCredentials(username) != nil {
+			logger.Warn("OIDC user %v (%v) conflicts with a local account that is not mapped to it\n", username, subject)
+			auditEvent(c, auditEventLoginFailure, username, authMethodOIDC, "username conflicts with a local account")
+			c.JSON(http.StatusForbidden, gin.H{"error": "OIDC login failed: " + username + " is a local account"})
+			return
+		}
+		role := directoryRole(oidcClaimStrings(claims, config.roleClaim), config.claimRoles, config.defaultRole)
+		if _, ok := rolePermissions[role]; !ok {
+			logger.Info("OIDC user %v has no claim mapped to a role\n", username)
+			auditEvent(c, auditEventLoginFailure, username, authMethodOIDC, "no role")
+			c.JSON(http.StatusForbidden, gin.H{"error": "OIDC login failed: no role for user " + username})
+			return
+		}
+		c.Set(authDirectoryRoleKey, role)
+	}
+
+	if !setAuthSession(c, username, method) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Authorization failed: Failed to create OIDC auth session"})
+		return
+	}
+	markTOTPEnrollment(c, username)
+
+	logger.Info("Successful OIDC authentication: %v\n", username)
+	c.Redirect(http.StatusFound, oidcReturnPath(returnPath))
+}
+
+// oidcExchangeCode redeems the authorization code at the token endpoint and returns the ID token
+func oidcExchangeCode(config oidcConfig, provider *oidcProvider, code string, redirectURI string, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("missing code")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", verifier)
+	if config.clientSecret == "" {
+		form.Set("client_id", config.clientID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if config.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(config.clientID), url.QueryEscape(config.clientSecret))
+	}
+
+	client := &http.Client{Timeout: config.timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("token endpoint returned %v: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || result.Error != "" {
+		return "", fmt.Errorf("token endpoint returned %v: %v %v", resp.Status, result.Error, result.ErrorDescription)
+	}
+	if result.IDToken == "" {
+		return "", errors.New("token response is missing the id_token")
+	}
+	return result.IDToken, nil
+}
@@ -0,0 +1,501 @@
+package gind
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// oidcTestKeyID is the key ID of the signing key of the test provider
+const oidcTestKeyID = "test-key"
+
+// oidcTestClientID is the client ID restd uses at the test provider
+const oidcTestClientID = "restd"
+
+// oidcTestAuthorization is an authorization code issued by the test provider
+type oidcTestAuthorization struct {
+	nonce     string
+	challenge string
+}
+
+// oidcTestProvider is an OIDC provider serving the discovery document, its keys and a token endpoint
+// the token endpoint checks the PKCE verifier and returns an ID token with the claims of the authorization,
+// changed by the claims function of the test
+type oidcTestProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims func(claims map[string]interface{})
+
+	mutex sync.Mutex
+	codes map[string]oidcTestAuthorization
+}
+
+func newOIDCTestProvider(t *testing.T) *oidcTestProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &oidcTestProvider{key: key, codes: map[string]oidcTestAuthorization{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.server.URL,
+			"authorization_endpoint": provider.server.URL + "/authorize",
+			"token_endpoint":         provider.server.URL + "/token",
+			"jwks_uri":               provider.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": oidcTestKeyID,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", provider.token)
+	provider.server = httptest.NewServer(mux)
+	return provider
+}
+
+// authorize issues a code for the authorization request restd redirected the user to
+func (p *oidcTestProvider) authorize(t *testing.T, location string) (code string, state string) {
+	t.Helper()
+	target, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := target.Query()
+	if target.Path != "/authorize" || query.Get("client_id") != oidcTestClientID || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization request = %v, want a PKCE request of %v", location, oidcTestClientID)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	code = "code-" + strconv.Itoa(len(p.codes))
+	p.codes[code] = oidcTestAuthorization{nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+	return code, query.Get("state")
+}
+
+func (p *oidcTestProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	p.mutex.Lock()
+	authorization, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mutex.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("client_id") != oidcTestClientID ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":                p.server.URL,
+		"sub":                "subject-1",
+		"aud":                oidcTestClientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              authorization.nonce,
+		"preferred_username": "alice",
+		"groups":             []string{"admins"},
+	}
+	if p.claims != nil {
+		p.claims(claims)
+	}
+	token, err := jwt.Sign(jwt.Header{KeyID: oidcTestKeyID}, claims, jwt.NewRSA(jwt.SHA256, p.key, &p.key.PublicKey))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": string(token)})
+}
+
+// oidcTestConfig returns the settings of a login through the provider
+func oidcTestConfig(provider *oidcTestProvider) oidcConfig {
+	return oidcConfig{
+		enabled:       true,
+		issuer:        provider.server.URL,
+		clientID:      oidcTestClientID,
+		redirectURI:   "https://restd.example/callback",
+		scopes:        []string{"openid"},
+		usernameClaim: "preferred_username",
+		roleClaim:     "groups",
+		claimRoles:    map[string]interface{}{"admins": RoleAdmin, "operators": RoleOperator},
+		accounts:      []oidcAccountMapping{},
+		timeout:       5 * time.Second,
+	}
+}
+
+// setupOIDCTest points the session store and audit log to temporary directories and clears the provider cache
+func setupOIDCTest(t *testing.T) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousStore, previousAuditLogDir := sessionStore, auditLogDir
+	sessionStore = newServerSessionStore(dir+"/sessions", []byte("0123456789abcdef0123456789abcdef"))
+	auditLogDir = dir + "/log"
+	oidcProviderCache = nil
+	return func() {
+		sessionStore, auditLogDir = previousStore, previousAuditLogDir
+		oidcProviderCache = nil
+		os.RemoveAll(dir)
+	}
+}
+
+// oidcTestEngine returns an engine with the login and callback routes using the config and a route
+// returning the user of the session
+func oidcTestEngine(config oidcConfig) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(sessions.Sessions(authSessionName, sessionStore))
+	engine.GET("/login", func(c *gin.Context) { oidcLogin(c, config) })
+	engine.GET("/callback", func(c *gin.Context) { oidcCallback(c, config) })
+	engine.GET("/session", func(c *gin.Context) {
+		session := sessions.Default(c)
+		c.JSON(http.StatusOK, gin.H{"username": session.Get("username"), "directoryRole": session.Get("directoryRole")})
+	})
+	return engine
+}
+
+// oidcTestRequest sends a GET with the cookies and adds the cookies set by the response to them
+func oidcTestRequest(engine *gin.Engine, target string, cookies map[string]*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	for _, cookie := range w.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+	tests := []struct {
+		name         string
+		claims       func(claims map[string]interface{})
+		config       func(config *oidcConfig)
+		state        string
+		code         string
+		wantStatus   int
+		wantUsername string
+		wantRole     string
+	}{
+		{
+			name:         "directory user with a role claim",
+			wantStatus:   http.StatusFound,
+			wantUsername: "alice",
+			wantRole:     RoleAdmin,
+		},
+		{
+			name:         "default role without a mapped claim",
+			claims:       func(claims map[string]interface{}) { claims["groups"] = []string{"staff"} },
+			config:       func(config *oidcConfig) { config.defaultRole = RoleReadOnly },
+			wantStatus:   http.StatusFound,
+			wantUsername: "alice",
+			wantRole:     RoleReadOnly,
+		},
+		{
+			name: "several audiences with the client as authorized party",
+			claims: func(claims map[string]interface{}) {
+				claims["aud"] = []string{oidcTestClientID, "other"}
+				claims["azp"] = oidcTestClientID
+			},
+			wantStatus:   http.StatusFound,
+			wantUsername: "alice",
+			wantRole:     RoleAdmin,
+		},
+		{
+			name:       "bad nonce",
+			claims:     func(claims map[string]interface{}) { claims["nonce"] = "replayed" },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong audience",
+			claims:     func(claims map[string]interface{}) { claims["aud"] = "other" },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "several audiences without the client as authorized party",
+			claims:     func(claims map[string]interface{}) { claims["aud"] = []string{oidcTestClientID, "other"} },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong issuer",
+			claims:     func(claims map[string]interface{}) { claims["iss"] = "https://idp.example" },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "expired token",
+			claims: func(claims map[string]interface{}) {
+				claims["iat"] = time.Now().Add(-2 * time.Hour).Unix()
+				claims["exp"] = time.Now().Add(-1 * time.Hour).Unix()
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing sub",
+			claims:     func(claims map[string]interface{}) { delete(claims, "sub") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "state mismatch",
+			state:      "forged",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown code",
+			code:       "forged",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "no role",
+			claims:     func(claims map[string]interface{}) { claims["groups"] = []string{"staff"} },
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "username of a builtin account",
+			claims:     func(claims map[string]interface{}) { claims["preferred_username"] = "root" },
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "subject mapped to a missing account",
+			config: func(config *oidcConfig) {
+				config.accounts = []oidcAccountMapping{{issuer: config.issuer, subject: "subject-1", username: "bob"}}
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "subject mapped to a builtin account",
+			config: func(config *oidcConfig) {
+				config.accounts = []oidcAccountMapping{{issuer: config.issuer, subject: "subject-1", username: "setup"}}
+			},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer setupOIDCTest(t)()
+			provider := newOIDCTestProvider(t)
+			defer provider.server.Close()
+			provider.claims = test.claims
+			config := oidcTestConfig(provider)
+			if test.config != nil {
+				test.config(&config)
+			}
+			engine := oidcTestEngine(config)
+			cookies := map[string]*http.Cookie{}
+
+			w := oidcTestRequest(engine, "/login?return=/admin/status", cookies)
+			if w.Code != http.StatusFound {
+				t.Fatalf("login = %v %v, want a redirect", w.Code, w.Body.String())
+			}
+			code, state := provider.authorize(t, w.Header().Get("Location"))
+			if test.state != "" {
+				state = test.state
+			}
+			if test.code != "" {
+				code = test.code
+			}
+
+			w = oidcTestRequest(engine, "/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), cookies)
+			if w.Code != test.wantStatus {
+				t.Fatalf("callback = %v %v, want %v", w.Code, w.Body.String(), test.wantStatus)
+			}
+			if test.wantStatus == http.StatusFound && w.Header().Get("Location") != "/admin/status" {
+				t.Errorf("callback redirect = %v, want /admin/status", w.Header().Get("Location"))
+			}
+
+			w = oidcTestRequest(engine, "/session", cookies)
+			var session struct {
+				Username      string `json:"username"`
+				DirectoryRole string `json:"directoryRole"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &session); err != nil {
+				t.Fatal(err)
+			}
+			if session.Username != test.wantUsername || session.DirectoryRole != test.wantRole {
+				t.Errorf("session = %v with role %q, want %v with role %q", session.Username, session.DirectoryRole, test.wantUsername, test.wantRole)
+			}
+
+			// the state of a login can only be used once
+			if w := oidcTestRequest(engine, "/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), cookies); w.Code != http.StatusBadRequest {
+				t.Errorf("replayed callback = %v, want %v", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestOIDCDisabled(t *testing.T) {
+	defer setupOIDCTest(t)()
+	engine := oidcTestEngine(oidcConfig{})
+	for _, target := range []string{"/login", "/callback"} {
+		if w := oidcTestRequest(engine, target, map[string]*http.Cookie{}); w.Code != http.StatusNotFound {
+			t.Errorf("%v = %v, want %v", target, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestGetOIDCProvider(t *testing.T) {
+	defer setupOIDCTest(t)()
+	provider := newOIDCTestProvider(t)
+	defer provider.server.Close()
+	config := oidcTestConfig(provider)
+
+	discovered, err := getOIDCProvider(config, false)
+	if err != nil {
+		t.Fatalf("getOIDCProvider() error = %v", err)
+	}
+	if discovered.Issuer != provider.server.URL || discovered.TokenEndpoint != provider.server.URL+"/token" {
+		t.Errorf("getOIDCProvider() = %+v, want the metadata of %v", discovered, provider.server.URL)
+	}
+	key, ok := discovered.keys[oidcTestKeyID].(*rsa.PublicKey)
+	if !ok || key.N.Cmp(provider.key.N) != 0 || key.E != provider.key.E {
+		t.Errorf("getOIDCProvider() keys = %v, want the provider key", discovered.keys)
+	}
+	if cached, _ := getOIDCProvider(config, false); cached != discovered {
+		t.Errorf("getOIDCProvider() did not use the cached provider")
+	}
+
+	config.issuer = provider.server.URL + "/other"
+	if _, err := getOIDCProvider(config, false); err == nil {
+		t.Errorf("getOIDCProvider() of an issuer without a discovery document succeeded")
+	}
+}
+
+func TestParseJWK(t *testing.T) {
+	encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		jwk     map[string]interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name: "RSA",
+			jwk:  map[string]interface{}{"kty": "RSA", "use": "sig", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+			want: &rsaKey.PublicKey,
+		},
+		{
+			name: "EC",
+			jwk:  map[string]interface{}{"kty": "EC", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+			want: &ecKey.PublicKey,
+		},
+		{
+			name:    "EC point not on the curve",
+			jwk:     map[string]interface{}{"kty": "EC", "crv": "P-256", "x": encode(ecKey.X), "y": encode(new(big.Int).Add(ecKey.Y, big.NewInt(1)))},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported curve",
+			jwk:     map[string]interface{}{"kty": "EC", "crv": "P-192", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+			wantErr: true,
+		},
+		{
+			name:    "encryption key",
+			jwk:     map[string]interface{}{"kty": "RSA", "use": "enc", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+			wantErr: true,
+		},
+		{
+			name:    "missing modulus",
+			jwk:     map[string]interface{}{"kty": "RSA", "e": encode(big.NewInt(int64(rsaKey.E)))},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported key type",
+			jwk:     map[string]interface{}{"kty": "oct", "k": "c2VjcmV0"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseJWK(test.jwk)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parseJWK() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJWK() error = %v", err)
+			}
+			switch want := test.want.(type) {
+			case *rsa.PublicKey:
+				if key, ok := got.(*rsa.PublicKey); !ok || key.N.Cmp(want.N) != 0 || key.E != want.E {
+					t.Errorf("parseJWK() = %v, want %v", got, want)
+				}
+			case *ecdsa.PublicKey:
+				if key, ok := got.(*ecdsa.PublicKey); !ok || key.Curve != want.Curve || key.X.Cmp(want.X) != 0 || key.Y.Cmp(want.Y) != 0 {
+					t.Errorf("parseJWK() = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOIDCLocalAccount(t *testing.T) {
+	config := oidcConfig{accounts: []oidcAccountMapping{
+		{issuer: "https://idp.example", subject: "subject-1", username: "alice"},
+		{issuer: "https://other.example", subject: "subject-2", username: "bob"},
+		{issuer: "https://idp.example", subject: "", username: "carol"},
+	}}
+
+	tests := []struct {
+		issuer  string
+		subject string
+		want    string
+	}{
+		{"https://idp.example", "subject-1", "alice"},
+		{"https://idp.example/", "subject-1", "alice"},
+		{"https://other.example", "subject-1", ""},
+		{"https://other.example", "subject-2", "bob"},
+		{"https://idp.example", "subject-2", ""},
+		{"https://idp.example", "", ""},
+	}
+	for _, test := range tests {
+		if got := oidcLocalAccount(config, test.issuer, test.subject); got != test.want {
+			t.Errorf("oidcLocalAccount(%v, %v) = %q, want %q", test.issuer, test.subject, got, test.want)
+		}
+	}
+}
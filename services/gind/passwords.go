@@ -0,0 +1,247 @@
+package gind
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/GehirnInc/crypt"
+	"github.com/GehirnInc/crypt/common"
+	_ "github.com/GehirnInc/crypt/md5_crypt"    // MD5 used to verify legacy passwords
+	_ "github.com/GehirnInc/crypt/sha512_crypt" // SHA512 used to verify and hash passwords
+	"github.com/untangle/golang-shared/services/logger"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// password hash algorithms
+const (
+	PasswordMD5Crypt    = "md5-crypt"
+	PasswordSHA512Crypt = "sha512-crypt"
+	PasswordBcrypt      = "bcrypt"
+	PasswordArgon2id    = "argon2id"
+)
+
+// argon2idKeyLength is the length of the derived argon2id key in bytes
+const argon2idKeyLength = 32
+
+// argon2id parameter limits
+// argon2.IDKey panics if the time or threads are 0, and the maximums keep the settings, a stored hash or
+// a backup header from making each key derivation take unbounded CPU and memory
+const (
+	argon2MaxTime      = 16
+	argon2MaxMemoryKiB = 1024 * 1024
+	argon2MaxThreads   = 64
+)
+
+// argon2MinMemoryKiB returns the minimum memory argon2 accepts for the number of threads
+func argon2MinMemoryKiB(threads int64) int64 {
+	return 8 * threads
+}
+
+// passwordConfig holds the system.restd.passwords settings
+type passwordConfig struct {
+	algorithm     string
+	sha512Rounds  int
+	bcryptCost    int
+	argon2Time    uint32
+	argon2Memory  uint32
+	argon2Threads uint8
+}
+
+// getPasswordConfig reads the password hashing settings, applying defaults for anything not configured
+func getPasswordConfig() passwordConfig {
+	jsonObject := getRestdSettings("passwords")
+	config := passwordConfig{
+		algorithm:    settingString(jsonObject, "algorithm", PasswordBcrypt),
+		sha512Rounds: int(settingInt(jsonObject, "sha512Rounds", 5000)),
+		bcryptCost:   int(settingInt(jsonObject, "bcryptCost", int64(bcrypt.DefaultCost))),
+	}
+	threads := settingIntRange(jsonObject, "argon2Threads", 4, 1, argon2MaxThreads)
+	config.argon2Threads = uint8(threads)
+	config.argon2Time = uint32(settingIntRange(jsonObject, "argon2Time", 3, 1, argon2MaxTime))
+	config.argon2Memory = uint32(settingIntRange(jsonObject, "argon2MemoryKiB", 64*1024, argon2MinMemoryKiB(threads), argon2MaxMemoryKiB))
+
+	switch config.algorithm {
+	case PasswordSHA512Crypt, PasswordBcrypt, PasswordArgon2id:
+	default:
+		logger.Warn("Unsupported password algorithm %v, using %v\n", config.algorithm, PasswordBcrypt)
+		config.algorithm = PasswordBcrypt
+	}
+	return config
+}
+
+// getPasswordHash returns the password hash stored in the credentials
+// passwordHash holds a self-describing hash of any supported algorithm, while older
+// credentials only have passwordHashMD5
+func getPasswordHash(credentialsJSON map[string]interface{}) (string, bool) {
+	for _, field := range []string{"passwordHash", "passwordHashMD5"} {
+		hash, ok := credentialsJSON[field].(string)
+		if ok && hash != "" {
+			return hash, true
+		}
+	}
+	return "", false
+}
+
+// passwordHashAlgorithm returns the algorithm of the specified hash, or "" if it is not supported
+func passwordHashAlgorithm(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$1$"):
+		return PasswordMD5Crypt
+	case strings.HasPrefix(hash, "$6$"):
+		return PasswordSHA512Crypt
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return PasswordBcrypt
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return PasswordArgon2id
+	}
+	return ""
+}
+
+// verifyPassword returns true if the password matches the specified hash
+func verifyPassword(hash string, password string) bool {
+	switch passwordHashAlgorithm(hash) {
+	case PasswordMD5Crypt, PasswordSHA512Crypt:
+		return crypt.NewFromHash(hash).Verify(hash, []byte(password)) == nil
+	case PasswordBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case PasswordArgon2id:
+		params, salt, key, err := parseArgon2idHash(hash)
+		if err != nil {
+			logger.Warn("Invalid argon2id password hash: %v\n", err)
+			return false
+		}
+		derived := argon2.IDKey([]byte(password), salt, params.argon2Time, params.argon2Memory, params.argon2Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(derived, key) == 1
+	}
+	logger.Warn("Unsupported password hash format\n")
+	return false
+}
+
+// hashPassword hashes the password with the configured algorithm
+func hashPassword(password string, config passwordConfig) (string, error) {
+	switch config.algorithm {
+	case PasswordSHA512Crypt:
+		salt := common.Salt{
+			MagicPrefix:   []byte("$6$"),
+			SaltLenMin:    1,
+			SaltLenMax:    16,
+			RoundsMin:     1000,
+			RoundsMax:     999999999,
+			RoundsDefault: 5000,
+		}
+		return crypt.SHA512.New().Generate([]byte(password), salt.GenerateWRounds(16, config.sha512Rounds))
+	case PasswordBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), config.bcryptCost)
+		return string(hash), err
+	case PasswordArgon2id:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, config.argon2Time, config.argon2Memory, config.argon2Threads, argon2idKeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			config.argon2Memory, config.argon2Time, config.argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	return "", errors.New("Unsupported password algorithm: " + config.algorithm)
+}
+
+// parseArgon2idHash parses a hash in the PHC string format
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+func parseArgon2idHash(hash string) (passwordConfig, []byte, []byte, error) {
+	config := passwordConfig{algorithm: PasswordArgon2id}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return config, nil, nil, errors.New("wrong number of fields")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return config, nil, nil, err
+	}
+	if version != argon2.Version {
+		return config, nil, nil, fmt.Errorf("unsupported version %d", version)
+	}
+	var memory, time, threads int64
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return config, nil, nil, err
+	}
+	if err := checkArgon2Parameters(time, memory, threads); err != nil {
+		return config, nil, nil, err
+	}
+	config.argon2Time, config.argon2Memory, config.argon2Threads = uint32(time), uint32(memory), uint8(threads)
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return config, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return config, nil, nil, err
+	}
+	// an empty key would match the empty key derived from any password
+	if len(salt) < 8 || len(key) < 16 {
+		return config, nil, nil, errors.New("salt or key too short")
+	}
+	return config, salt, key, nil
+}
+
+// checkArgon2Parameters returns an error if the argon2id parameters are outside the supported limits
+func checkArgon2Parameters(time int64, memory int64, threads int64) error {
+	if time < 1 || time > argon2MaxTime || threads < 1 || threads > argon2MaxThreads ||
+		memory < argon2MinMemoryKiB(threads) || memory > argon2MaxMemoryKiB {
+		return fmt.Errorf("argon2id parameters t=%d, m=%d, p=%d out of range", time, memory, threads)
+	}
+	return nil
+}
+
+// passwordNeedsRehash returns true if the hash does not use the configured algorithm and parameters
+func passwordNeedsRehash(hash string, config passwordConfig) bool {
+	if passwordHashAlgorithm(hash) != config.algorithm {
+		return true
+	}
+
+	switch config.algorithm {
+	case PasswordSHA512Crypt:
+		rounds, err := crypt.SHA512.New().Cost(hash)
+		return err != nil || rounds != config.sha512Rounds
+	case PasswordBcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != config.bcryptCost
+	case PasswordArgon2id:
+		params, _, _, err := parseArgon2idHash(hash)
+		return err != nil || params.argon2Time != config.argon2Time ||
+			params.argon2Memory != config.argon2Memory || params.argon2Threads != config.argon2Threads
+	}
+	return false
+}
+
+// upgradePasswordHash rehashes the password of the specified user with the configured algorithm
+// if the stored hash uses a different algorithm or different parameters
+// it must only be called after the password has been verified
+func upgradePasswordHash(username string, password string, hash string) {
+	config := getPasswordConfig()
+	if !passwordNeedsRehash(hash, config) {
+		return
+	}
+
+	newHash, err := hashPassword(password, config)
+	if err != nil {
+		logger.Warn("Failed to rehash password of %v: %v\n", username, err)
+		return
+	}
+
+	err = updateCredentials(username, func(cred map[string]interface{}) {
+		cred["passwordHash"] = newHash
+		delete(cred, "passwordHashMD5")
+	})
+	if err != nil {
+		logger.Warn("Failed to save rehashed password of %v: %v\n", username, err)
+		return
+	}
+	logger.Info("Upgraded password hash of %v from %v to %v\n", username, passwordHashAlgorithm(hash), config.algorithm)
+}
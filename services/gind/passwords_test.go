@@ -0,0 +1,58 @@
+package gind
+
+import (
+	"testing"
+)
+
+func TestParseArgon2idHash(t *testing.T) {
+	const salt = "c2FsdHNhbHRzYWx0"
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr bool
+	}{
+		{name: "valid", hash: "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + key},
+		{name: "minimum memory of the threads", hash: "$argon2id$v=19$m=32,t=1,p=4$" + salt + "$" + key},
+		{name: "zero time", hash: "$argon2id$v=19$m=65536,t=0,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "zero threads", hash: "$argon2id$v=19$m=65536,t=3,p=0$" + salt + "$" + key, wantErr: true},
+		{name: "threads wrapping to zero", hash: "$argon2id$v=19$m=65536,t=3,p=256$" + salt + "$" + key, wantErr: true},
+		{name: "too many passes", hash: "$argon2id$v=19$m=65536,t=1000,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "too much memory", hash: "$argon2id$v=19$m=4294967295,t=3,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "too little memory for the threads", hash: "$argon2id$v=19$m=16,t=3,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "negative memory", hash: "$argon2id$v=19$m=-1,t=3,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "empty key", hash: "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$", wantErr: true},
+		{name: "unsupported version", hash: "$argon2id$v=16$m=65536,t=3,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "missing field", hash: "$argon2id$v=19$m=65536,t=3,p=4$" + salt, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, _, err := parseArgon2idHash(test.hash)
+			if (err != nil) != test.wantErr {
+				t.Errorf("parseArgon2idHash() error = %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr && verifyPassword(test.hash, "password") {
+				t.Errorf("verifyPassword() of an invalid hash succeeded")
+			}
+		})
+	}
+}
+
+func TestArgon2idPassword(t *testing.T) {
+	config := passwordConfig{algorithm: PasswordArgon2id, argon2Time: 1, argon2Memory: 64, argon2Threads: 1}
+	hash, err := hashPassword("secret", config)
+	if err != nil {
+		t.Fatalf("hashPassword() error = %v", err)
+	}
+	if !verifyPassword(hash, "secret") || verifyPassword(hash, "other") {
+		t.Errorf("verifyPassword() of %v does not match only the hashed password", hash)
+	}
+	if passwordNeedsRehash(hash, config) {
+		t.Errorf("passwordNeedsRehash() = true for the configured parameters")
+	}
+	config.argon2Time = 2
+	if !passwordNeedsRehash(hash, config) {
+		t.Errorf("passwordNeedsRehash() = false after the parameters changed")
+	}
+}
@@ -0,0 +1,178 @@
+package gind
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/untangle/golang-shared/services/logger"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// RADIUS authentication methods
+const (
+	radiusMethodPAP  = "pap"
+	radiusMethodCHAP = "chap"
+)
+
+// radiusMessageAuthenticator is the type of the Message-Authenticator attribute, RFC 3579 section 3.2
+const radiusMessageAuthenticator radius.Type = 80
+
+// radiusAuthenticator checks the username and password with an Access-Request to a RADIUS server
+// the role is taken from the Filter-Id attribute of the Access-Accept
+type radiusAuthenticator struct {
+	servers       []string
+	secret        []byte
+	method        string
+	timeout       time.Duration
+	nasIdentifier string
+	filterIDRoles map[string]interface{}
+	defaultRole   string
+}
+
+// newRADIUSAuthenticator creates a RADIUS authenticator from the system.restd.authentication.radius settings
+func newRADIUSAuthenticator(jsonObject map[string]interface{}) *radiusAuthenticator {
+	filterIDRoles, _ := jsonObject["filterIdRoles"].(map[string]interface{})
+	servers := settingStrings(jsonObject, "servers")
+	for i, server := range servers {
+		if !strings.Contains(server, ":") {
+			servers[i] = server + ":1812"
+		}
+	}
+	return &radiusAuthenticator{
+		servers:       servers,
+		secret:        []byte(settingString(jsonObject, "secret", "")),
+		method:        strings.ToLower(settingString(jsonObject, "method", radiusMethodPAP)),
+		timeout:       time.Duration(settingInt(jsonObject, "timeoutSeconds", 5)) * time.Second,
+		nasIdentifier: settingString(jsonObject, "nasIdentifier", "restd"),
+		filterIDRoles: filterIDRoles,
+		defaultRole:   settingString(jsonObject, "defaultRole", ""),
+	}
+}
+
+// Name returns the name of the authenticator
+func (a *radiusAuthenticator) Name() string {
+	return "radius"
+}
+
+// Authenticate sends an Access-Request to each server in turn until one of them answers
+func (a *radiusAuthenticator) Authenticate(username string, password string) (authResult, error) {
+	if len(a.servers) == 0 || len(a.secret) == 0 {
+		return authResult{}, errors.New("no RADIUS server or secret configured")
+	}
+	if username == "" || password == "" {
+		return authResult{}, nil
+	}
+
+	packet, err := a.accessRequest(username, password)
+	if err != nil {
+		return authResult{}, err
+	}
+
+	client := &radius.Client{Retry: time.Second, MaxPacketErrors: 10}
+	var response *radius.Packet
+	for _, server := range a.servers {
+		ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+		response, err = client.Exchange(ctx, packet, server)
+		cancel()
+		if err == nil {
+			break
+		}
+		logger.Warn("RADIUS server %v failed: %v\n", server, err)
+	}
+	if err != nil {
+		return authResult{}, fmt.Errorf("no RADIUS server answered: %v", err)
+	}
+
+	if response.Code != radius.CodeAccessAccept {
+		logger.Info("Failed RADIUS authentication: %v (%v)\n", username, response.Code)
+		return authResult{}, nil
+	}
+
+	filterIDs, _ := rfc2865.FilterID_GetStrings(response)
+	role := directoryRole(filterIDs, a.filterIDRoles, "")
+	if role == "" {
+		// a Filter-Id naming a role directly is used as is
+		for _, filterID := range filterIDs {
+			if _, ok := rolePermissions[filterID]; ok && roleRank[filterID] > roleRank[role] {
+				role = filterID
+			}
+		}
+	}
+	if role == "" {
+		role = a.defaultRole
+	}
+	if _, ok := rolePermissions[role]; !ok {
+		logger.Info("RADIUS user %v has no Filter-Id mapped to a role\n", username)
+		return authResult{}, nil
+	}
+	return authResult{valid: true, role: role}, nil
+}
+
+// accessRequest creates the Access-Request packet with the password encoded for the configured method
+func (a *radiusAuthenticator) accessRequest(username string, password string) (*radius.Packet, error) {
+	packet := radius.New(radius.CodeAccessRequest, a.secret)
+	if err := rfc2865.UserName_SetString(packet, username); err != nil {
+		return nil, err
+	}
+	if err := rfc2865.NASIdentifier_SetString(packet, a.nasIdentifier); err != nil {
+		return nil, err
+	}
+
+	switch a.method {
+	case radiusMethodPAP:
+		// the password is padded with nulls to a multiple of 16 bytes, RFC 2865 section 5.2
+		// the vendored layeh.com/radius does not pad it and fails on any other length
+		padded := make([]byte, (len(password)+15)/16*16)
+		copy(padded, password)
+		if err := rfc2865.UserPassword_Set(packet, padded); err != nil {
+			return nil, err
+		}
+	case radiusMethodCHAP:
+		// CHAP-Password is the identifier followed by MD5(identifier + password + challenge), RFC 2865 section 5.3
+		challenge := make([]byte, 17)
+		if _, err := rand.Read(challenge); err != nil {
+			return nil, err
+		}
+		ident := challenge[16]
+		challenge = challenge[:16]
+		hash := md5.New()
+		hash.Write([]byte{ident})
+		hash.Write([]byte(password))
+		hash.Write(challenge)
+		if err := rfc2865.CHAPPassword_Set(packet, append([]byte{ident}, hash.Sum(nil)...)); err != nil {
+			return nil, err
+		}
+		if err := rfc2865.CHAPChallenge_Set(packet, challenge); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Unsupported RADIUS method: " + a.method)
+	}
+
+	if err := setMessageAuthenticator(packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// setMessageAuthenticator adds the Message-Authenticator attribute to the Access-Request
+// it is the HMAC-MD5 of the packet with the attribute set to zeros, keyed with the secret
+// servers that require it reject requests without it, and it keeps the attributes from being changed in transit
+func setMessageAuthenticator(packet *radius.Packet) error {
+	packet.Set(radiusMessageAuthenticator, make(radius.Attribute, md5.Size))
+	wire, err := packet.Encode()
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(md5.New, packet.Secret)
+	mac.Write(wire)
+	packet.Set(radiusMessageAuthenticator, mac.Sum(nil))
+	return nil
+}
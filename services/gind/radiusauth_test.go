@@ -0,0 +1,303 @@
+package gind
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+const testRADIUSSecret = "testing123"
+
+// testRADIUSUsers are the passwords known to the test RADIUS server, and the Filter-Id it returns for each user
+var testRADIUSUsers = map[string]struct {
+	password string
+	filterID []string
+}{
+	"alice":   {"alice-password", []string{"ops-team"}},
+	"bob":     {"a password longer than sixteen bytes", []string{"unmapped", RoleReadOnly}},
+	"carol":   {"carol-password", nil},
+	"mallory": {"mallory-password", []string{"admins", "readers"}},
+}
+
+// startTestRADIUSServer runs a RADIUS server on a local UDP port that accepts the testRADIUSUsers with PAP or CHAP
+// requests without a valid Message-Authenticator are dropped, the same as servers enforcing RFC 3579
+// the method of each request it receives is sent to the returned channel, the caller closes the returned connection
+func startTestRADIUSServer(t *testing.T) (net.PacketConn, chan string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods := make(chan string, 10)
+
+	handler := func(w radius.ResponseWriter, r *radius.Request) {
+		if !validMessageAuthenticator(r.Packet) {
+			methods <- "invalid"
+			return
+		}
+
+		user, ok := testRADIUSUsers[rfc2865.UserName_GetString(r.Packet)]
+		valid := false
+		if chapPassword := rfc2865.CHAPPassword_Get(r.Packet); chapPassword != nil {
+			methods <- radiusMethodCHAP
+			hash := md5.New()
+			hash.Write(chapPassword[:1])
+			hash.Write([]byte(user.password))
+			hash.Write(rfc2865.CHAPChallenge_Get(r.Packet))
+			valid = ok && len(chapPassword) == 17 && bytes.Equal(hash.Sum(nil), chapPassword[1:])
+		} else {
+			methods <- radiusMethodPAP
+			valid = ok && rfc2865.UserPassword_GetString(r.Packet) == user.password
+		}
+
+		if !valid {
+			w.Write(r.Packet.Response(radius.CodeAccessReject))
+			return
+		}
+		response := r.Packet.Response(radius.CodeAccessAccept)
+		for _, filterID := range user.filterID {
+			rfc2865.FilterID_AddString(response, filterID)
+		}
+		w.Write(response)
+	}
+
+	server := &radius.PacketServer{
+		Handler:      radius.HandlerFunc(handler),
+		SecretSource: radius.StaticSecretSource([]byte(testRADIUSSecret)),
+	}
+	go server.Serve(conn)
+	return conn, methods
+}
+
+// receivedMethods returns the methods of the requests the test RADIUS server has received so far
+func receivedMethods(methods chan string) []string {
+	var received []string
+	for {
+		select {
+		case method := <-methods:
+			received = append(received, method)
+		default:
+			return received
+		}
+	}
+}
+
+// validMessageAuthenticator checks the Message-Authenticator of an Access-Request the way a server does
+func validMessageAuthenticator(packet *radius.Packet) bool {
+	received := packet.Get(radiusMessageAuthenticator)
+	if len(received) != md5.Size {
+		return false
+	}
+	packet.Set(radiusMessageAuthenticator, make(radius.Attribute, md5.Size))
+	wire, err := packet.Encode()
+	packet.Set(radiusMessageAuthenticator, received)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(md5.New, packet.Secret)
+	mac.Write(wire)
+	return hmac.Equal(mac.Sum(nil), received)
+}
+
+func TestRADIUSAuthenticate(t *testing.T) {
+	filterIDRoles := map[string]interface{}{
+		"ops-team": RoleOperator,
+		"admins":   RoleAdmin,
+		"readers":  RoleReadOnly,
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		username    string
+		password    string
+		defaultRole string
+		want        authResult
+	}{
+		{
+			name:     "pap with a Filter-Id mapped to a role",
+			method:   radiusMethodPAP,
+			username: "alice",
+			password: "alice-password",
+			want:     authResult{valid: true, role: RoleOperator},
+		},
+		{
+			name:     "pap password longer than one block",
+			method:   radiusMethodPAP,
+			username: "bob",
+			password: "a password longer than sixteen bytes",
+			want:     authResult{valid: true, role: RoleReadOnly},
+		},
+		{
+			name:     "pap wrong password is rejected",
+			method:   radiusMethodPAP,
+			username: "alice",
+			password: "alice-passwor",
+		},
+		{
+			name:     "pap unknown user is rejected",
+			method:   radiusMethodPAP,
+			username: "eve",
+			password: "alice-password",
+		},
+		{
+			name:     "chap with a Filter-Id mapped to a role",
+			method:   radiusMethodCHAP,
+			username: "alice",
+			password: "alice-password",
+			want:     authResult{valid: true, role: RoleOperator},
+		},
+		{
+			name:     "chap wrong password is rejected",
+			method:   radiusMethodCHAP,
+			username: "alice",
+			password: "wrong",
+		},
+		{
+			name:     "Filter-Id naming a role is used as is",
+			method:   radiusMethodCHAP,
+			username: "bob",
+			password: "a password longer than sixteen bytes",
+			want:     authResult{valid: true, role: RoleReadOnly},
+		},
+		{
+			name:     "the highest mapped role wins",
+			method:   radiusMethodPAP,
+			username: "mallory",
+			password: "mallory-password",
+			want:     authResult{valid: true, role: RoleAdmin},
+		},
+		{
+			name:     "accepted without a role is rejected",
+			method:   radiusMethodPAP,
+			username: "carol",
+			password: "carol-password",
+		},
+		{
+			name:        "accepted without a role gets the default role",
+			method:      radiusMethodPAP,
+			username:    "carol",
+			password:    "carol-password",
+			defaultRole: RoleReadOnly,
+			want:        authResult{valid: true, role: RoleReadOnly},
+		},
+		{
+			name:     "empty password is rejected without a request",
+			method:   radiusMethodPAP,
+			username: "alice",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, methods := startTestRADIUSServer(t)
+			defer conn.Close()
+			authenticator := &radiusAuthenticator{
+				servers:       []string{conn.LocalAddr().String()},
+				secret:        []byte(testRADIUSSecret),
+				method:        test.method,
+				timeout:       2 * time.Second,
+				nasIdentifier: "restd",
+				filterIDRoles: filterIDRoles,
+				defaultRole:   test.defaultRole,
+			}
+
+			got, err := authenticator.Authenticate(test.username, test.password)
+			if err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("Authenticate() = %+v, want %+v", got, test.want)
+			}
+
+			var wantMethods []string
+			if test.password != "" {
+				wantMethods = []string{test.method}
+			}
+			if received := receivedMethods(methods); !reflect.DeepEqual(received, wantMethods) {
+				t.Errorf("server received %v, want %v", received, wantMethods)
+			}
+		})
+	}
+}
+
+func TestRADIUSAuthenticateServers(t *testing.T) {
+	conn, methods := startTestRADIUSServer(t)
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+
+	// nothing listens on a closed port, the next server is tried
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := closed.LocalAddr().String()
+	closed.Close()
+
+	authenticator := &radiusAuthenticator{
+		servers: []string{unreachable, addr},
+		secret:  []byte(testRADIUSSecret),
+		method:  radiusMethodPAP,
+		timeout: 500 * time.Millisecond,
+	}
+	got, err := authenticator.Authenticate("bob", "a password longer than sixteen bytes")
+	if err != nil || got != (authResult{valid: true, role: RoleReadOnly}) {
+		t.Errorf("Authenticate() = %+v, %v, want the second server to accept", got, err)
+	}
+
+	authenticator.servers = []string{unreachable}
+	if _, err := authenticator.Authenticate("bob", "a password longer than sixteen bytes"); err == nil {
+		t.Error("Authenticate() without a server answering did not fail")
+	}
+
+	// a server with another secret cannot decode the password and drops the request
+	authenticator.servers = []string{addr}
+	authenticator.secret = []byte("another secret")
+	receivedMethods(methods)
+	if _, err := authenticator.Authenticate("bob", "a password longer than sixteen bytes"); err == nil {
+		t.Error("Authenticate() with the wrong secret did not fail")
+	}
+	if received := receivedMethods(methods); len(received) == 0 || received[0] != "invalid" {
+		t.Errorf("server received %v, want an invalid Message-Authenticator", received)
+	}
+
+	authenticator.secret = nil
+	if _, err := authenticator.Authenticate("bob", "a password longer than sixteen bytes"); err == nil {
+		t.Error("Authenticate() without a secret did not fail")
+	}
+}
+
+func TestRADIUSAccessRequest(t *testing.T) {
+	authenticator := &radiusAuthenticator{secret: []byte(testRADIUSSecret), method: radiusMethodPAP, nasIdentifier: "restd"}
+	for _, password := range []string{"x", "exactly16bytes!!", "seventeen bytes!!"} {
+		packet, err := authenticator.accessRequest("alice", password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wire, err := packet.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := radius.Parse(wire, []byte(testRADIUSSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rfc2865.UserPassword_GetString(parsed); got != password {
+			t.Errorf("User-Password = %q, want %q", got, password)
+		}
+		if !validMessageAuthenticator(parsed) {
+			t.Errorf("Message-Authenticator of %q is invalid", password)
+		}
+	}
+
+	authenticator.method = "mschap"
+	if _, err := authenticator.accessRequest("alice", "x"); err == nil {
+		t.Error("accessRequest() with an unsupported method did not fail")
+	}
+}
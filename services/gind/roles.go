@@ -0,0 +1,260 @@
+package gind
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// Permission is a capability that a role must have to access an /api route
+type Permission string
+
+const (
+	// PermStatusRead allows reading the status, reports and other read only endpoints
+	PermStatusRead Permission = "status:read"
+	// PermSettingsRead allows reading the settings and defaults
+	PermSettingsRead Permission = "settings:read"
+	// PermSettingsWrite allows changing the settings
+	PermSettingsWrite Permission = "settings:write"
+	// PermNetworkControl allows operational network actions such as renewing DHCP leases
+	PermNetworkControl Permission = "network:control"
+	// PermSystemAdmin allows system level actions such as reboot, upgrade and factory reset
+	PermSystemAdmin Permission = "system:admin"
+	// PermAccountSelf allows managing the API keys and other account data of the current user
+	PermAccountSelf Permission = "account:self"
+	// PermAccountsAdmin allows managing the accounts and API keys of all users
+	PermAccountsAdmin Permission = "accounts:admin"
+)
+
+const (
+	// RoleAdmin has every permission
+	RoleAdmin = "admin"
+	// RoleOperator can view everything, change settings and perform network actions
+	RoleOperator = "operator"
+	// RoleReadOnly can only view status and settings
+	RoleReadOnly = "read-only"
+)
+
+// rolePermissions maps each role to the permissions it grants
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:    {PermStatusRead, PermSettingsRead, PermSettingsWrite, PermNetworkControl, PermSystemAdmin, PermAccountSelf, PermAccountsAdmin},
+	RoleOperator: {PermStatusRead, PermSettingsRead, PermSettingsWrite, PermNetworkControl, PermAccountSelf},
+	RoleReadOnly: {PermStatusRead, PermSettingsRead, PermAccountSelf},
+}
+
+// routePermission holds the permissions required to read (GET/HEAD) and to modify (any other method) a route
+type routePermission struct {
+	read  Permission
+	write Permission
+}
+
+// routePermissions maps the full path of each /api route to its required permissions
+// routes missing from this table require PermSystemAdmin
+var routePermissions = map[string]routePermission{
+	"/api/status/uid":                    {PermStatusRead, PermSystemAdmin},
+	"/api/status/commandcenter":          {PermStatusRead, PermSystemAdmin},
+	"/api/status/sessions":               {PermStatusRead, PermSystemAdmin},
+	"/api/status/system":                 {PermStatusRead, PermSystemAdmin},
+	"/api/status/hardware":               {PermStatusRead, PermSystemAdmin},
+	"/api/status/upgrade":                {PermStatusRead, PermSystemAdmin},
+	"/api/status/build":                  {PermStatusRead, PermSystemAdmin},
+	"/api/status/license":                {PermStatusRead, PermSystemAdmin},
+	"/api/status/wantest/:device":        {PermNetworkControl, PermSystemAdmin},
+	"/api/status/command/find_account":   {PermStatusRead, PermSystemAdmin},
+	"/api/status/interfaces/:device":     {PermStatusRead, PermSystemAdmin},
+	"/api/status/arp/":                   {PermStatusRead, PermSystemAdmin},
+	"/api/status/arp/:device":            {PermStatusRead, PermSystemAdmin},
+	"/api/status/dhcp":                   {PermStatusRead, PermSystemAdmin},
+	"/api/status/route":                  {PermStatusRead, PermSystemAdmin},
+	"/api/status/routetables":            {PermStatusRead, PermSystemAdmin},
+	"/api/status/route/:table":           {PermStatusRead, PermSystemAdmin},
+	"/api/status/rules":                  {PermStatusRead, PermSystemAdmin},
+	"/api/status/routerules":             {PermStatusRead, PermSystemAdmin},
+	"/api/status/wwan/:device":           {PermStatusRead, PermSystemAdmin},
+	"/api/status/wifichannels/:device":   {PermStatusRead, PermSystemAdmin},
+	"/api/status/wifimodelist/:device":   {PermStatusRead, PermSystemAdmin},
+	"/api/status/diagnostics":            {PermStatusRead, PermSystemAdmin},
+	"/api/threatprevention/lookup/:host": {PermStatusRead, PermSystemAdmin},
+	"/api/settings":                      {PermSettingsRead, PermSettingsWrite},
+	"/api/settings/*path":                {PermSettingsRead, PermSettingsWrite},
+	"/api/settings-schema":               {PermSettingsRead, PermSettingsWrite},
+	"/api/settings-history":              {PermSettingsRead, PermSettingsWrite},
+	"/api/settings-history/:id":          {PermSettingsRead, PermSettingsWrite},
+	"/api/settings-history/:id/diff":     {PermSettingsRead, PermSettingsWrite},
+	"/api/settings-history/:id/rollback": {PermSettingsWrite, PermSettingsWrite},
+	"/api/defaults":                      {PermSettingsRead, PermSettingsWrite},
+	"/api/defaults/*path":                {PermSettingsRead, PermSettingsWrite},
+	"/api/backup":                        {PermSystemAdmin, PermSystemAdmin},
+	"/api/backup/schedule":               {PermSystemAdmin, PermSystemAdmin},
+	"/api/backup/schedule/run":           {PermSystemAdmin, PermSystemAdmin},
+	"/api/restore":                       {PermSystemAdmin, PermSystemAdmin},
+	"/api/reports/*path":                 {PermStatusRead, PermStatusRead},
+	"/api/warehouse/*path":               {PermSystemAdmin, PermSystemAdmin},
+	"/api/netspace/*path":                {PermStatusRead, PermSettingsWrite},
+	"/api/license/*path":                 {PermStatusRead, PermSystemAdmin},
+	"/api/logging/*path":                 {PermStatusRead, PermSystemAdmin},
+	"/api/wireguard/*path":               {PermStatusRead, PermSettingsWrite},
+	"/api/classify/*path":                {PermStatusRead, PermSystemAdmin},
+	"/api/logger/*path":                  {PermStatusRead, PermSystemAdmin},
+	"/api/debug":                         {PermSystemAdmin, PermSystemAdmin},
+	"/api/gc":                            {PermSystemAdmin, PermSystemAdmin},
+	"/api/fetch-licenses":                {PermSystemAdmin, PermSystemAdmin},
+	"/api/factory-reset":                 {PermSystemAdmin, PermSystemAdmin},
+	"/api/sysupgrade":                    {PermSystemAdmin, PermSystemAdmin},
+	"/api/upgrade":                       {PermSystemAdmin, PermSystemAdmin},
+	"/api/reboot":                        {PermSystemAdmin, PermSystemAdmin},
+	"/api/shutdown":                      {PermSystemAdmin, PermSystemAdmin},
+	"/api/releasedhcp/:device":           {PermNetworkControl, PermNetworkControl},
+	"/api/renewdhcp/:device":             {PermNetworkControl, PermNetworkControl},
+	"/api/account/keys":                  {PermAccountSelf, PermAccountSelf},
+	"/api/account/keys/:id":              {PermAccountSelf, PermAccountSelf},
+	"/api/account/sessions":              {PermAccountSelf, PermAccountSelf},
+	"/api/account/sessions/:id":          {PermAccountSelf, PermAccountSelf},
+	"/api/account/lockouts":              {PermAccountsAdmin, PermAccountsAdmin},
+	"/api/account/totp":                  {PermAccountSelf, PermAccountSelf},
+	"/api/account/totp/verify":           {PermAccountSelf, PermAccountSelf},
+	"/api/account/password":              {PermAccountSelf, PermAccountSelf},
+	"/api/accounts":                      {PermAccountsAdmin, PermAccountsAdmin},
+	"/api/accounts/:username":            {PermAccountsAdmin, PermAccountsAdmin},
+	"/api/audit":                         {PermSystemAdmin, PermSystemAdmin},
+}
+
+// authUsernameKey and authKeyRoleKey are the gin context keys holding the identity of requests
+// authenticated without a session, such as those using an API key
+const authUsernameKey = "authUsername"
+const authKeyRoleKey = "authKeyRole"
+
+// authDirectoryRoleKey is the gin context key holding the role granted by a directory during login,
+// or by the role claim of a JWT
+const authDirectoryRoleKey = "authDirectoryRole"
+
+// builtinUsers are the session usernames created by restd itself rather than from accounts.credentials
+// they are always granted the admin role
+var builtinUsers = map[string]bool{
+	"root":           true,
+	"command-center": true,
+	"setup":          true,
+}
+
+// permissionRequired is a middleware handler function that must follow authRequired
+// it looks up the permission required by the matched route and aborts with a 403 if the
+// role of the authenticated user does not grant it
+func permissionRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		required := requiredPermission(c.Request.Method, c.FullPath())
+
+		// accounts that must use two-factor authentication may only enroll until they have
+		if totpEnrollmentPending(c) && !strings.HasPrefix(c.FullPath(), "/api/account/totp") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied: two-factor enrollment required", "twoFactorEnrollRequired": true})
+			c.Abort()
+			return
+		}
+
+		if !requestHasPermission(c, required) {
+			logger.Info("Permission %v denied for user %v: %v %v\n", required, getAuthUsername(c), c.Request.Method, c.Request.URL.Path)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied: missing permission " + string(required), "permission": required})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// requiredPermission returns the permission needed for the specified method on the route with the specified full path
+func requiredPermission(method string, fullPath string) Permission {
+	perm, ok := routePermissions[fullPath]
+	if !ok {
+		return PermSystemAdmin
+	}
+
+	if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions {
+		return perm.read
+	}
+	return perm.write
+}
+
+// roleHasPermission returns true if the specified role grants the specified permission
+func roleHasPermission(role string, permission Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHasPermission returns true if the authenticated user of the request has the specified permission
+// requests authenticated with a scoped API key are limited to what both the key and its owner are granted
+func requestHasPermission(c *gin.Context, permission Permission) bool {
+	if !roleHasPermission(getRequestRole(c), permission) {
+		return false
+	}
+	if keyRole, ok := c.Get(authKeyRoleKey); ok {
+		role, _ := keyRole.(string)
+		return roleHasPermission(role, permission)
+	}
+	return true
+}
+
+// getAuthUsername returns the username of the authenticated request, or "" if there is none
+func getAuthUsername(c *gin.Context) string {
+	if value, ok := c.Get(authUsernameKey); ok {
+		username, _ := value.(string)
+		return username
+	}
+
+	session := sessions.Default(c)
+	username, _ := session.Get("username").(string)
+	return username
+}
+
+// getRequestRole returns the role of the user of the request
+// directory users have no local credentials, the role granted by the directory is kept in their session
+// or, for requests authenticated without a session, in the request context
+func getRequestRole(c *gin.Context) string {
+	if value, ok := c.Get(authDirectoryRoleKey); ok {
+		if role, _ := value.(string); role != "" {
+			return role
+		}
+	}
+	if _, ok := c.Get(authUsernameKey); !ok {
+		session := sessions.Default(c)
+		if role, ok := session.Get("directoryRole").(string); ok && role != "" {
+			return role
+		}
+	}
+	return getUserRole(getAuthUsername(c))
+}
+
+// getUserRole returns the role of the specified user
+// accounts without a role predate role support and are treated as admin
+// returns "" if the user is unknown or the configured role is invalid
+func getUserRole(username string) string {
+	if username == "" {
+		return ""
+	}
+
+	credentialsJSON := getCredentials(username)
+	if credentialsJSON == nil {
+		if builtinUsers[username] {
+			return RoleAdmin
+		}
+		return ""
+	}
+
+	role, ok := credentialsJSON["role"].(string)
+	if !ok || role == "" {
+		return RoleAdmin
+	}
+
+	role = strings.ToLower(role)
+	if _, ok := rolePermissions[role]; !ok {
+		logger.Warn("Invalid role for user %v: %v\n", username, role)
+		return ""
+	}
+	return role
+}
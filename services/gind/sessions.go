@@ -30,7 +30,7 @@ func getSessions() ([]map[string]interface{}, error) {
 		return nil, err
 	}
 
-	logger.Debug("received reply: ", reply)
+	logger.Debug("received reply: %v\n", reply)
 
 	sessions, err := messenger.RetrievePacketdReplyItem(reply, messenger.GetSessions)
 	if err != nil {
@@ -0,0 +1,450 @@
+package gind
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// sessionDir is where the server side sessions are stored
+// sessions survive a restd restart but not a reboot
+const sessionDir = "/tmp/restd-sessions"
+
+// sessionKeyFile stores the key used to sign the session cookie so it survives a restart
+const sessionKeyFile = restdConfigDir + "/session.key"
+
+// sessionMaxAge is the lifetime of a session in seconds
+const sessionMaxAge = 86400
+
+// sessionTouchInterval is how often the last seen time of a session is written to disk
+const sessionTouchInterval = 1 * time.Minute
+
+// sessionCleanupInterval is how often expired sessions are removed
+const sessionCleanupInterval = 10 * time.Minute
+
+// sessionRecord is a session as stored on disk
+type sessionRecord struct {
+	ID        string `json:"-"`
+	Username  string `json:"username"`
+	SourceIP  string `json:"sourceIP"`
+	UserAgent string `json:"userAgent"`
+	Created   int64  `json:"created"`
+	LastSeen  int64  `json:"lastSeen"`
+	Expires   int64  `json:"expires"`
+	Values    []byte `json:"values"`
+}
+
+// serverSessionStore is a gin sessions store that keeps the session data on disk
+// and only the signed session ID in the cookie
+// it is modeled on the gorilla FilesystemStore, with metadata kept alongside the
+// values so that sessions can be listed and revoked
+type serverSessionStore struct {
+	codecs  []securecookie.Codec
+	options *gsessions.Options
+	dir     string
+	mutex   sync.RWMutex
+}
+
+var sessionStore *serverSessionStore
+
+// newServerSessionStore creates a store in the specified directory, signed with the specified key
+func newServerSessionStore(dir string, key []byte) *serverSessionStore {
+	store := &serverSessionStore{
+		codecs:  securecookie.CodecsFromPairs(key),
+		options: &gsessions.Options{Path: "/", MaxAge: sessionMaxAge, HttpOnly: true, SameSite: http.SameSiteLaxMode},
+		dir:     dir,
+	}
+	for _, codec := range store.codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(sessionMaxAge)
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.Warn("Failed to create %v: %v\n", dir, err)
+	}
+	return store
+}
+
+// getSessionKey returns the session signing key, creating it if it does not exist yet
+func getSessionKey() []byte {
+	key, err := ioutil.ReadFile(sessionKeyFile)
+	if err == nil && len(key) == 64 {
+		return key
+	}
+
+	key = securecookie.GenerateRandomKey(64)
+	if key == nil {
+		logger.Warn("Failed to generate session key\n")
+		return []byte(GenerateRandomString(64))
+	}
+	if err := os.MkdirAll(restdConfigDir, 0700); err != nil {
+		logger.Warn("Failed to create %v: %v\n", restdConfigDir, err)
+		return key
+	}
+	if err := ioutil.WriteFile(sessionKeyFile, key, 0600); err != nil {
+		logger.Warn("Failed to write %v: %v\n", sessionKeyFile, err)
+	}
+	return key
+}
+
+// Options sets the default options of new sessions
+func (s *serverSessionStore) Options(options sessions.Options) {
+	s.options = options.ToGorillaOptions()
+}
+
+// Get returns a session for the given name after adding it to the registry
+func (s *serverSessionStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session referenced by the request cookie, or a new session if there is none
+func (s *serverSessionStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(s, name)
+	opts := *s.options
+	opts.Secure = r.TLS != nil
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.codecs...); err != nil {
+		return session, err
+	}
+
+	record, err := s.load(id)
+	if err != nil || time.Now().Unix() > record.Expires {
+		// unknown, expired or revoked session
+		return session, nil
+	}
+
+	values := make(map[interface{}]interface{})
+	if err := gob.NewDecoder(bytes.NewReader(record.Values)).Decode(&values); err != nil {
+		logger.Warn("Failed to decode session %v: %v\n", sessionHandle(id), err)
+		return session, nil
+	}
+
+	session.ID = id
+	session.Values = values
+	session.IsNew = false
+
+	if time.Since(time.Unix(record.LastSeen, 0)) > sessionTouchInterval {
+		record.LastSeen = time.Now().Unix()
+		if err := s.update(record); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Failed to update session %v: %v\n", sessionHandle(id), err)
+		}
+	}
+	return session, nil
+}
+
+// Save writes the session to disk and sets the cookie
+// if the session MaxAge is <= 0 the session is removed from disk and the cookie is deleted
+// a session that was revoked while the request was handled is not written back, its cookie is deleted
+func (s *serverSessionStore) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			s.erase(session.ID)
+		}
+		http.SetCookie(w, gsessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now().Unix()
+	record := &sessionRecord{Created: now}
+	existing := false
+	if session.ID == "" {
+		// the ID is used as the filename so only use alphanumeric characters
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	} else if stored, err := s.load(session.ID); err == nil {
+		record = stored
+		existing = !session.IsNew
+	} else if !session.IsNew {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		return s.dropRevoked(w, session)
+	}
+
+	var values bytes.Buffer
+	if err := gob.NewEncoder(&values).Encode(session.Values); err != nil {
+		return err
+	}
+
+	record.ID = session.ID
+	record.Username, _ = session.Values["username"].(string)
+	record.SourceIP = requestSourceIP(r)
+	record.UserAgent = r.UserAgent()
+	record.LastSeen = now
+	record.Expires = now + int64(session.Options.MaxAge)
+	record.Values = values.Bytes()
+	write := s.write
+	if existing {
+		write = s.update
+	}
+	if err := write(record); err != nil {
+		if existing && os.IsNotExist(err) {
+			return s.dropRevoked(w, session)
+		}
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// filename returns the path of the file storing the session with the specified ID
+func (s *serverSessionStore) filename(id string) string {
+	return filepath.Join(s.dir, "session_"+id)
+}
+
+// load reads the session with the specified ID from disk
+func (s *serverSessionStore) load(id string) (*sessionRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	data, err := ioutil.ReadFile(s.filename(id))
+	if err != nil {
+		return nil, err
+	}
+	record := &sessionRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	record.ID = id
+	return record, nil
+}
+
+// write stores the session record on disk
+func (s *serverSessionStore) write(record *sessionRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return ioutil.WriteFile(s.filename(record.ID), data, 0600)
+}
+
+// update stores the record of a session that is already on disk
+// the file is not created, so a session erased since it was loaded stays removed
+// returns an error satisfying os.IsNotExist if the session is no longer stored
+func (s *serverSessionStore) update(record *sessionRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	file, err := os.OpenFile(s.filename(record.ID), os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// dropRevoked deletes the cookie of a session that was revoked while its request was handled
+func (s *serverSessionStore) dropRevoked(w http.ResponseWriter, session *gsessions.Session) error {
+	logger.Info("Not saving revoked session %v\n", sessionHandle(session.ID))
+	options := *session.Options
+	options.MaxAge = -1
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), "", &options))
+	return nil
+}
+
+// erase removes the session with the specified ID from disk
+func (s *serverSessionStore) erase(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Remove(s.filename(id)); err != nil && !os.IsNotExist(err) {
+		logger.Warn("Failed to remove session %v: %v\n", sessionHandle(id), err)
+	}
+}
+
+// list returns every unexpired session, removing the expired ones
+func (s *serverSessionStore) list() []*sessionRecord {
+	records := []*sessionRecord{}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		logger.Warn("Failed to read %v: %v\n", s.dir, err)
+		return records
+	}
+
+	now := time.Now().Unix()
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), "session_") {
+			continue
+		}
+		id := strings.TrimPrefix(file.Name(), "session_")
+		record, err := s.load(id)
+		if err != nil {
+			logger.Warn("Failed to read session %v: %v\n", sessionHandle(id), err)
+			continue
+		}
+		if now > record.Expires {
+			s.erase(id)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Created < records[j].Created })
+	return records
+}
+
+// purgeLegacy removes sessions created by older versions that stored the user's password
+func (s *serverSessionStore) purgeLegacy() {
+	for _, record := range s.list() {
+		values := make(map[interface{}]interface{})
+		if err := gob.NewDecoder(bytes.NewReader(record.Values)).Decode(&values); err != nil {
+			continue
+		}
+		if _, ok := values["password"]; ok {
+			logger.Info("Removing legacy session %v of %v\n", sessionHandle(record.ID), record.Username)
+			s.erase(record.ID)
+		}
+	}
+}
+
+// revokeUser removes every session of the specified user except the one with the specified ID
+func (s *serverSessionStore) revokeUser(username string, except string) {
+	for _, record := range s.list() {
+		if record.Username == username && record.ID != except {
+			logger.Info("Revoking session %v of %v\n", sessionHandle(record.ID), username)
+			s.erase(record.ID)
+		}
+	}
+}
+
+// startSessionCleanup removes expired sessions and login failures periodically until the service is shut down
+func startSessionCleanup() {
+	go func() {
+		ticker := time.NewTicker(sessionCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-serviceShutdown:
+				return
+			case <-ticker.C:
+				sessionStore.list()
+				expireLoginFailures()
+			}
+		}
+	}()
+}
+
+// sessionHandle returns the public identifier of a session
+// the session ID itself is never exposed through the API
+func sessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// requestSourceIP returns the IP address of the client
+func requestSourceIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// currentSessionID returns the ID of the session of the current request, or "" if there is none
+func currentSessionID(c *gin.Context) string {
+	session, err := sessionStore.Get(c.Request, authSessionName)
+	if err != nil || session.IsNew {
+		return ""
+	}
+	return session.ID
+}
+
+// renewSessionID gives the session of the current request a new ID when it is saved and removes the
+// session stored under the old ID, so an ID planted before a login can not be used to take it over
+func renewSessionID(c *gin.Context) {
+	session, err := sessionStore.Get(c.Request, authSessionName)
+	if err != nil || session.ID == "" {
+		return
+	}
+	sessionStore.erase(session.ID)
+	session.ID = ""
+}
+
+// accountSessionsList is the GET /api/account/sessions handler
+// it returns the sessions of the current user, or every session for users with PermAccountsAdmin
+func accountSessionsList(c *gin.Context) {
+	username := getAuthUsername(c)
+	all := requestHasPermission(c, PermAccountsAdmin)
+	current := currentSessionID(c)
+
+	result := []map[string]interface{}{}
+	for _, record := range sessionStore.list() {
+		if !all && record.Username != username {
+			continue
+		}
+		result = append(result, map[string]interface{}{
+			"id":        sessionHandle(record.ID),
+			"username":  record.Username,
+			"sourceIP":  record.SourceIP,
+			"userAgent": record.UserAgent,
+			"created":   record.Created,
+			"lastSeen":  record.LastSeen,
+			"expires":   record.Expires,
+			"current":   record.ID == current,
+		})
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// accountSessionsRevoke is the DELETE /api/account/sessions/:id handler
+// users may revoke their own sessions, users with PermAccountsAdmin may revoke any session
+func accountSessionsRevoke(c *gin.Context) {
+	handle := c.Param("id")
+	username := getAuthUsername(c)
+	all := requestHasPermission(c, PermAccountsAdmin)
+
+	for _, record := range sessionStore.list() {
+		if sessionHandle(record.ID) != handle || (!all && record.Username != username) {
+			continue
+		}
+
+		sessionStore.erase(record.ID)
+		logger.Info("Revoked session %v of %v by %v\n", handle, record.Username, username)
+		c.JSON(http.StatusOK, gin.H{"message": "Successfully revoked session"})
+		return
+	}
+
+	c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+}
@@ -0,0 +1,125 @@
+package gind
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// saveTestSession logs alice in on the store and returns the session cookie
+func saveTestSession(t *testing.T, store *serverSessionStore) *http.Cookie {
+	r := httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+	w := httptest.NewRecorder()
+	session, err := store.New(r, authSessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["username"] = "alice"
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("login set %v cookies, want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+func TestSessionStoreSaveRevoked(t *testing.T) {
+	tests := []struct {
+		name       string
+		revoke     bool
+		wantStored bool
+	}{
+		{"session still stored is saved", false, true},
+		{"session revoked during the request is not written back", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sessions")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			store := newServerSessionStore(dir, []byte("0123456789abcdef0123456789abcdef"))
+			cookie := saveTestSession(t, store)
+
+			r := httptest.NewRequest(http.MethodGet, "/api/settings", nil)
+			r.AddCookie(cookie)
+			session, err := store.New(r, authSessionName)
+			if err != nil || session.IsNew {
+				t.Fatalf("New() = %v, %v, want the stored session", session.IsNew, err)
+			}
+
+			// the session is revoked while the request is being handled, which then changes it
+			if test.revoke {
+				store.revokeUser("alice", "")
+			}
+			session.Values["directoryRole"] = RoleReadOnly
+			w := httptest.NewRecorder()
+			if err := store.Save(r, w, session); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+
+			record, err := store.load(session.ID)
+			if test.wantStored {
+				if err != nil {
+					t.Fatalf("load() error = %v", err)
+				}
+				if record.Username != "alice" {
+					t.Errorf("stored username = %q, want alice", record.Username)
+				}
+			} else if !os.IsNotExist(err) {
+				t.Errorf("load() error = %v, want the session to stay removed", err)
+			}
+
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("Save() set %v cookies, want 1", len(cookies))
+			}
+			if deleted := cookies[0].MaxAge < 0; deleted == test.wantStored {
+				t.Errorf("Save() cookie MaxAge = %v, want deleted %v", cookies[0].MaxAge, !test.wantStored)
+			}
+
+			// a request after the revocation gets a new session
+			r = httptest.NewRequest(http.MethodGet, "/api/settings", nil)
+			r.AddCookie(cookie)
+			session, err = store.New(r, authSessionName)
+			if err != nil || session.IsNew == test.wantStored {
+				t.Errorf("New() after Save() IsNew = %v, %v, want %v", session.IsNew, err, !test.wantStored)
+			}
+		})
+	}
+}
+
+func TestSessionStoreUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := newServerSessionStore(dir, []byte("0123456789abcdef0123456789abcdef"))
+
+	record := &sessionRecord{ID: "ABCDEF", Username: "alice", Expires: 1}
+	if err := store.update(record); !os.IsNotExist(err) {
+		t.Errorf("update() of a session not stored error = %v, want not exist", err)
+	}
+	if _, err := store.load(record.ID); !os.IsNotExist(err) {
+		t.Errorf("update() created the session, load() error = %v", err)
+	}
+
+	if err := store.write(record); err != nil {
+		t.Fatal(err)
+	}
+	record.Username = "bob"
+	if err := store.update(record); err != nil {
+		t.Fatalf("update() error = %v", err)
+	}
+	stored, err := store.load(record.ID)
+	if err != nil || stored.Username != "bob" {
+		t.Errorf("load() after update() = %+v, %v, want username bob", stored, err)
+	}
+}
@@ -0,0 +1,177 @@
+package gind
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/settings"
+)
+
+// protectedSetting is a settings subtree that only users with the permission may change through the settings API
+type protectedSetting struct {
+	path       []string
+	permission Permission
+}
+
+// protectedSettings are the settings that control who can log in and with which role
+// settings:write is not enough to change them, or an operator could grant themselves the admin role
+var protectedSettings = []protectedSetting{
+	{[]string{"accounts"}, PermAccountsAdmin},
+	{[]string{"system", "restd"}, PermSystemAdmin},
+}
+
+// settingsSecretKeys are the keys of the protected settings holding credentials, in addition to the
+// keys starting with "password"
+// they are never returned by the settings API
+var settingsSecretKeys = map[string]bool{
+	"totpSecret":        true,
+	"totpRecoveryCodes": true,
+	"hash":              true,
+	"secret":            true,
+	"bindPassword":      true,
+	"clientSecret":      true,
+	"passphrase":        true,
+}
+
+// protectedSettingsPath returns true if the path is in one of the protected settings
+func protectedSettingsPath(segments []string) bool {
+	for _, protected := range protectedSettings {
+		if len(segments) >= len(protected.path) && reflect.DeepEqual(segments[:len(protected.path)], protected.path) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretSettingsPath returns true if the path is a secret of the protected settings
+func secretSettingsPath(segments []string) bool {
+	if len(segments) == 0 || !protectedSettingsPath(segments) {
+		return false
+	}
+	key := segments[len(segments)-1]
+	return strings.HasPrefix(key, "password") || settingsSecretKeys[key]
+}
+
+// appendSegment returns the path of a child, without sharing the array of the parent path
+func appendSegment(segments []string, segment string) []string {
+	return append(segments[:len(segments):len(segments)], segment)
+}
+
+// redactSettings returns a copy of the settings value at the path without the secrets of the protected settings
+func redactSettings(segments []string, value interface{}) interface{} {
+	if secretSettingsPath(segments) {
+		return nil
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			childSegments := appendSegment(segments, key)
+			if !secretSettingsPath(childSegments) {
+				result[key] = redactSettings(childSegments, child)
+			}
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, child := range v {
+			result[i] = redactSettings(appendSegment(segments, strconv.Itoa(i)), child)
+		}
+		return result
+	}
+	return value
+}
+
+// restoreSettingsSecrets adds the secrets of the current value at the path that are missing from the new value,
+// so settings read from the API without their secrets can be written back without losing them
+// a secret is only replaced or cleared if the new value sets it explicitly
+// array elements are matched by their id or username, or by their index if they have neither
+func restoreSettingsSecrets(segments []string, current interface{}, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		currentObject, ok := current.(map[string]interface{})
+		if !ok {
+			return value
+		}
+		for key, child := range currentObject {
+			childSegments := appendSegment(segments, key)
+			if newChild, ok := v[key]; ok {
+				v[key] = restoreSettingsSecrets(childSegments, child, newChild)
+			} else if secretSettingsPath(childSegments) {
+				v[key] = child
+			}
+		}
+	case []interface{}:
+		currentArray, ok := current.([]interface{})
+		if !ok {
+			return value
+		}
+		for i, child := range v {
+			if match := matchingSettingsElement(currentArray, child, i); match != nil {
+				v[i] = restoreSettingsSecrets(appendSegment(segments, strconv.Itoa(i)), match, child)
+			}
+		}
+	}
+	return value
+}
+
+// matchingSettingsElement returns the element of the current array that the element at the index of the new array replaces
+func matchingSettingsElement(current []interface{}, element interface{}, index int) interface{} {
+	object, ok := element.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for _, key := range []string{"id", "username"} {
+		id, ok := object[key]
+		if !ok {
+			continue
+		}
+		for _, candidate := range current {
+			if candidateObject, ok := candidate.(map[string]interface{}); ok && reflect.DeepEqual(candidateObject[key], id) {
+				return candidateObject
+			}
+		}
+		return nil
+	}
+	if index < len(current) {
+		return current[index]
+	}
+	return nil
+}
+
+// checkSettingsAccess checks that the request may make the changes a write would make to the protected settings
+// change is called with a copy of the current settings and returns the settings after the write
+// if the request lacks the permission of a protected setting it changes it sends a 403 and returns false
+func checkSettingsAccess(c *gin.Context, change func(interface{}) interface{}) bool {
+	denied := []protectedSetting{}
+	for _, protected := range protectedSettings {
+		if !requestHasPermission(c, protected.permission) {
+			denied = append(denied, protected)
+		}
+	}
+	if len(denied) == 0 {
+		return true
+	}
+
+	current, err := settings.GetSettings(nil)
+	if err != nil {
+		// the write itself fails and reports the error
+		return true
+	}
+	proposed := change(copyJSONValue(current))
+	for _, protected := range denied {
+		before, _ := jsonPointerGet(current, protected.path)
+		after, _ := jsonPointerGet(proposed, protected.path)
+		if !reflect.DeepEqual(before, after) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":      "Permission denied: missing permission " + string(protected.permission) + " to change " + strings.Join(protected.path, "/"),
+				"permission": protected.permission,
+			})
+			return false
+		}
+	}
+	return true
+}
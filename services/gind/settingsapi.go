@@ -0,0 +1,334 @@
+package gind
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings"
+)
+
+// settingsWriteMutex serializes the settings writes so the If-Match check and the write are atomic
+// and concurrent read-modify-write updates do not lose each other's changes
+var settingsWriteMutex sync.Mutex
+
+// updateSettings reads the settings at the path, applies the update function and writes the result through sync-settings
+// every internal settings write goes through it, so it is serialized with the settings API writes
+// if the update function returns an error nothing is written and the error is returned
+func updateSettings(segments []string, update func(value interface{}) (interface{}, error)) error {
+	settingsWriteMutex.Lock()
+	defer settingsWriteMutex.Unlock()
+
+	current, err := currentSettingsValue(segments)
+	if err != nil {
+		return err
+	}
+	value, err := update(current)
+	if err != nil {
+		return err
+	}
+	_, err = settings.SetSettings(segments, value, false)
+	return err
+}
+
+// settingsSegments returns the settings path of the request split into segments, or nil for the root
+func settingsSegments(c *gin.Context) []string {
+	var segments []string
+	for _, segment := range strings.Split(c.Param("path"), "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// settingsErrorResponse returns the JSON body of a failed settings change
+// the error and output keys are the same as the packetd response, the output of
+// sync-settings is also split into lines so clients do not have to parse it
+func settingsErrorResponse(result interface{}, err error) gin.H {
+	response := gin.H{"error": err.Error()}
+	if jsonObject, ok := result.(map[string]interface{}); ok {
+		if output, ok := jsonObject["output"].(string); ok {
+			lines := []string{}
+			for _, line := range strings.Split(output, "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					lines = append(lines, line)
+				}
+			}
+			response["output"] = output
+			response["outputLines"] = lines
+		}
+	}
+	return response
+}
+
+// setAuditSettingsPath records the settings path changed by the request in the audit log
+func setAuditSettingsPath(c *gin.Context, segments []string) {
+	c.Set(auditSettingsPathsKey, []string{strings.Join(segments, "/")})
+}
+
+// settingsETag returns the entity tag of a settings value
+// encoding/json sorts the object keys, so equal settings always have the same tag
+func settingsETag(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		logger.Warn("Failed to serialize settings: %v\n", err)
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// currentSettingsETag returns the entity tag of the settings at the specified path
+// a path that does not exist has the tag of null, so a client can require that it is still missing
+// the tag is that of the value the API returns, without the secrets of the protected settings
+func currentSettingsETag(segments []string) (string, bool, error) {
+	value, err := currentSettingsValue(segments)
+	if err != nil {
+		return "", false, err
+	}
+	return settingsETag(redactSettings(segments, value)), value != nil, nil
+}
+
+// currentSettingsValue returns the settings at the specified path, or nil if the path does not exist
+// an error is only returned if the settings can not be read
+func currentSettingsValue(segments []string) (interface{}, error) {
+	value, err := settings.GetSettings(segments)
+	if err != nil {
+		if _, readErr := settings.GetSettings(nil); readErr != nil {
+			return nil, readErr
+		}
+		return nil, nil
+	}
+	return value, nil
+}
+
+// etagListMatches returns true if the If-Match or If-None-Match header value lists the entity tag
+// weak tags are compared by their opaque value
+func etagListMatches(header string, etag string, exists bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if (candidate == "*" && exists) || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSettingsPrecondition checks the If-Match header of a settings write against the current settings
+// if the settings changed since the client read them it sends a 412 with the current tag and aborts
+// the caller must hold settingsWriteMutex
+func checkSettingsPrecondition(c *gin.Context, segments []string) bool {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+	etag, exists, err := currentSettingsETag(segments)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if !etagListMatches(ifMatch, etag, exists) {
+		c.Header("ETag", etag)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Settings have been modified", "etag": etag})
+		return false
+	}
+	return true
+}
+
+// sendSettings sends the settings value with its entity tag
+// a 304 is sent if the client already has the current value
+func sendSettings(c *gin.Context, value interface{}) {
+	etag := settingsETag(value)
+	if etag != "" {
+		c.Header("ETag", etag)
+		if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" && etagListMatches(ifNoneMatch, etag, true) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, value)
+}
+
+// setSettingsETag sets the ETag header to the tag of the settings after a write
+func setSettingsETag(c *gin.Context, segments []string) {
+	if etag, _, err := currentSettingsETag(segments); err == nil {
+		c.Header("ETag", etag)
+	}
+}
+
+// getSettings is the GET /api/settings/*path handler
+// the secrets of the protected settings are never returned, see redactSettings
+func getSettings(c *gin.Context) {
+	segments := settingsSegments(c)
+	jsonResult, err := settings.GetSettings(segments)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sendSettings(c, redactSettings(segments, jsonResult))
+}
+
+// getDefaultSettings is the GET /api/defaults/*path handler
+func getDefaultSettings(c *gin.Context) {
+	segments := settingsSegments(c)
+	jsonResult, err := settings.GetDefaultSettings(segments)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sendSettings(c, redactSettings(segments, jsonResult))
+}
+
+// setSettings is the POST /api/settings/*path handler
+// the body is the new value of the path, sync-settings is run with force=true if the force query argument is set
+// with the dryRun query argument the change is only previewed, see previewSettings
+// if an If-Match header is sent the settings are only written if they have not changed since the client read them
+func setSettings(c *gin.Context) {
+	segments := settingsSegments(c)
+	setAuditSettingsPath(c, segments)
+
+	options, ok := getSettingsWriteOptions(c)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var bodyJSONObject interface{}
+	if err := json.Unmarshal(body, &bodyJSONObject); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON: " + err.Error()})
+		return
+	}
+
+	settingsWriteMutex.Lock()
+	defer settingsWriteMutex.Unlock()
+	if !checkSettingsPrecondition(c, segments) {
+		return
+	}
+
+	writeSettings(c, segments, bodyJSONObject, options)
+}
+
+// settingsWriteOptions holds the query arguments of a settings write
+type settingsWriteOptions struct {
+	force  bool
+	dryRun bool
+}
+
+// getSettingsWriteOptions returns the force and dryRun query arguments of a settings write
+// if a value is invalid it sends a 400 and returns false
+func getSettingsWriteOptions(c *gin.Context) (settingsWriteOptions, bool) {
+	var options settingsWriteOptions
+	for name, value := range map[string]*bool{"force": &options.force, "dryRun": &options.dryRun} {
+		argument := c.Query(name)
+		if argument == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(argument)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + ": " + argument})
+			return options, false
+		}
+		*value = parsed
+	}
+	return options, true
+}
+
+// writeSettings writes the value at the settings path through sync-settings and sends the result
+// the resulting settings are validated against the settings schema first, and the settings from
+// before the write are added to the history
+// secrets of the protected settings that the value leaves out are kept, so settings read from the API
+// can be written back, and changes to the protected settings require their permission
+// the caller must hold settingsWriteMutex
+func writeSettings(c *gin.Context, segments []string, value interface{}, options settingsWriteOptions) {
+	current, err := currentSettingsValue(segments)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	value = restoreSettingsSecrets(segments, current, value)
+
+	change := func(doc interface{}) interface{} { return settingsWithValue(doc, segments, value) }
+	if !checkSettingsAccess(c, change) || !checkSettingsSchema(c, change) {
+		return
+	}
+	if options.dryRun {
+		previewSettings(c, change, options.force)
+		return
+	}
+
+	previous, err := currentSettingsSnapshot()
+	if err != nil {
+		logger.Warn("Failed to read settings for the history: %v\n", err)
+	}
+	jsonResult, err := settings.SetSettings(segments, value, options.force)
+	if err != nil {
+		logger.Warn("Failed to set settings %v: %v\n", strings.Join(segments, "/"), err)
+		c.JSON(http.StatusInternalServerError, settingsErrorResponse(jsonResult, err))
+		return
+	}
+	recordSettingsRevision(c, previous, []string{strings.Join(segments, "/")}, settingsMessage(c))
+	setSettingsETag(c, segments)
+	c.JSON(http.StatusOK, jsonResult)
+}
+
+// trimSettings is the DELETE /api/settings/*path handler
+func trimSettings(c *gin.Context) {
+	segments := settingsSegments(c)
+	setAuditSettingsPath(c, segments)
+
+	options, ok := getSettingsWriteOptions(c)
+	if !ok {
+		return
+	}
+	if len(segments) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid trim settings path"})
+		return
+	}
+
+	settingsWriteMutex.Lock()
+	defer settingsWriteMutex.Unlock()
+	if !checkSettingsPrecondition(c, segments) {
+		return
+	}
+	change := func(doc interface{}) interface{} { return settingsWithoutValue(doc, segments) }
+	if !checkSettingsAccess(c, change) || !checkSettingsSchema(c, change) {
+		return
+	}
+	if options.dryRun {
+		previewSettings(c, change, options.force)
+		return
+	}
+
+	previous, err := currentSettingsSnapshot()
+	if err != nil {
+		logger.Warn("Failed to read settings for the history: %v\n", err)
+	}
+	// settings.TrimSettings always syncs without force, so the settings without the path are written
+	// as a whole to honor the force argument
+	current, err := settings.GetSettings(nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	jsonResult, err := settings.SetSettings(nil, settingsWithoutValue(current, segments), options.force)
+	if err != nil {
+		logger.Warn("Failed to trim settings %v: %v\n", strings.Join(segments, "/"), err)
+		c.JSON(http.StatusInternalServerError, settingsErrorResponse(jsonResult, err))
+		return
+	}
+	recordSettingsRevision(c, previous, []string{strings.Join(segments, "/")}, settingsMessage(c))
+	setSettingsETag(c, segments)
+	c.JSON(http.StatusOK, jsonResult)
+}
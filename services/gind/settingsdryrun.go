@@ -0,0 +1,95 @@
+package gind
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings"
+)
+
+// syncSettingsExecutable is the sync-settings command used to check settings without applying them
+// settings.SyncSettings can not be used for this, it has no simulate mode and its NormalSync applies the
+// settings file it is given to the system
+const syncSettingsExecutable = "/usr/bin/sync-settings"
+
+// simulateSyncSettings runs sync-settings in simulate mode on a temporary copy of the settings
+// nothing is written to settings.json or the system configuration
+// sync-settings may sanitize the copy, so the settings are read back from it after the run
+func simulateSyncSettings(jsonObject interface{}, force bool) (string, interface{}, error) {
+	data, err := json.MarshalIndent(jsonObject, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+	tmpfile, err := ioutil.TempFile("", "settings-dryrun.*.json")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(tmpfile.Name())
+	_, err = tmpfile.Write(data)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	cmd := exec.Command(syncSettingsExecutable, "-o", settings.OSForSyncSettings, "-s", "-f", tmpfile.Name(), "-v", "force="+strconv.FormatBool(force))
+	outbytes, err := cmd.CombinedOutput()
+	output := string(outbytes)
+	if err != nil {
+		return output, nil, err
+	}
+
+	result := jsonObject
+	if data, err := ioutil.ReadFile(tmpfile.Name()); err == nil {
+		var sanitized interface{}
+		if json.Unmarshal(data, &sanitized) == nil && sanitized != nil {
+			result = sanitized
+		}
+	}
+	return output, result, nil
+}
+
+// previewSettings is the dry run of a settings write
+// change is called with a copy of the current settings and returns the settings after the write, which
+// are checked by sync-settings without being applied
+// the response lists the changes the write would make, a 422 is sent if sync-settings rejects the settings
+// changes to the secrets of the protected settings are not listed
+func previewSettings(c *gin.Context, change func(interface{}) interface{}, force bool) {
+	// a dry run does not change any settings, so none are recorded in the audit log
+	c.Set(auditSettingsPathsKey, []string{})
+
+	current, err := settings.GetSettings(nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	proposed := change(copyJSONValue(current))
+
+	output, result, err := simulateSyncSettings(proposed, force)
+	changes := []settingsChange{}
+	if err != nil {
+		logger.Info("Dry run of settings change failed: %v\n", err)
+		diffSettings(redactSettings(nil, current), redactSettings(nil, proposed), "", &changes)
+		status := http.StatusInternalServerError
+		if _, ok := err.(*exec.ExitError); ok {
+			status = http.StatusUnprocessableEntity
+			err = errors.New("sync-settings rejected the settings")
+		}
+		response := settingsErrorResponse(map[string]interface{}{"output": output}, err)
+		response["dryRun"] = true
+		response["changes"] = changes
+		c.JSON(status, response)
+		return
+	}
+
+	diffSettings(redactSettings(nil, current), redactSettings(nil, result), "", &changes)
+	c.JSON(http.StatusOK, gin.H{"result": "OK", "dryRun": true, "output": output, "changes": changes})
+}
@@ -0,0 +1,367 @@
+package gind
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings"
+)
+
+// settingsHistoryDir is where the settings revisions are kept
+const settingsHistoryDir = restdConfigDir + "/settings-history"
+
+// settingsHistoryIndex is the file listing the settings revisions
+const settingsHistoryIndex = settingsHistoryDir + "/index.json"
+
+// settingsMessageHeader is the header in which clients describe a settings change
+const settingsMessageHeader = "X-Settings-Message"
+
+// settingsHistoryConfig holds the system.restd.settingsHistory settings
+type settingsHistoryConfig struct {
+	enabled      bool
+	maxRevisions int
+	maxTotalSize int64
+}
+
+// settingsRevision describes a settings write
+// the revision holds the settings as they were before the write, so rolling back to it undoes the write
+type settingsRevision struct {
+	ID       int64    `json:"id"`
+	Time     int64    `json:"time"`
+	Username string   `json:"username,omitempty"`
+	Message  string   `json:"message,omitempty"`
+	Paths    []string `json:"paths"`
+	Size     int64    `json:"size"`
+}
+
+// settingsChange is a single difference between two settings revisions
+type settingsChange struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  interface{} `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+var settingsHistoryMutex sync.Mutex
+
+// getSettingsHistoryConfig reads the settings history settings, applying defaults for anything not configured
+func getSettingsHistoryConfig() settingsHistoryConfig {
+	jsonObject := getRestdSettings("settingsHistory")
+	return settingsHistoryConfig{
+		enabled:      settingBool(jsonObject, "enabled", true),
+		maxRevisions: int(settingInt(jsonObject, "maxRevisions", 50)),
+		maxTotalSize: settingInt(jsonObject, "maxTotalSizeKB", 10240) * 1024,
+	}
+}
+
+// settingsRevisionFile returns the path of the file holding the settings of the revision
+func settingsRevisionFile(id int64) string {
+	return filepath.Join(settingsHistoryDir, strconv.FormatInt(id, 10)+".json")
+}
+
+// loadSettingsHistory returns the settings revisions, oldest first
+// the caller must hold settingsHistoryMutex
+func loadSettingsHistory() []settingsRevision {
+	revisions := []settingsRevision{}
+	data, err := ioutil.ReadFile(settingsHistoryIndex)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Failed to read %v: %v\n", settingsHistoryIndex, err)
+		}
+		return revisions
+	}
+	if err := json.Unmarshal(data, &revisions); err != nil {
+		logger.Warn("Failed to parse %v: %v\n", settingsHistoryIndex, err)
+		return []settingsRevision{}
+	}
+	return revisions
+}
+
+// saveSettingsHistory writes the list of settings revisions
+// the caller must hold settingsHistoryMutex
+func saveSettingsHistory(revisions []settingsRevision) error {
+	data, err := json.Marshal(revisions)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(settingsHistoryIndex, data, 0600)
+}
+
+// historySettings returns the settings without the accounts
+// the accounts are never kept in the history, so the password hashes and second factor secrets are only
+// in settings.json and a rollback can not bring back a removed account or an old password
+func historySettings(jsonObject interface{}) interface{} {
+	if settingsObject, ok := jsonObject.(map[string]interface{}); ok {
+		delete(settingsObject, "accounts")
+	}
+	return jsonObject
+}
+
+// currentSettingsSnapshot returns the current settings serialized for a revision
+func currentSettingsSnapshot() ([]byte, error) {
+	jsonObject, err := settings.GetSettings(nil)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(historySettings(jsonObject), "", "  ")
+}
+
+// settingsMessage returns the description of the settings change sent by the client
+func settingsMessage(c *gin.Context) string {
+	if message := c.GetHeader(settingsMessageHeader); message != "" {
+		return message
+	}
+	return c.Query("message")
+}
+
+// recordSettingsRevision adds the settings from before a successful write to the history
+// the oldest revisions are removed once there are more than maxRevisions or they use more than maxTotalSize
+func recordSettingsRevision(c *gin.Context, previous []byte, paths []string, message string) {
+	config := getSettingsHistoryConfig()
+	if !config.enabled || previous == nil {
+		return
+	}
+
+	settingsHistoryMutex.Lock()
+	defer settingsHistoryMutex.Unlock()
+
+	if err := os.MkdirAll(settingsHistoryDir, 0700); err != nil {
+		logger.Warn("Failed to create %v: %v\n", settingsHistoryDir, err)
+		return
+	}
+	revisions := loadSettingsHistory()
+	revision := settingsRevision{
+		ID:       1,
+		Time:     time.Now().Unix(),
+		Username: getAuthUsername(c),
+		Message:  message,
+		Paths:    paths,
+		Size:     int64(len(previous)),
+	}
+	if len(revisions) > 0 {
+		revision.ID = revisions[len(revisions)-1].ID + 1
+	}
+	if err := ioutil.WriteFile(settingsRevisionFile(revision.ID), previous, 0600); err != nil {
+		logger.Warn("Failed to write settings revision %v: %v\n", revision.ID, err)
+		return
+	}
+	revisions = append(revisions, revision)
+
+	var total int64
+	for _, r := range revisions {
+		total += r.Size
+	}
+	for len(revisions) > 1 && (len(revisions) > config.maxRevisions || total > config.maxTotalSize) {
+		os.Remove(settingsRevisionFile(revisions[0].ID))
+		total -= revisions[0].Size
+		revisions = revisions[1:]
+	}
+
+	if err := saveSettingsHistory(revisions); err != nil {
+		logger.Warn("Failed to write %v: %v\n", settingsHistoryIndex, err)
+	}
+}
+
+// loadSettingsRevision returns the settings of the revision, or the current settings for "current"
+// the accounts are left out of both, see historySettings
+func loadSettingsRevision(id string) (interface{}, error) {
+	if id == "current" {
+		jsonObject, err := settings.GetSettings(nil)
+		if err != nil {
+			return nil, err
+		}
+		return historySettings(jsonObject), nil
+	}
+	revisionID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid revision %v", id)
+	}
+
+	settingsHistoryMutex.Lock()
+	data, err := ioutil.ReadFile(settingsRevisionFile(revisionID))
+	settingsHistoryMutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("revision %v not found", id)
+	}
+
+	var jsonObject interface{}
+	if err := json.Unmarshal(data, &jsonObject); err != nil {
+		return nil, err
+	}
+	return historySettings(jsonObject), nil
+}
+
+// diffSettings appends the changes that turn a into b to changes
+// objects are compared by key and arrays by index, so an insertion in an array shows up as
+// changes to every following element
+func diffSettings(a interface{}, b interface{}, path string, changes *[]settingsChange) {
+	mapA, okA := a.(map[string]interface{})
+	mapB, okB := b.(map[string]interface{})
+	if okA && okB {
+		keys := []string{}
+		for key := range mapA {
+			keys = append(keys, key)
+		}
+		for key := range mapB {
+			if _, ok := mapA[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			childPath := jsonPointerAppend(path, key)
+			valueA, inA := mapA[key]
+			valueB, inB := mapB[key]
+			switch {
+			case !inA:
+				*changes = append(*changes, settingsChange{Op: "add", Path: childPath, Value: valueB})
+			case !inB:
+				*changes = append(*changes, settingsChange{Op: "remove", Path: childPath, From: valueA})
+			default:
+				diffSettings(valueA, valueB, childPath, changes)
+			}
+		}
+		return
+	}
+
+	arrayA, okA := a.([]interface{})
+	arrayB, okB := b.([]interface{})
+	if okA && okB {
+		for i := 0; i < len(arrayA) || i < len(arrayB); i++ {
+			childPath := path + "/" + strconv.Itoa(i)
+			switch {
+			case i >= len(arrayA):
+				*changes = append(*changes, settingsChange{Op: "add", Path: childPath, Value: arrayB[i]})
+			case i >= len(arrayB):
+				*changes = append(*changes, settingsChange{Op: "remove", Path: childPath, From: arrayA[i]})
+			default:
+				diffSettings(arrayA[i], arrayB[i], childPath, changes)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, settingsChange{Op: "replace", Path: path, From: a, Value: b})
+	}
+}
+
+// settingsHistoryList is the GET /api/settings-history handler
+// it returns the settings revisions, newest first
+func settingsHistoryList(c *gin.Context) {
+	settingsHistoryMutex.Lock()
+	revisions := loadSettingsHistory()
+	settingsHistoryMutex.Unlock()
+
+	for i, j := 0, len(revisions)-1; i < j; i, j = i+1, j-1 {
+		revisions[i], revisions[j] = revisions[j], revisions[i]
+	}
+	c.JSON(http.StatusOK, revisions)
+}
+
+// settingsHistoryGet is the GET /api/settings-history/:id handler
+// it returns the settings of the revision, without the secrets of the protected settings
+func settingsHistoryGet(c *gin.Context) {
+	jsonObject, err := loadSettingsRevision(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, redactSettings(nil, jsonObject))
+}
+
+// settingsHistoryDiff is the GET /api/settings-history/:id/diff handler
+// it returns the changes from the revision to the revision in the to query argument, by default the current settings
+// paths are JSON pointers (RFC 6901), changes to the secrets of the protected settings are not listed
+func settingsHistoryDiff(c *gin.Context) {
+	from, err := loadSettingsRevision(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := loadSettingsRevision(c.DefaultQuery("to", "current"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	changes := []settingsChange{}
+	diffSettings(redactSettings(nil, from), redactSettings(nil, to), "", &changes)
+	c.JSON(http.StatusOK, changes)
+}
+
+// settingsHistoryRollback is the POST /api/settings-history/:id/rollback handler
+// it writes the settings of the revision through sync-settings, which itself adds a revision
+// the current accounts are kept, they are not part of the history
+func settingsHistoryRollback(c *gin.Context) {
+	id := c.Param("id")
+	jsonObject, err := loadSettingsRevision(id)
+	if err != nil || id == "current" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision " + id + " not found"})
+		return
+	}
+	setAuditSettingsPath(c, nil)
+
+	options, ok := getSettingsWriteOptions(c)
+	if !ok {
+		return
+	}
+
+	settingsWriteMutex.Lock()
+	defer settingsWriteMutex.Unlock()
+	if !checkSettingsPrecondition(c, nil) {
+		return
+	}
+	settingsObject, ok := jsonObject.(map[string]interface{})
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid settings in revision " + id})
+		return
+	}
+	accounts, err := currentSettingsValue([]string{"accounts"})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if accounts != nil {
+		settingsObject["accounts"] = accounts
+	}
+	change := func(interface{}) interface{} { return jsonObject }
+	if !checkSettingsAccess(c, change) || !checkSettingsSchema(c, change) {
+		return
+	}
+	if options.dryRun {
+		previewSettings(c, change, options.force)
+		return
+	}
+
+	previous, err := currentSettingsSnapshot()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	jsonResult, err := settings.SetSettings(nil, jsonObject, options.force)
+	if err != nil {
+		logger.Warn("Failed to roll back settings to revision %v: %v\n", id, err)
+		c.JSON(http.StatusInternalServerError, settingsErrorResponse(jsonResult, err))
+		return
+	}
+
+	message := settingsMessage(c)
+	if message == "" {
+		message = "Rollback to revision " + id
+	}
+	recordSettingsRevision(c, previous, []string{""}, message)
+	setSettingsETag(c, nil)
+	c.JSON(http.StatusOK, jsonResult)
+}
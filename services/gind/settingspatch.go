@@ -0,0 +1,389 @@
+package gind
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mergePatchContentType is the media type of JSON Merge Patch (RFC 7396) bodies
+const mergePatchContentType = "application/merge-patch+json"
+
+// jsonPatchContentType is the media type of JSON Patch (RFC 6902) bodies
+const jsonPatchContentType = "application/json-patch+json"
+
+// jsonPatchOperation is a single operation of a JSON Patch document
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// jsonPatchError describes the operation of a JSON Patch document that could not be applied
+type jsonPatchError struct {
+	index int
+	op    string
+	path  string
+	err   error
+}
+
+func (e *jsonPatchError) Error() string {
+	return fmt.Sprintf("operation %d (%v %v): %v", e.index, e.op, e.path, e.err)
+}
+
+// mergePatch applies a JSON Merge Patch to the target and returns the result
+// objects are merged recursively, a null removes the key and any other value replaces the target
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// parseJSONPointer splits a JSON pointer (RFC 6901) into its unescaped reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.New("invalid JSON pointer " + pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// jsonPointerAppend returns the JSON pointer to the child of the pointer with the specified reference token
+func jsonPointerAppend(pointer string, token string) string {
+	return pointer + "/" + strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+// jsonArrayIndex parses an array index reference token, which must be below max
+func jsonArrayIndex(token string, max int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, errors.New("invalid array index " + token)
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, errors.New("invalid array index " + token)
+	}
+	if index >= max {
+		return 0, errors.New("array index " + token + " out of range")
+	}
+	return index, nil
+}
+
+// jsonPointerGet returns the value the reference tokens point to in the document
+func jsonPointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, errors.New("member " + token + " not found")
+			}
+			doc = value
+		case []interface{}:
+			index, err := jsonArrayIndex(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			doc = container[index]
+		default:
+			return nil, errors.New("can not reference " + token + " in a scalar value")
+		}
+	}
+	return doc, nil
+}
+
+// jsonPointerUpdate calls update with the parent container of the value the reference tokens point to
+// and the last token, and stores the container it returns in place of the parent
+// it returns the updated document
+func jsonPointerUpdate(doc interface{}, tokens []string, update func(interface{}, string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return update(doc, tokens[0])
+	}
+	child, err := jsonPointerGet(doc, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = jsonPointerUpdate(child, tokens[1:], update)
+	if err != nil {
+		return nil, err
+	}
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		container[tokens[0]] = child
+	case []interface{}:
+		index, _ := jsonArrayIndex(tokens[0], len(container))
+		container[index] = child
+	}
+	return doc, nil
+}
+
+// jsonPatchAdd adds the value at the location, inserting it into arrays
+func jsonPatchAdd(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return jsonPointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			if token == "-" {
+				return append(container, value), nil
+			}
+			index, err := jsonArrayIndex(token, len(container)+1)
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		default:
+			return nil, errors.New("can not add " + token + " to a scalar value")
+		}
+	})
+}
+
+// jsonPatchRemove removes the value at the location, which must exist
+func jsonPatchRemove(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("can not remove the whole document")
+	}
+	return jsonPointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := container[token]; !ok {
+				return nil, errors.New("member " + token + " not found")
+			}
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			index, err := jsonArrayIndex(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			return append(container[:index], container[index+1:]...), nil
+		default:
+			return nil, errors.New("can not remove " + token + " from a scalar value")
+		}
+	})
+}
+
+// jsonPatchReplace replaces the value at the location, which must exist
+func jsonPatchReplace(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	if _, err := jsonPointerGet(doc, tokens); err != nil {
+		return nil, err
+	}
+	return jsonPointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[token] = value
+		case []interface{}:
+			index, _ := jsonArrayIndex(token, len(container))
+			container[index] = value
+		}
+		return parent, nil
+	})
+}
+
+// copyJSONValue returns a deep copy of a decoded JSON value
+func copyJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			result[key] = copyJSONValue(child)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, child := range v {
+			result[i] = copyJSONValue(child)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+// applyJSONPatchOperation applies a single JSON Patch operation to the document
+func applyJSONPatchOperation(doc interface{}, operation jsonPatchOperation) (interface{}, error) {
+	if operation.Path == nil {
+		return nil, errors.New("missing path")
+	}
+	tokens, err := parseJSONPointer(*operation.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch operation.Op {
+	case "add", "replace", "test":
+		// a null value is decoded as the raw null literal, only a missing value is empty
+		if len(operation.Value) == 0 {
+			return nil, errors.New("missing value")
+		}
+		if err := json.Unmarshal(operation.Value, &value); err != nil {
+			return nil, err
+		}
+	}
+
+	var fromTokens []string
+	switch operation.Op {
+	case "move", "copy":
+		if operation.From == nil {
+			return nil, errors.New("missing from")
+		}
+		if fromTokens, err = parseJSONPointer(*operation.From); err != nil {
+			return nil, err
+		}
+		if value, err = jsonPointerGet(doc, fromTokens); err != nil {
+			return nil, err
+		}
+	}
+
+	switch operation.Op {
+	case "add":
+		return jsonPatchAdd(doc, tokens, value)
+	case "remove":
+		return jsonPatchRemove(doc, tokens)
+	case "replace":
+		return jsonPatchReplace(doc, tokens, value)
+	case "move":
+		if *operation.Path == *operation.From {
+			return doc, nil
+		}
+		if strings.HasPrefix(*operation.Path, *operation.From+"/") {
+			return nil, errors.New("can not move a value into one of its children")
+		}
+		if doc, err = jsonPatchRemove(doc, fromTokens); err != nil {
+			return nil, err
+		}
+		return jsonPatchAdd(doc, tokens, value)
+	case "copy":
+		return jsonPatchAdd(doc, tokens, copyJSONValue(value))
+	case "test":
+		current, err := jsonPointerGet(doc, tokens)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	default:
+		return nil, errors.New("unknown operation " + operation.Op)
+	}
+}
+
+// applyJSONPatch applies the JSON Patch operations to the document in order
+// the document is modified in place, so the caller must pass a value it can discard if an operation fails
+func applyJSONPatch(doc interface{}, operations []jsonPatchOperation) (interface{}, error) {
+	for i, operation := range operations {
+		var err error
+		if doc, err = applyJSONPatchOperation(doc, operation); err != nil {
+			path := ""
+			if operation.Path != nil {
+				path = *operation.Path
+			}
+			return nil, &jsonPatchError{index: i, op: operation.Op, path: path, err: err}
+		}
+	}
+	return doc, nil
+}
+
+// patchSettings is the PATCH /api/settings/*path handler
+// the body is a JSON Merge Patch or a JSON Patch, depending on the content type, which is applied to the
+// current value of the path and written through sync-settings
+// JSON Patch paths are relative to the settings path, and if any operation fails nothing is written
+// the patch is applied to the value the API returns, without the secrets of the protected settings,
+// so a test operation can not be used to guess them
+func patchSettings(c *gin.Context) {
+	segments := settingsSegments(c)
+	setAuditSettingsPath(c, segments)
+
+	contentType := c.ContentType()
+	if contentType != mergePatchContentType && contentType != jsonPatchContentType {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported patch format: " + contentType})
+		return
+	}
+	options, ok := getSettingsWriteOptions(c)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var mergeDocument interface{}
+	var operations []jsonPatchOperation
+	if contentType == mergePatchContentType {
+		err = json.Unmarshal(body, &mergeDocument)
+	} else {
+		err = json.Unmarshal(body, &operations)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON: " + err.Error()})
+		return
+	}
+
+	settingsWriteMutex.Lock()
+	defer settingsWriteMutex.Unlock()
+	if !checkSettingsPrecondition(c, segments) {
+		return
+	}
+
+	current, err := currentSettingsValue(segments)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	current = redactSettings(segments, current)
+
+	var result interface{}
+	if contentType == mergePatchContentType {
+		result = mergePatch(current, mergeDocument)
+	} else if result, err = applyJSONPatch(current, operations); err != nil {
+		patchErr := err.(*jsonPatchError)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":     patchErr.Error(),
+			"operation": patchErr.index,
+			"op":        patchErr.op,
+			"path":      patchErr.path,
+		})
+		return
+	}
+	writeSettings(c, segments, result, options)
+}
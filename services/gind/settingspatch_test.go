@@ -0,0 +1,267 @@
+package gind
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// decodeJSON decodes a JSON test fixture, failing the test if it is invalid
+func decodeJSON(t *testing.T, data string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		t.Fatalf("invalid fixture %v: %v", data, err)
+	}
+	return value
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		doc       string
+		patch     string
+		want      string
+		wantIndex int
+	}{
+		{
+			name:  "add appends with the - index",
+			doc:   `{"a":[1,2]}`,
+			patch: `[{"op":"add","path":"/a/-","value":3}]`,
+			want:  `{"a":[1,2,3]}`,
+		},
+		{
+			name:  "add inserts before the index",
+			doc:   `{"a":[1,2]}`,
+			patch: `[{"op":"add","path":"/a/0","value":0}]`,
+			want:  `{"a":[0,1,2]}`,
+		},
+		{
+			name:  "add at the array length appends",
+			doc:   `{"a":[1,2]}`,
+			patch: `[{"op":"add","path":"/a/2","value":3}]`,
+			want:  `{"a":[1,2,3]}`,
+		},
+		{
+			name:      "add past the array length fails",
+			doc:       `{"a":[1,2]}`,
+			patch:     `[{"op":"add","path":"/a/3","value":3}]`,
+			wantIndex: 0,
+		},
+		{
+			name:  "add replaces an existing member",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"add","path":"/a","value":2}]`,
+			want:  `{"a":2}`,
+		},
+		{
+			name:      "add to a missing parent fails",
+			doc:       `{}`,
+			patch:     `[{"op":"add","path":"/a/b","value":1}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "index with a leading zero is invalid",
+			doc:       `{"a":[1,2]}`,
+			patch:     `[{"op":"replace","path":"/a/01","value":3}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "the - index can only be added to",
+			doc:       `{"a":[1,2]}`,
+			patch:     `[{"op":"remove","path":"/a/-"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "remove out of range fails",
+			doc:       `{"a":[1,2]}`,
+			patch:     `[{"op":"remove","path":"/a/2"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:  "escaped tokens are unescaped",
+			doc:   `{"a/b":1,"m~n":2}`,
+			patch: `[{"op":"replace","path":"/a~1b","value":10},{"op":"replace","path":"/m~0n","value":20}]`,
+			want:  `{"a/b":10,"m~n":20}`,
+		},
+		{
+			name:  "~01 is unescaped to ~1",
+			doc:   `{"~1":1,"/":2}`,
+			patch: `[{"op":"remove","path":"/~01"}]`,
+			want:  `{"/":2}`,
+		},
+		{
+			name:      "remove a missing member fails",
+			doc:       `{"a":1}`,
+			patch:     `[{"op":"remove","path":"/b"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "replace a missing member fails",
+			doc:       `{"a":1}`,
+			patch:     `[{"op":"replace","path":"/b","value":1}]`,
+			wantIndex: 0,
+		},
+		{
+			name:  "replace the whole document",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"replace","path":"","value":{"b":2}}]`,
+			want:  `{"b":2}`,
+		},
+		{
+			name:      "remove the whole document fails",
+			doc:       `{"a":1}`,
+			patch:     `[{"op":"remove","path":""}]`,
+			wantIndex: 0,
+		},
+		{
+			name:  "move between members",
+			doc:   `{"a":{"b":1},"c":{}}`,
+			patch: `[{"op":"move","from":"/a/b","path":"/c/d"}]`,
+			want:  `{"a":{},"c":{"d":1}}`,
+		},
+		{
+			name:  "move within an array",
+			doc:   `{"a":[1,2,3]}`,
+			patch: `[{"op":"move","from":"/a/0","path":"/a/-"}]`,
+			want:  `{"a":[2,3,1]}`,
+		},
+		{
+			name:  "move to the same path does nothing",
+			doc:   `{"a":{"b":1}}`,
+			patch: `[{"op":"move","from":"/a","path":"/a"}]`,
+			want:  `{"a":{"b":1}}`,
+		},
+		{
+			name:      "move into a child fails",
+			doc:       `{"a":{"b":1}}`,
+			patch:     `[{"op":"move","from":"/a","path":"/a/b/c"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:  "move to a sibling with the same prefix",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"move","from":"/a","path":"/ab"}]`,
+			want:  `{"ab":1}`,
+		},
+		{
+			name:      "move from a missing member fails",
+			doc:       `{"a":1}`,
+			patch:     `[{"op":"move","from":"/b","path":"/c"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:  "copy makes a deep copy",
+			doc:   `{"a":{"b":[1]}}`,
+			patch: `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b/-","value":2}]`,
+			want:  `{"a":{"b":[1]},"c":{"b":[1,2]}}`,
+		},
+		{
+			name:  "test compares values",
+			doc:   `{"a":{"b":[1,"x"]}}`,
+			patch: `[{"op":"test","path":"/a","value":{"b":[1,"x"]}},{"op":"remove","path":"/a/b/1"}]`,
+			want:  `{"a":{"b":[1]}}`,
+		},
+		{
+			name:      "failing test reports its operation",
+			doc:       `{"a":1}`,
+			patch:     `[{"op":"replace","path":"/a","value":2},{"op":"test","path":"/a","value":1}]`,
+			wantIndex: 1,
+		},
+		{
+			name:      "test of a missing member fails",
+			doc:       `{"a":1}`,
+			patch:     `[{"op":"test","path":"/b","value":null}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "missing value fails",
+			doc:       `{"a":1}`,
+			patch:     `[{"op":"add","path":"/b"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:  "null value is added",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"add","path":"/b","value":null}]`,
+			want:  `{"a":1,"b":null}`,
+		},
+		{
+			name:      "missing path fails",
+			doc:       `{"a":1}`,
+			patch:     `[{"op":"add","value":1}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "pointer without a leading slash fails",
+			doc:       `{"a":1}`,
+			patch:     `[{"op":"remove","path":"a"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "unknown operation fails",
+			doc:       `{"a":1}`,
+			patch:     `[{"op":"append","path":"/a","value":1}]`,
+			wantIndex: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var operations []jsonPatchOperation
+			if err := json.Unmarshal([]byte(test.patch), &operations); err != nil {
+				t.Fatalf("invalid patch %v: %v", test.patch, err)
+			}
+
+			got, err := applyJSONPatch(decodeJSON(t, test.doc), operations)
+			if test.want == "" {
+				patchErr, ok := err.(*jsonPatchError)
+				if !ok {
+					t.Fatalf("applyJSONPatch() = %v, %v, want a jsonPatchError", got, err)
+				}
+				if patchErr.index != test.wantIndex {
+					t.Errorf("failed operation = %v (%v), want %v", patchErr.index, patchErr, test.wantIndex)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyJSONPatch() error = %v", err)
+			}
+			if want := decodeJSON(t, test.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("applyJSONPatch() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// the merge patch cases are the examples of RFC 7396 appendix A
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target string
+		patch  string
+		want   string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, test := range tests {
+		got := mergePatch(decodeJSON(t, test.target), decodeJSON(t, test.patch))
+		if want := decodeJSON(t, test.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("mergePatch(%v, %v) = %v, want %v", test.target, test.patch, got, want)
+		}
+	}
+}
@@ -0,0 +1,601 @@
+package gind
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings"
+)
+
+// defaultSettingsSchemaFile is the JSON Schema of settings.json shipped with the system
+const defaultSettingsSchemaFile = "/usr/share/restd/settings-schema.json"
+
+// maxSchemaDepth limits the nesting of schemas, so a $ref cycle can not recurse forever
+const maxSchemaDepth = 256
+
+// hostnamePattern matches the hostname format of JSON Schema (RFC 1123)
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*\.?$`)
+
+// settingsSchemaConfig holds the system.restd.settingsSchema settings
+type settingsSchemaConfig struct {
+	enabled bool
+	file    string
+}
+
+// settingsValidationError is a settings value that does not match the schema
+// path is the JSON pointer (RFC 6901) of the value in settings.json
+type settingsValidationError struct {
+	Path    string `json:"path"`
+	Keyword string `json:"keyword"`
+	Message string `json:"message"`
+}
+
+// schemaValidator validates a settings document against a JSON Schema
+type schemaValidator struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+	errors   []settingsValidationError
+}
+
+// settingsSchemaStatus tells whether settings writes are validated against the schema
+// state is "active", "disabled", or "missing" or "invalid" if validation is enabled but the schema can not be used
+type settingsSchemaStatus struct {
+	Enabled bool   `json:"enabled"`
+	File    string `json:"file"`
+	State   string `json:"state"`
+	Error   string `json:"error,omitempty"`
+}
+
+// the states of settingsSchemaStatus
+const (
+	schemaStateActive   = "active"
+	schemaStateDisabled = "disabled"
+	schemaStateMissing  = "missing"
+	schemaStateInvalid  = "invalid"
+)
+
+// settingsSchemaHeader is the header that tells a client its settings write was not validated, and why
+const settingsSchemaHeader = "X-Settings-Schema"
+
+var settingsSchemaMutex sync.Mutex
+var settingsSchema interface{}
+var settingsSchemaFile string
+var settingsSchemaModTime time.Time
+var settingsSchemaCurrentStatus settingsSchemaStatus
+
+// getSettingsSchemaConfig reads the settings schema settings, applying defaults for anything not configured
+func getSettingsSchemaConfig() settingsSchemaConfig {
+	jsonObject := getRestdSettings("settingsSchema")
+	return settingsSchemaConfig{
+		enabled: settingBool(jsonObject, "enabled", true),
+		file:    settingString(jsonObject, "file", defaultSettingsSchemaFile),
+	}
+}
+
+// getSettingsSchema returns the settings schema, or nil if settings are not validated
+// the schema file is only parsed again after it changes
+func getSettingsSchema() interface{} {
+	config := getSettingsSchemaConfig()
+
+	settingsSchemaMutex.Lock()
+	defer settingsSchemaMutex.Unlock()
+
+	if !config.enabled {
+		setSettingsSchemaStatus(config, schemaStateDisabled, nil)
+		return nil
+	}
+
+	info, err := os.Stat(config.file)
+	if err != nil {
+		state := schemaStateInvalid
+		if os.IsNotExist(err) {
+			state = schemaStateMissing
+		}
+		setSettingsSchemaStatus(config, state, err)
+		settingsSchema = nil
+		return nil
+	}
+	if settingsSchema != nil && settingsSchemaFile == config.file && settingsSchemaModTime.Equal(info.ModTime()) {
+		return settingsSchema
+	}
+
+	// a broken schema is not allowed to block every settings change, the write is checked by sync-settings
+	settingsSchema = nil
+	data, err := ioutil.ReadFile(config.file)
+	if err != nil {
+		setSettingsSchemaStatus(config, schemaStateInvalid, err)
+		return nil
+	}
+	var schema interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		setSettingsSchemaStatus(config, schemaStateInvalid, err)
+		return nil
+	}
+	logger.Info("Loaded settings schema %v\n", config.file)
+	setSettingsSchemaStatus(config, schemaStateActive, nil)
+	settingsSchema = schema
+	settingsSchemaFile = config.file
+	settingsSchemaModTime = info.ModTime()
+	return schema
+}
+
+// setSettingsSchemaStatus records whether settings writes are validated
+// a warning is logged when validation is enabled but stops because the schema file is missing or broken
+// the caller must hold settingsSchemaMutex
+func setSettingsSchemaStatus(config settingsSchemaConfig, state string, err error) {
+	status := settingsSchemaStatus{Enabled: config.enabled, File: config.file, State: state}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	if status == settingsSchemaCurrentStatus {
+		return
+	}
+	settingsSchemaCurrentStatus = status
+
+	switch state {
+	case schemaStateMissing:
+		logger.Warn("Settings schema %v is missing, settings changes are not validated\n", config.file)
+	case schemaStateInvalid:
+		logger.Warn("Failed to load settings schema %v, settings changes are not validated: %v\n", config.file, err)
+	}
+}
+
+// getSettingsSchemaStatus returns whether settings writes are currently validated against the schema
+func getSettingsSchemaStatus() settingsSchemaStatus {
+	getSettingsSchema()
+
+	settingsSchemaMutex.Lock()
+	defer settingsSchemaMutex.Unlock()
+	return settingsSchemaCurrentStatus
+}
+
+// settingsSchemaStatusHandler is the GET /api/settings-schema handler
+// it tells whether settings writes are validated, so a missing or broken schema file does not go unnoticed
+func settingsSchemaStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, getSettingsSchemaStatus())
+}
+
+// validateSettingsSchema returns the values of the document that do not match the schema
+func validateSettingsSchema(schema interface{}, doc interface{}) []settingsValidationError {
+	v := &schemaValidator{root: schema, patterns: map[string]*regexp.Regexp{}}
+	v.validate(schema, doc, "", 0)
+	return v.errors
+}
+
+// checkSettingsSchema validates the settings a write would produce against the settings schema
+// change is called with a copy of the current settings and returns the settings after the write
+// if the settings are invalid it sends a 422 with the invalid values and returns false
+// if validation is enabled but the schema can not be used the write is allowed, and the settingsSchemaHeader
+// of the response tells the client it was not validated
+func checkSettingsSchema(c *gin.Context, change func(interface{}) interface{}) bool {
+	schema := getSettingsSchema()
+	if schema == nil {
+		if status := getSettingsSchemaStatus(); status.Enabled {
+			c.Header(settingsSchemaHeader, status.State)
+		}
+		return true
+	}
+	current, err := settings.GetSettings(nil)
+	if err != nil {
+		// the write itself fails and reports the error
+		return true
+	}
+
+	validationErrors := validateSettingsSchema(schema, change(current))
+	if len(validationErrors) == 0 {
+		return true
+	}
+	logger.Info("Rejected settings change: %v is invalid: %v\n", validationErrors[0].Path, validationErrors[0].Message)
+	c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid settings", "validationErrors": validationErrors})
+	return false
+}
+
+// settingsWithValue returns the settings with the value set at the path, the same way settings.SetSettings sets it
+func settingsWithValue(doc interface{}, segments []string, value interface{}) interface{} {
+	if len(segments) == 0 {
+		return value
+	}
+	if array, ok := doc.([]interface{}); ok && len(segments) == 1 {
+		if index, err := strconv.Atoi(segments[0]); err == nil && index >= 0 && index < len(array) {
+			array[index] = value
+		}
+		return array
+	}
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		object = map[string]interface{}{}
+	}
+	object[segments[0]] = settingsWithValue(object[segments[0]], segments[1:], value)
+	return object
+}
+
+// settingsWithoutValue returns the settings with the path removed, the same way settings.TrimSettings removes it
+func settingsWithoutValue(doc interface{}, segments []string) interface{} {
+	object, ok := doc.(map[string]interface{})
+	for i, segment := range segments {
+		if !ok {
+			break
+		}
+		if i == len(segments)-1 {
+			delete(object, segment)
+			break
+		}
+		object, ok = object[segment].(map[string]interface{})
+	}
+	return doc
+}
+
+// error records a value that does not match the schema
+func (v *schemaValidator) error(path string, keyword string, format string, args ...interface{}) {
+	v.errors = append(v.errors, settingsValidationError{Path: path, Keyword: keyword, Message: fmt.Sprintf(format, args...)})
+}
+
+// matches returns true if the value matches the schema, without recording any error
+func (v *schemaValidator) matches(schema interface{}, value interface{}, path string, depth int) bool {
+	saved := v.errors
+	v.errors = nil
+	v.validate(schema, value, path, depth)
+	valid := len(v.errors) == 0
+	v.errors = saved
+	return valid
+}
+
+// pattern returns the compiled regular expression, or nil if it is invalid
+func (v *schemaValidator) pattern(expr string) *regexp.Regexp {
+	if re, ok := v.patterns[expr]; ok {
+		return re
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		logger.Warn("Invalid pattern in settings schema %v: %v\n", expr, err)
+	}
+	v.patterns[expr] = re
+	return re
+}
+
+// resolve returns the schema a local $ref points to
+func (v *schemaValidator) resolve(ref string) (interface{}, bool) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, false
+	}
+	pointer, err := url.PathUnescape(ref[1:])
+	if err != nil {
+		return nil, false
+	}
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, false
+	}
+	schema, err := jsonPointerGet(v.root, tokens)
+	return schema, err == nil
+}
+
+// validate records the errors of the value at the path against the schema
+func (v *schemaValidator) validate(schema interface{}, value interface{}, path string, depth int) {
+	if depth > maxSchemaDepth {
+		logger.Warn("Settings schema is nested too deeply at %v\n", path)
+		return
+	}
+	depth++
+
+	if allowed, ok := schema.(bool); ok {
+		if !allowed {
+			v.error(path, "false", "value is not allowed")
+		}
+		return
+	}
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if ref, ok := s["$ref"].(string); ok {
+		if target, ok := v.resolve(ref); ok {
+			v.validate(target, value, path, depth)
+		} else {
+			logger.Warn("Unresolved $ref in settings schema: %v\n", ref)
+		}
+	}
+
+	if types, ok := s["type"]; ok && !schemaTypeMatches(types, value) {
+		v.error(path, "type", "expected %v, got %v", schemaTypeNames(types), jsonTypeName(value))
+		return
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.error(path, "enum", "must be one of %v", jsonString(enum))
+		}
+	}
+	if constant, ok := s["const"]; ok && !reflect.DeepEqual(constant, value) {
+		v.error(path, "const", "must be %v", jsonString(constant))
+	}
+
+	switch typed := value.(type) {
+	case string:
+		v.validateString(s, typed, path)
+	case float64:
+		v.validateNumber(s, typed, path)
+	case map[string]interface{}:
+		v.validateObject(s, typed, path, depth)
+	case []interface{}:
+		v.validateArray(s, typed, path, depth)
+	}
+
+	if allOf, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			v.validate(sub, value, path, depth)
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if v.matches(sub, value, path, depth) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.error(path, "anyOf", "does not match any of the allowed schemas")
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range oneOf {
+			if v.matches(sub, value, path, depth) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			v.error(path, "oneOf", "must match exactly one schema, matches %d", matched)
+		}
+	}
+	if not, ok := s["not"]; ok && v.matches(not, value, path, depth) {
+		v.error(path, "not", "matches a schema that is not allowed")
+	}
+	if condition, ok := s["if"]; ok {
+		if v.matches(condition, value, path, depth) {
+			if then, ok := s["then"]; ok {
+				v.validate(then, value, path, depth)
+			}
+		} else if otherwise, ok := s["else"]; ok {
+			v.validate(otherwise, value, path, depth)
+		}
+	}
+}
+
+// validateString checks the string keywords of the schema
+func (v *schemaValidator) validateString(s map[string]interface{}, value string, path string) {
+	length := float64(utf8.RuneCountInString(value))
+	if min, ok := s["minLength"].(float64); ok && length < min {
+		v.error(path, "minLength", "must be at least %v characters long", min)
+	}
+	if max, ok := s["maxLength"].(float64); ok && length > max {
+		v.error(path, "maxLength", "must be at most %v characters long", max)
+	}
+	if expr, ok := s["pattern"].(string); ok {
+		if re := v.pattern(expr); re != nil && !re.MatchString(value) {
+			v.error(path, "pattern", "must match %v", expr)
+		}
+	}
+	if format, ok := s["format"].(string); ok {
+		ip := net.ParseIP(value)
+		valid := true
+		switch format {
+		case "ipv4":
+			valid = ip != nil && ip.To4() != nil && !strings.Contains(value, ":")
+		case "ipv6":
+			valid = ip != nil && strings.Contains(value, ":")
+		case "hostname":
+			valid = len(value) <= 253 && hostnamePattern.MatchString(value)
+		}
+		if !valid {
+			v.error(path, "format", "must be a valid %v", format)
+		}
+	}
+}
+
+// validateNumber checks the numeric keywords of the schema
+// exclusiveMinimum and exclusiveMaximum are accepted both as numbers and as the draft 4 booleans
+func (v *schemaValidator) validateNumber(s map[string]interface{}, value float64, path string) {
+	exclusiveMin, _ := s["exclusiveMinimum"].(bool)
+	exclusiveMax, _ := s["exclusiveMaximum"].(bool)
+	if min, ok := s["minimum"].(float64); ok {
+		if exclusiveMin && value <= min {
+			v.error(path, "exclusiveMinimum", "must be greater than %v", min)
+		} else if value < min {
+			v.error(path, "minimum", "must be at least %v", min)
+		}
+	}
+	if max, ok := s["maximum"].(float64); ok {
+		if exclusiveMax && value >= max {
+			v.error(path, "exclusiveMaximum", "must be less than %v", max)
+		} else if value > max {
+			v.error(path, "maximum", "must be at most %v", max)
+		}
+	}
+	if min, ok := s["exclusiveMinimum"].(float64); ok && value <= min {
+		v.error(path, "exclusiveMinimum", "must be greater than %v", min)
+	}
+	if max, ok := s["exclusiveMaximum"].(float64); ok && value >= max {
+		v.error(path, "exclusiveMaximum", "must be less than %v", max)
+	}
+	if factor, ok := s["multipleOf"].(float64); ok && factor > 0 {
+		quotient := value / factor
+		if math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			v.error(path, "multipleOf", "must be a multiple of %v", factor)
+		}
+	}
+}
+
+// validateObject checks the object keywords of the schema and validates the members
+func (v *schemaValidator) validateObject(s map[string]interface{}, value map[string]interface{}, path string, depth int) {
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, ok := value[key]; !ok {
+					v.error(jsonPointerAppend(path, key), "required", "is required")
+				}
+			}
+		}
+	}
+	if min, ok := s["minProperties"].(float64); ok && float64(len(value)) < min {
+		v.error(path, "minProperties", "must have at least %v members", min)
+	}
+	if max, ok := s["maxProperties"].(float64); ok && float64(len(value)) > max {
+		v.error(path, "maxProperties", "must have at most %v members", max)
+	}
+
+	keys := []string{}
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	properties, _ := s["properties"].(map[string]interface{})
+	patternProperties, _ := s["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := s["additionalProperties"]
+	for _, key := range keys {
+		childPath := jsonPointerAppend(path, key)
+		matched := false
+		if sub, ok := properties[key]; ok {
+			v.validate(sub, value[key], childPath, depth)
+			matched = true
+		}
+		for expr, sub := range patternProperties {
+			if re := v.pattern(expr); re != nil && re.MatchString(key) {
+				v.validate(sub, value[key], childPath, depth)
+				matched = true
+			}
+		}
+		if !matched && hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				v.error(childPath, "additionalProperties", "is not allowed")
+			} else {
+				v.validate(additional, value[key], childPath, depth)
+			}
+		}
+	}
+}
+
+// validateArray checks the array keywords of the schema and validates the items
+func (v *schemaValidator) validateArray(s map[string]interface{}, value []interface{}, path string, depth int) {
+	if min, ok := s["minItems"].(float64); ok && float64(len(value)) < min {
+		v.error(path, "minItems", "must have at least %v items", min)
+	}
+	if max, ok := s["maxItems"].(float64); ok && float64(len(value)) > max {
+		v.error(path, "maxItems", "must have at most %v items", max)
+	}
+	if unique, ok := s["uniqueItems"].(bool); ok && unique {
+		for i := 1; i < len(value); i++ {
+			for j := 0; j < i; j++ {
+				if reflect.DeepEqual(value[i], value[j]) {
+					v.error(jsonPointerAppend(path, strconv.Itoa(i)), "uniqueItems", "duplicates item %d", j)
+					break
+				}
+			}
+		}
+	}
+
+	items, hasItems := s["items"]
+	tuple, isTuple := items.([]interface{})
+	for i, item := range value {
+		childPath := jsonPointerAppend(path, strconv.Itoa(i))
+		switch {
+		case isTuple && i < len(tuple):
+			v.validate(tuple[i], item, childPath, depth)
+		case isTuple:
+			if additional, ok := s["additionalItems"]; ok {
+				if allowed, ok := additional.(bool); ok && !allowed {
+					v.error(childPath, "additionalItems", "is not allowed")
+				} else {
+					v.validate(additional, item, childPath, depth)
+				}
+			}
+		case hasItems:
+			v.validate(items, item, childPath, depth)
+		}
+	}
+}
+
+// schemaTypeMatches returns true if the value has the schema type, or one of the schema types
+func schemaTypeMatches(types interface{}, value interface{}) bool {
+	switch t := types.(type) {
+	case string:
+		name := jsonTypeName(value)
+		return name == t || (t == "number" && name == "integer")
+	case []interface{}:
+		for _, name := range t {
+			if schemaTypeMatches(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// schemaTypeNames returns the schema type, or types, for an error message
+func schemaTypeNames(types interface{}) string {
+	if list, ok := types.([]interface{}); ok {
+		names := []string{}
+		for _, name := range list {
+			names = append(names, fmt.Sprint(name))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(types)
+}
+
+// jsonTypeName returns the JSON Schema type of a decoded JSON value
+func jsonTypeName(value interface{}) string {
+	switch typed := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if typed == math.Trunc(typed) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// jsonString returns the JSON encoding of a value for an error message
+func jsonString(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
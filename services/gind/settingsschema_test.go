@@ -0,0 +1,246 @@
+package gind
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateSettingsSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		doc    string
+		want   []string
+	}{
+		{
+			name:   "valid document",
+			schema: `{"type":"object","properties":{"a":{"type":"integer","minimum":1}},"required":["a"]}`,
+			doc:    `{"a":1}`,
+			want:   []string{},
+		},
+		{
+			name:   "type of a nested member",
+			schema: `{"properties":{"a":{"properties":{"b":{"type":"string"}}}}}`,
+			doc:    `{"a":{"b":1}}`,
+			want:   []string{"/a/b type"},
+		},
+		{
+			name:   "integer is a number but a fraction is not an integer",
+			schema: `{"items":[{"type":"number"},{"type":"integer"}]}`,
+			doc:    `[1,1.5]`,
+			want:   []string{"/1 type"},
+		},
+		{
+			name:   "required member",
+			schema: `{"properties":{"a":{"required":["b","c"]}}}`,
+			doc:    `{"a":{"c":1}}`,
+			want:   []string{"/a/b required"},
+		},
+		{
+			name:   "member names are escaped in the path",
+			schema: `{"additionalProperties":{"additionalProperties":{"maximum":1}}}`,
+			doc:    `{"a/b":{"m~n":2}}`,
+			want:   []string{"/a~1b/m~0n maximum"},
+		},
+		{
+			name:   "additional properties",
+			schema: `{"properties":{"a":{}},"patternProperties":{"^x-":{"type":"string"}},"additionalProperties":false}`,
+			doc:    `{"a":1,"x-b":"c","x-d":1,"e":1}`,
+			want:   []string{"/e additionalProperties", "/x-d type"},
+		},
+		{
+			name:   "$ref to a definition",
+			schema: `{"definitions":{"port":{"type":"integer","minimum":1,"maximum":65535}},"properties":{"ports":{"items":{"$ref":"#/definitions/port"}}}}`,
+			doc:    `{"ports":[80,0,70000]}`,
+			want:   []string{"/ports/1 minimum", "/ports/2 maximum"},
+		},
+		{
+			name:   "$ref with escaped and percent-encoded tokens",
+			schema: `{"definitions":{"a/b":{"type":"string"},"c d":{"type":"integer"},"e~f":{"type":"boolean"}},"items":[{"$ref":"#/definitions/a~1b"},{"$ref":"#/definitions/c%20d"},{"$ref":"#/definitions/e~0f"}]}`,
+			doc:    `[1,"x",null]`,
+			want:   []string{"/0 type", "/1 type", "/2 type"},
+		},
+		{
+			name:   "$ref cycle stops at the maximum depth",
+			schema: `{"definitions":{"a":{"$ref":"#/definitions/b"},"b":{"$ref":"#/definitions/a"}},"$ref":"#/definitions/a"}`,
+			doc:    `{"a":1}`,
+			want:   []string{},
+		},
+		{
+			name:   "self reference stops at the maximum depth",
+			schema: `{"$ref":"#"}`,
+			doc:    `1`,
+			want:   []string{},
+		},
+		{
+			name:   "allOf records the errors of every schema",
+			schema: `{"allOf":[{"minimum":5},{"multipleOf":2}]}`,
+			doc:    `3`,
+			want:   []string{" minimum", " multipleOf"},
+		},
+		{
+			name:   "anyOf",
+			schema: `{"properties":{"a":{"anyOf":[{"type":"string"},{"minimum":5}]}}}`,
+			doc:    `{"a":3}`,
+			want:   []string{"/a anyOf"},
+		},
+		{
+			name:   "anyOf matched",
+			schema: `{"properties":{"a":{"anyOf":[{"type":"string"},{"minimum":5}]}}}`,
+			doc:    `{"a":6}`,
+			want:   []string{},
+		},
+		{
+			name:   "oneOf matching two schemas",
+			schema: `{"oneOf":[{"type":"integer"},{"minimum":0}]}`,
+			doc:    `1`,
+			want:   []string{" oneOf"},
+		},
+		{
+			name:   "oneOf matching one schema",
+			schema: `{"oneOf":[{"type":"integer"},{"minimum":0}]}`,
+			doc:    `-1`,
+			want:   []string{},
+		},
+		{
+			name:   "not",
+			schema: `{"items":{"not":{"type":"string"}}}`,
+			doc:    `[1,"a"]`,
+			want:   []string{"/1 not"},
+		},
+		{
+			name:   "if then",
+			schema: `{"items":{"if":{"type":"string"},"then":{"maxLength":2},"else":{"minimum":10}}}`,
+			doc:    `["ab","abc",10,9]`,
+			want:   []string{"/1 maxLength", "/3 minimum"},
+		},
+		{
+			name:   "draft 4 exclusive bounds",
+			schema: `{"items":[{"minimum":0,"exclusiveMinimum":true},{"maximum":10,"exclusiveMaximum":true},{"minimum":0,"exclusiveMinimum":false}]}`,
+			doc:    `[0,10,0]`,
+			want:   []string{"/0 exclusiveMinimum", "/1 exclusiveMaximum"},
+		},
+		{
+			name:   "draft 6 exclusive bounds",
+			schema: `{"items":[{"exclusiveMinimum":0},{"exclusiveMaximum":10},{"exclusiveMinimum":0,"exclusiveMaximum":10}]}`,
+			doc:    `[0,10,5]`,
+			want:   []string{"/0 exclusiveMinimum", "/1 exclusiveMaximum"},
+		},
+		{
+			name:   "tuple items without additional items",
+			schema: `{"items":[{"type":"string"},{"type":"number"}],"additionalItems":false}`,
+			doc:    `["a","b",3]`,
+			want:   []string{"/1 type", "/2 additionalItems"},
+		},
+		{
+			name:   "tuple items with an additional items schema",
+			schema: `{"items":[{"type":"string"}],"additionalItems":{"type":"integer"}}`,
+			doc:    `["a",1,"b"]`,
+			want:   []string{"/2 type"},
+		},
+		{
+			name:   "array size and unique items",
+			schema: `{"minItems":4,"uniqueItems":true}`,
+			doc:    `[1,{"a":1},{"a":1}]`,
+			want:   []string{" minItems", "/2 uniqueItems"},
+		},
+		{
+			name:   "string length counts characters",
+			schema: `{"items":{"minLength":2,"maxLength":3}}`,
+			doc:    `["é","éèê","éèêë"]`,
+			want:   []string{"/0 minLength", "/2 maxLength"},
+		},
+		{
+			name:   "pattern",
+			schema: `{"items":{"pattern":"^[a-z]+$"}}`,
+			doc:    `["abc","ABC"]`,
+			want:   []string{"/1 pattern"},
+		},
+		{
+			name:   "formats",
+			schema: `{"properties":{"ipv4":{"items":{"format":"ipv4"}},"ipv6":{"items":{"format":"ipv6"}},"hostname":{"items":{"format":"hostname"}},"other":{"format":"uri"}}}`,
+			doc:    `{"ipv4":["192.0.2.1","192.0.2.256","::ffff:192.0.2.1"],"ipv6":["2001:db8::1","192.0.2.1"],"hostname":["host.example.com","-host","a_b"],"other":"not checked"}`,
+			want:   []string{"/hostname/1 format", "/hostname/2 format", "/ipv4/1 format", "/ipv4/2 format", "/ipv6/1 format"},
+		},
+		{
+			name:   "enum and const",
+			schema: `{"properties":{"a":{"enum":["x",1]},"b":{"const":{"c":[1]}}}}`,
+			doc:    `{"a":"y","b":{"c":[2]}}`,
+			want:   []string{"/a enum", "/b const"},
+		},
+		{
+			name:   "false schema",
+			schema: `{"properties":{"a":false}}`,
+			doc:    `{"a":1}`,
+			want:   []string{"/a false"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := []string{}
+			for _, validationError := range validateSettingsSchema(decodeJSON(t, test.schema), decodeJSON(t, test.doc)) {
+				got = append(got, validationError.Path+" "+validationError.Keyword)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("validateSettingsSchema() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// the expected documents follow setSettingsInJSON and TrimSettingsFile of golang-shared
+// they can not be compared with settings.SetSettingsFile and settings.TrimSettingsFile directly
+// because those only write the file after sync-settings applied it to the system
+func TestSettingsWithValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		segments []string
+		value    string
+		want     string
+	}{
+		{"replace the document", `{"a":1}`, nil, `{"b":2}`, `{"b":2}`},
+		{"replace a member", `{"a":{"b":1}}`, []string{"a", "b"}, `2`, `{"a":{"b":2}}`},
+		{"add a member", `{"a":{}}`, []string{"a", "b"}, `[1]`, `{"a":{"b":[1]}}`},
+		{"create missing parents", `{}`, []string{"a", "b", "c"}, `1`, `{"a":{"b":{"c":1}}}`},
+		{"null parent is replaced", `{"a":null}`, []string{"a", "b"}, `1`, `{"a":{"b":1}}`},
+		{"scalar parent is replaced", `{"a":1}`, []string{"a", "b"}, `1`, `{"a":{"b":1}}`},
+		{"array element", `{"a":[1,2]}`, []string{"a", "1"}, `3`, `{"a":[1,3]}`},
+		{"array parent of a nested path is replaced", `{"a":[{"b":1}]}`, []string{"a", "0", "b"}, `2`, `{"a":{"0":{"b":2}}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := settingsWithValue(decodeJSON(t, test.doc), test.segments, decodeJSON(t, test.value))
+			if want := decodeJSON(t, test.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("settingsWithValue() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSettingsWithoutValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		segments []string
+		want     string
+	}{
+		{"remove a member", `{"a":{"b":1,"c":2}}`, []string{"a", "b"}, `{"a":{"c":2}}`},
+		{"remove a top level member", `{"a":1,"b":2}`, []string{"a"}, `{"b":2}`},
+		{"missing member", `{"a":{"c":2}}`, []string{"a", "b"}, `{"a":{"c":2}}`},
+		{"missing parent", `{"a":1}`, []string{"b", "c"}, `{"a":1}`},
+		{"null parent", `{"a":null}`, []string{"a", "b"}, `{"a":null}`},
+		{"array parent is left unchanged, golang-shared rejects it", `{"a":[1,2]}`, []string{"a", "0"}, `{"a":[1,2]}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := settingsWithoutValue(decodeJSON(t, test.doc), test.segments)
+			if want := decodeJSON(t, test.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("settingsWithoutValue() = %v, want %v", got, want)
+			}
+		})
+	}
+}
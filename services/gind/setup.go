@@ -0,0 +1,284 @@
+package gind
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+	"github.com/untangle/golang-shared/services/settings"
+)
+
+// setupUsername is the session username of clients running the setup wizard
+const setupUsername = "setup"
+
+// setupCodeHeader is the header in which clients send the setup code
+const setupCodeHeader = "X-Setup-Code"
+
+// setupCodeDigits is the length of the setup code
+const setupCodeDigits = 8
+
+// defaultSetupNetworks are the LAN side source addresses allowed to run the setup wizard
+var defaultSetupNetworks = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// defaultSetupPaths are the /api path prefixes a setup session may use
+var defaultSetupPaths = []string{
+	"/api/settings",
+	"/api/defaults",
+	"/api/status",
+	"/api/account/password",
+}
+
+// setupConfig holds the system.restd.setup settings
+type setupConfig struct {
+	requireCode     bool
+	codeLifetime    time.Duration
+	maxCodeAttempts int
+	allowedNetworks []*net.IPNet
+	allowedPrefixes []string
+	announceConsole bool
+	consoleDevice   string
+}
+
+var setupCodeMutex sync.Mutex
+var setupCode string
+var setupCodeExpires time.Time
+var setupCodeAttempts int
+
+// getSetupConfig reads the setup mode settings, applying defaults for anything not configured
+func getSetupConfig() setupConfig {
+	jsonObject := getRestdSettings("setup")
+	config := setupConfig{
+		requireCode:     settingBool(jsonObject, "requireCode", true),
+		codeLifetime:    time.Duration(settingInt(jsonObject, "codeLifetimeMinutes", 60)) * time.Minute,
+		maxCodeAttempts: int(settingInt(jsonObject, "maxCodeAttempts", 5)),
+		allowedNetworks: []*net.IPNet{},
+		allowedPrefixes: settingStrings(jsonObject, "allowedPaths"),
+		announceConsole: settingBool(jsonObject, "announceConsole", true),
+		consoleDevice:   settingString(jsonObject, "consoleDevice", "/dev/console"),
+	}
+	if len(config.allowedPrefixes) == 0 {
+		config.allowedPrefixes = defaultSetupPaths
+	}
+
+	networks := settingStrings(jsonObject, "allowedNetworks")
+	if len(networks) == 0 {
+		networks = defaultSetupNetworks
+	}
+	for _, cidr := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.Warn("Invalid setup network %v: %v\n", cidr, err)
+			continue
+		}
+		config.allowedNetworks = append(config.allowedNetworks, network)
+	}
+	return config
+}
+
+// getSetupWizardState returns true if the setup wizard is completed
+// an error is returned if the setting can not be read or is not a boolean
+func getSetupWizardState() (bool, error) {
+	wizardCompletedJSON, err := settings.GetSettings([]string{"system", "setupWizard", "completed"})
+	if err != nil {
+		return false, err
+	}
+	if wizardCompletedJSON == nil {
+		return false, errors.New("setting is missing")
+	}
+	wizardCompletedBool, ok := wizardCompletedJSON.(bool)
+	if !ok {
+		return false, fmt.Errorf("invalid type %v", reflect.TypeOf(wizardCompletedJSON))
+	}
+	return wizardCompletedBool, nil
+}
+
+// setupModeActive returns true if the setup wizard has not been completed
+// setup mode is never entered when the setting can not be read, so a broken settings file does
+// not open the API to unauthenticated clients
+func setupModeActive() bool {
+	completed, err := getSetupWizardState()
+	if err != nil {
+		logger.Warn("Failed to read setup wizard completed settings, setup mode disabled: %v\n", err)
+		return false
+	}
+	return !completed
+}
+
+// setupSourceAllowed returns true if the request comes from a LAN side address, or from a
+// local socket process whose uid is mapped to a role
+func setupSourceAllowed(c *gin.Context, config setupConfig) bool {
+	if creds, ok := parsePeerCredentials(c.Request.RemoteAddr); ok {
+		return localSocketRole(creds, getLocalSocketConfig()) != ""
+	}
+	ip := net.ParseIP(requestSourceIP(c.Request))
+	if ip == nil {
+		return false
+	}
+	for _, network := range config.allowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setupPathAllowed returns true if a setup session may use the requested path
+// only /api paths are restricted, the account and static admin UI paths are always allowed
+func setupPathAllowed(c *gin.Context, config setupConfig) bool {
+	path := c.Request.URL.Path
+	if !strings.HasPrefix(path, "/api/") {
+		return true
+	}
+	for _, prefix := range config.allowedPrefixes {
+		// prefixes match whole path segments, /api/settings does not allow /api/settings-history
+		prefix = strings.TrimRight(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// generateSetupCode creates a new setup code and announces it on the log and console
+// the caller must hold setupCodeMutex
+func generateSetupCode(config setupConfig) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(setupCodeDigits), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		logger.Warn("Failed to generate setup code: %v\n", err)
+		setupCode = ""
+		return
+	}
+	setupCode = fmt.Sprintf("%0*d", setupCodeDigits, n)
+	setupCodeExpires = time.Now().Add(config.codeLifetime)
+	setupCodeAttempts = 0
+
+	message := fmt.Sprintf("Setup code: %v (valid until %v)", setupCode, setupCodeExpires.Format(time.RFC1123))
+	logger.Notice("%v\n", message)
+	if config.announceConsole {
+		console, err := os.OpenFile(config.consoleDevice, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			logger.Debug("Failed to open %v: %v\n", config.consoleDevice, err)
+			return
+		}
+		fmt.Fprintf(console, "\nrestd: %v\n", message)
+		console.Close()
+	}
+}
+
+// startSetupCode announces the first setup code when restd starts in setup mode
+func startSetupCode() {
+	config := getSetupConfig()
+	if !config.requireCode || !setupModeActive() {
+		return
+	}
+	setupCodeMutex.Lock()
+	defer setupCodeMutex.Unlock()
+	generateSetupCode(config)
+}
+
+// checkSetupCode checks the setup code and consumes it if valid
+// a new code is generated once the current one expires, is used, or has been guessed too many times
+func checkSetupCode(config setupConfig, code string) bool {
+	setupCodeMutex.Lock()
+	defer setupCodeMutex.Unlock()
+
+	if setupCode == "" || time.Now().After(setupCodeExpires) {
+		generateSetupCode(config)
+		return false
+	}
+	if code == "" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(setupCode)) == 1 {
+		// the code is single use, the next one is announced when it is needed
+		setupCode = ""
+		return true
+	}
+
+	setupCodeAttempts++
+	if setupCodeAttempts >= config.maxCodeAttempts {
+		logger.Warn("Too many invalid setup codes, generating a new one\n")
+		generateSetupCode(config)
+	}
+	return false
+}
+
+// checkSetupAuth grants a setup session to a LAN client with the setup code while the setup wizard is not completed
+// if the setup code is missing or invalid it sends a 401 and aborts the request
+// returns bool - true for successful auth, false if we should continue to next auth method
+func checkSetupAuth(c *gin.Context) bool {
+	if !setupModeActive() {
+		return false
+	}
+	config := getSetupConfig()
+	if !setupSourceAllowed(c, config) {
+		logger.Info("Setup mode is not available to %v\n", requestSourceIP(c.Request))
+		return false
+	}
+	if !setupPathAllowed(c, config) {
+		return false
+	}
+
+	if config.requireCode {
+		code := c.GetHeader(setupCodeHeader)
+		if code == "" {
+			code = c.PostForm("setupCode")
+		}
+		if !checkSetupCode(config, strings.TrimSpace(code)) {
+			if code != "" {
+				auditEvent(c, auditEventLoginFailure, setupUsername, authMethodSetup, "invalid setup code")
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Setup code required", "setupCodeRequired": true})
+			c.Abort()
+			return false
+		}
+	}
+	return true
+}
+
+// checkSetupSession checks that a setup session may still be used for the request
+// the session is removed once the setup wizard is completed, and requests from outside the LAN
+// or to paths not needed by the wizard are rejected with a 403
+// returns bool - true if the request may continue with the setup session
+func checkSetupSession(c *gin.Context) bool {
+	if !setupModeActive() {
+		logger.Info("Setup wizard completed, removing setup session\n")
+		session := sessions.Default(c)
+		session.Clear()
+		session.Options(sessionOptions(c, -1))
+		if err := session.Save(); err != nil {
+			logger.Warn("Error saving session: %s\n", err.Error())
+		}
+		return false
+	}
+
+	config := getSetupConfig()
+	if !setupSourceAllowed(c, config) || !setupPathAllowed(c, config) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed in setup mode"})
+		c.Abort()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+package gind
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSetupSourceAllowed(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	config := setupConfig{allowedNetworks: []*net.IPNet{lan}}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       bool
+	}{
+		{"local socket uid mapped to a role", peerCredentials{uid: 0, gid: 0, pid: 1}.String(), true},
+		{"local socket uid not mapped", peerCredentials{uid: 1000, gid: 1000, pid: 1}.String(), false},
+		{"malformed local socket address", peerCredPrefix + "0", false},
+		{"allowed network", "192.168.1.10:4000", true},
+		{"other network", "10.0.0.1:4000", false},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/settings", nil)
+			c.Request.RemoteAddr = test.remoteAddr
+			if got := setupSourceAllowed(c, config); got != test.want {
+				t.Errorf("setupSourceAllowed() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,475 @@
+package gind
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/golang-shared/services/logger"
+)
+
+// TOTP parameters (RFC 6238), these are the defaults understood by every authenticator app
+const (
+	totpPeriod  = 30
+	totpDigits  = 6
+	totpSkew    = 1
+	totpIssuer  = "MFW"
+	totpHeader  = "X-Restd-TOTP"
+	totpPending = 5 * time.Minute
+)
+
+// totpEnrollRequiredKey is the gin context key flagging a request without a session as limited to TOTP enrollment
+const totpEnrollRequiredKey = "totpEnrollRequired"
+
+// totpRecoveryCodeCount is the number of recovery codes generated on enrollment
+const totpRecoveryCodeCount = 10
+
+// totpEnrollment is a secret waiting for its first code to be verified
+type totpEnrollment struct {
+	secret  string
+	expires time.Time
+}
+
+var totpEnrollments = make(map[string]totpEnrollment)
+var totpEnrollmentMutex sync.Mutex
+
+// totpLastStep holds the time step of the last code accepted for each user
+var totpLastStep = make(map[string]int64)
+var totpLastStepMutex sync.Mutex
+
+// totpCodeRequest is the body of the POSTs to /api/account/totp and /api/account/totp/verify
+// and of a DELETE of /api/account/totp, codes are never passed in the URL where they would be logged
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// errRecoveryCodeUsed aborts the removal of a recovery code that is no longer stored
+var errRecoveryCodeUsed = errors.New("recovery code already used")
+
+// generateTOTPSecret returns a new random base32 encoded secret
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// totpCode returns the code of the specified secret for the specified time step (RFC 4226/6238)
+func totpCode(secret string, counter uint64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// checkTOTP returns the time step of the code if it is valid for the secret at the current time
+// codes from the adjacent time steps are accepted to allow for clock drift
+func checkTOTP(secret string, code string) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	counter := time.Now().Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		expected, err := totpCode(secret, uint64(counter+int64(i)))
+		if err != nil {
+			logger.Warn("Invalid TOTP secret: %v\n", err)
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+// acceptTOTPStep records the time step of a code accepted for the user
+// returns false if a code of the same or a later step was already accepted, so a code can only be used once
+func acceptTOTPStep(username string, step int64) bool {
+	totpLastStepMutex.Lock()
+	defer totpLastStepMutex.Unlock()
+
+	if last, ok := totpLastStep[username]; ok && step <= last {
+		return false
+	}
+	totpLastStep[username] = step
+	return true
+}
+
+// totpProvisioningURI returns the otpauth URI for the secret, suitable for a QR code
+func totpProvisioningURI(username string, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprintf("%d", totpDigits))
+	values.Set("period", fmt.Sprintf("%d", totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// totpEnabled returns true if the account has a verified TOTP secret
+func totpEnabled(credentialsJSON map[string]interface{}) bool {
+	secret, _ := credentialsJSON["totpSecret"].(string)
+	return settingBool(credentialsJSON, "totpEnabled", false) && secret != ""
+}
+
+// totpRequired returns true if the account policy requires a second factor
+func totpRequired(credentialsJSON map[string]interface{}) bool {
+	return settingBool(credentialsJSON, "totpRequired", false)
+}
+
+// hashRecoveryCode returns the hex encoded SHA-256 of a normalized recovery code
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifySecondFactor checks the code as either a TOTP code or an unused recovery code of the user
+// a recovery code is removed from the account once used
+func verifySecondFactor(username string, code string) bool {
+	credentialsJSON := getCredentials(username)
+	if !totpEnabled(credentialsJSON) {
+		return false
+	}
+
+	secret, _ := credentialsJSON["totpSecret"].(string)
+	if step, ok := checkTOTP(secret, code); ok {
+		if !acceptTOTPStep(username, step) {
+			logger.Info("Rejected reused two-factor code of %v\n", username)
+			return false
+		}
+		return true
+	}
+
+	hash := hashRecoveryCode(code)
+	recoveryCodes, _ := credentialsJSON["totpRecoveryCodes"].([]interface{})
+	if _, ok := removeRecoveryCode(recoveryCodes, hash); !ok {
+		return false
+	}
+
+	// the code is checked again and removed in a single settings update, so concurrent logins can not both use it
+	err := updateStoredCredentials(func(credentialsSlice []interface{}) ([]interface{}, error) {
+		for _, json := range credentialsSlice {
+			cred, ok := json.(map[string]interface{})
+			if !ok || cred["username"] != username {
+				continue
+			}
+			codes, _ := cred["totpRecoveryCodes"].([]interface{})
+			remaining, ok := removeRecoveryCode(codes, hash)
+			if !ok {
+				return nil, errRecoveryCodeUsed
+			}
+			cred["totpRecoveryCodes"] = remaining
+			return credentialsSlice, nil
+		}
+		return nil, errors.New("Account not found: " + username)
+	})
+	if err != nil {
+		logger.Warn("Failed to use recovery code for %v: %v\n", username, err)
+		return false
+	}
+	logger.Info("Recovery code used by %v\n", username)
+	return true
+}
+
+// removeRecoveryCode returns the recovery code hashes without the specified one
+// returns false if the hash is not one of them
+func removeRecoveryCode(recoveryCodes []interface{}, hash string) ([]interface{}, bool) {
+	remaining := []interface{}{}
+	found := false
+	for _, stored := range recoveryCodes {
+		storedHash, _ := stored.(string)
+		if subtle.ConstantTimeCompare([]byte(storedHash), []byte(hash)) == 1 {
+			found = true
+			continue
+		}
+		remaining = append(remaining, stored)
+	}
+	return remaining, found
+}
+
+// setPendingTOTPSession marks the session as waiting for the second factor of the specified user
+func setPendingTOTPSession(c *gin.Context, username string, method string) bool {
+	session := sessions.Default(c)
+	session.Clear()
+	renewSessionID(c)
+	session.Set("pendingUsername", username)
+	session.Set("pendingMethod", method)
+	session.Set("pendingIssued", time.Now().Unix())
+	session.Options(sessionOptions(c, int(totpPending.Seconds())))
+	return session.Save() == nil
+}
+
+// checkTOTPPending completes a login waiting for its second factor, if the request carries a valid code
+// if the code is invalid it sends a 401 and aborts the request
+// returns bool - true for successful auth, false if we should continue to next auth method
+// returns string - the username of the completed login
+// returns string - the authentication method of the completed login
+func checkTOTPPending(c *gin.Context) (bool, string, string) {
+	session := sessions.Default(c)
+	username, _ := session.Get("pendingUsername").(string)
+	if username == "" {
+		return false, "", ""
+	}
+	method, _ := session.Get("pendingMethod").(string)
+	issued, _ := session.Get("pendingIssued").(int64)
+	if time.Since(time.Unix(issued, 0)) > totpPending {
+		return false, "", ""
+	}
+
+	code := c.PostForm("totp")
+	if code == "" {
+		return false, "", ""
+	}
+
+	ip := requestSourceIP(c.Request)
+	if wait := loginRetryAfter(username, ip); wait > 0 {
+		c.Header("Retry-After", fmt.Sprintf("%d", int64(wait.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts"})
+		c.Abort()
+		return false, "", ""
+	}
+	if !verifySecondFactor(username, code) {
+		logger.Info("Failed second factor: %v\n", username)
+		auditEvent(c, auditEventLoginFailure, username, method, "invalid two-factor code")
+		recordLoginFailure(username, ip)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code", "twoFactorRequired": true})
+		c.Abort()
+		return false, "", ""
+	}
+
+	recordLoginSuccess(username)
+	return true, username, method + "+totp"
+}
+
+// requireSecondFactor is called once a user's password has been validated
+// if the account has TOTP enabled and code is not valid, the login is left pending, a 401 is sent and the request aborted
+// returns the authentication method to record in the session
+func requireSecondFactor(c *gin.Context, username string, method string, code string) string {
+	credentialsJSON := getCredentials(username)
+	if !totpEnabled(credentialsJSON) {
+		return method
+	}
+	if code != "" && verifySecondFactor(username, code) {
+		return method + "+totp"
+	}
+	if code != "" {
+		auditEvent(c, auditEventLoginFailure, username, method, "invalid two-factor code")
+		recordLoginFailure(username, requestSourceIP(c.Request))
+	}
+
+	// basic auth and client certificate clients do not keep the session, so they must always send the code
+	// codes can only be used once, so automation should use an API key instead
+	if method != authMethodBasic && method != authMethodCertificate && !setPendingTOTPSession(c, username, method) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Authorization failed: Failed to create pending session"})
+		c.Abort()
+		return method
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Two-factor authentication required", "twoFactorRequired": true})
+	c.Abort()
+	return method
+}
+
+// markTOTPEnrollment flags the session, or the request if it has none, as limited to TOTP enrollment if
+// the account policy requires a second factor that the user has not set up yet
+func markTOTPEnrollment(c *gin.Context, username string) {
+	credentialsJSON := getCredentials(username)
+	if !totpRequired(credentialsJSON) || totpEnabled(credentialsJSON) {
+		return
+	}
+
+	if _, ok := c.Get(authUsernameKey); ok {
+		// requests authenticated without a session carry the flag themselves
+		c.Set(totpEnrollRequiredKey, true)
+		return
+	}
+	session := sessions.Default(c)
+	session.Set("totpEnrollRequired", true)
+	if err := session.Save(); err != nil {
+		logger.Warn("Error saving session: %s\n", err.Error())
+	}
+}
+
+// totpEnrollmentPending returns true if the session is limited to TOTP enrollment
+func totpEnrollmentPending(c *gin.Context) bool {
+	if value, ok := c.Get(totpEnrollRequiredKey); ok {
+		required, _ := value.(bool)
+		return required
+	}
+	session := sessions.Default(c)
+	required, _ := session.Get("totpEnrollRequired").(bool)
+	return required
+}
+
+// accountTOTPEnroll is the POST /api/account/totp handler
+// it generates a new secret for the current user, which is enabled once a code is verified
+// replacing an enabled secret requires a valid code of the current one in the "code" field of the body
+func accountTOTPEnroll(c *gin.Context) {
+	username := getAuthUsername(c)
+	credentialsJSON := getCredentials(username)
+	if credentialsJSON == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication requires a local account"})
+		return
+	}
+	if totpEnabled(credentialsJSON) {
+		var request totpCodeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		if !verifySecondFactor(username, request.Code) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid two-factor code"})
+			return
+		}
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret: " + err.Error()})
+		return
+	}
+
+	totpEnrollmentMutex.Lock()
+	totpEnrollments[username] = totpEnrollment{secret: secret, expires: time.Now().Add(10 * time.Minute)}
+	totpEnrollmentMutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+		"uri":    totpProvisioningURI(username, secret),
+		"issuer": totpIssuer,
+		"digits": totpDigits,
+		"period": totpPeriod,
+	})
+}
+
+// accountTOTPVerify is the POST /api/account/totp/verify handler
+// it enables the pending secret if the code is valid and returns the recovery codes
+func accountTOTPVerify(c *gin.Context) {
+	var request totpCodeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	username := getAuthUsername(c)
+	totpEnrollmentMutex.Lock()
+	enrollment, ok := totpEnrollments[username]
+	totpEnrollmentMutex.Unlock()
+	if !ok || time.Now().After(enrollment.expires) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No pending enrollment"})
+		return
+	}
+	step, ok := checkTOTP(enrollment.secret, request.Code)
+	if !ok || !acceptTOTPStep(username, step) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid two-factor code"})
+		return
+	}
+
+	recoveryCodes := []string{}
+	recoveryHashes := []interface{}{}
+	for i := 0; i < totpRecoveryCodeCount; i++ {
+		code, err := randomHex(5)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes: " + err.Error()})
+			return
+		}
+		recoveryCodes = append(recoveryCodes, code[:5]+"-"+code[5:])
+		recoveryHashes = append(recoveryHashes, hashRecoveryCode(code))
+	}
+
+	err := updateCredentials(username, func(cred map[string]interface{}) {
+		cred["totpEnabled"] = true
+		cred["totpSecret"] = enrollment.secret
+		cred["totpRecoveryCodes"] = recoveryHashes
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save two-factor settings: " + err.Error()})
+		return
+	}
+
+	totpEnrollmentMutex.Lock()
+	delete(totpEnrollments, username)
+	totpEnrollmentMutex.Unlock()
+
+	session := sessions.Default(c)
+	if session.Get("totpEnrollRequired") != nil {
+		session.Delete("totpEnrollRequired")
+		if err := session.Save(); err != nil {
+			logger.Warn("Error saving session: %s\n", err.Error())
+		}
+	}
+
+	logger.Info("Two-factor authentication enabled for %v\n", username)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled", "recoveryCodes": recoveryCodes})
+}
+
+// accountTOTPDisable is the DELETE /api/account/totp handler
+// users may disable their own second factor with a valid code in the "code" field of the body,
+// users with PermAccountsAdmin may reset the second factor of the account in the "username" query argument
+func accountTOTPDisable(c *gin.Context) {
+	username := getAuthUsername(c)
+	target := c.Query("username")
+	if target != "" && target != username {
+		if !requestHasPermission(c, PermAccountsAdmin) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied: missing permission " + string(PermAccountsAdmin), "permission": PermAccountsAdmin})
+			return
+		}
+	} else {
+		target = username
+		var request totpCodeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+		if !verifySecondFactor(username, request.Code) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid two-factor code"})
+			return
+		}
+	}
+
+	err := updateCredentials(target, func(cred map[string]interface{}) {
+		delete(cred, "totpEnabled")
+		delete(cred, "totpSecret")
+		delete(cred, "totpRecoveryCodes")
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save two-factor settings: " + err.Error()})
+		return
+	}
+
+	logger.Info("Two-factor authentication disabled for %v by %v\n", target, username)
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
@@ -0,0 +1,35 @@
+package gind
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRemoveRecoveryCode(t *testing.T) {
+	first := hashRecoveryCode("abcde-12345")
+	second := hashRecoveryCode("fghij-67890")
+
+	tests := []struct {
+		name      string
+		stored    []interface{}
+		code      string
+		want      []interface{}
+		wantFound bool
+	}{
+		{"first code", []interface{}{first, second}, "abcde-12345", []interface{}{second}, true},
+		{"code without separator or case", []interface{}{first, second}, " FGHIJ67890 ", []interface{}{first}, true},
+		{"last code", []interface{}{first}, "abcde-12345", []interface{}{}, true},
+		{"unknown code", []interface{}{first, second}, "abcde-12346", []interface{}{first, second}, false},
+		{"already used", []interface{}{second}, "abcde-12345", []interface{}{second}, false},
+		{"no codes", nil, "abcde-12345", []interface{}{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, found := removeRecoveryCode(test.stored, hashRecoveryCode(test.code))
+			if found != test.wantFound || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("removeRecoveryCode() = %v, %v, want %v, %v", got, found, test.want, test.wantFound)
+			}
+		})
+	}
+}